@@ -1,18 +1,28 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net/http"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/mattbaird/jsonpatch"
 	"github.com/regclient/regclient/config"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 )
 
 const (
@@ -20,6 +30,29 @@ const (
 	AnnotationSkipMutation = "k8smultiarcher.programmerq.io/skip-mutation"
 	// AnnotationNamespaceDisabled is the namespace annotation key to disable mutation
 	AnnotationNamespaceDisabled = "k8smultiarcher.programmerq.io/disabled"
+	// AnnotationNamespacePlatforms is the namespace annotation key that narrows the configured platforms
+	AnnotationNamespacePlatforms = "k8smultiarcher.programmerq.io/platforms"
+	// AnnotationNoCache is the annotation key that makes platform detection for
+	// the object bypass cached results and inspect its images afresh
+	AnnotationNoCache = "k8smultiarcher.programmerq.io/no-cache"
+	// AnnotationDetectedPlatforms is the annotation key recording the
+	// comma-separated platforms detected for the object under DECISION_ONLY
+	AnnotationDetectedPlatforms = "k8smultiarcher.programmerq.io/detected-platforms"
+
+	// subResourceEphemeralContainers is the pod subresource used to add ephemeral containers
+	subResourceEphemeralContainers = "ephemeralcontainers"
+)
+
+// Admission errors, wrapped by the errors ProcessAdmissionReview and
+// AdmissionReviewFromRequest return so mutateHandler can tell a malformed
+// request from a failure of the webhook itself.
+var (
+	// ErrBadRequest marks an error caused by the request, such as a body or
+	// object that cannot be decoded or a kind STRICT_KINDS rejects.
+	ErrBadRequest = errors.New("bad admission request")
+	// ErrInternal marks an error of the webhook, such as failing to build the
+	// patch.
+	ErrInternal = errors.New("internal admission error")
 )
 
 // PodHasSkipAnnotation returns true if the pod has the skip-mutation annotation set to "true"
@@ -38,13 +71,25 @@ func PodTemplateHasSkipAnnotation(template *corev1.PodTemplateSpec) bool {
 	return template.Annotations[AnnotationSkipMutation] == "true"
 }
 
+// withNoCacheAnnotation returns a context that bypasses cached platform results
+// when annotations set the no-cache annotation to "true", and ctx otherwise.
+func withNoCacheAnnotation(ctx context.Context, annotations map[string]string) context.Context {
+	if annotations[AnnotationNoCache] != "true" {
+		return ctx
+	}
+	slog.Info("bypassing cached platform results due to no-cache annotation")
+	return withCacheBypass(ctx)
+}
+
 // shouldSkipMutation reports whether mutation should be skipped for an object,
-// based on its skip-mutation annotation, the namespace filter config, and the
-// namespace's disabled annotation. The kind and name are used only for logging.
+// based on its skip-mutation annotation, its pod labels against the pod label
+// selector, the namespace filter config, and the namespace's disabled
+// annotation. The kind and name are used only for logging.
 func shouldSkipMutation(
 	ctx context.Context,
 	kind, name, namespace string,
 	hasSkipAnnotation bool,
+	podLabels map[string]string,
 	namespaceFilterCfg *NamespaceFilterConfig,
 ) bool {
 	if hasSkipAnnotation {
@@ -52,6 +97,11 @@ func shouldSkipMutation(
 		return true
 	}
 
+	if namespaceFilterCfg.ShouldSkipPodLabels(podLabels) {
+		slog.Info("skipping mutation due to pod label selector", "kind", kind, "name", name, "namespace", namespace)
+		return true
+	}
+
 	// Check if namespace is filtered by namespace selector or ignore list
 	if namespace != "" && IsNamespaceFiltered(ctx, namespace, namespaceFilterCfg) {
 		slog.Info("skipping mutation due to namespace filter", "namespace", namespace)
@@ -67,6 +117,26 @@ func shouldSkipMutation(
 	return false
 }
 
+// namespacePlatformConfig narrows config to the platforms allowed by the
+// namespace's platforms annotation. It returns config unchanged when the
+// namespace has no override.
+func namespacePlatformConfig(
+	ctx context.Context,
+	namespace string,
+	config *PlatformTolerationConfig,
+) *PlatformTolerationConfig {
+	allowed := GetNamespacePlatforms(ctx, namespace)
+	if allowed == nil {
+		return config
+	}
+	slog.Info("applying namespace platforms override", "namespace", namespace, "platforms", allowed)
+	return config.RestrictToPlatforms(allowed)
+}
+
+// ProcessAdmissionReview decodes an AdmissionReview request body, computes the
+// toleration patch for it, and records the outcome in the admission metrics.
+// Errors wrap ErrBadRequest or ErrInternal; when the body decoded, the review
+// is returned alongside the error without a response.
 func ProcessAdmissionReview(
 	ctx context.Context,
 	cache Cache,
@@ -76,127 +146,654 @@ func ProcessAdmissionReview(
 ) (*admissionv1.AdmissionReview, error) {
 	review, err := AdmissionReviewFromRequest(requestBody)
 	if err != nil {
+		recordAdmissionOutcome("", "", admissionOutcomeError)
 		return nil, err
 	}
 
+	result, err := mutateAdmissionReview(ctx, cache, config, namespaceFilterCfg, review)
+	recordAdmissionOutcome(review.Request.Kind.Kind, review.Request.Namespace, admissionOutcome(result, err))
+	return result, err
+}
+
+// podTemplateKind describes a kind whose pods are created from a pod template,
+// which is all mutateAdmissionReview needs to inspect and patch it.
+type podTemplateKind struct {
+	// newObject returns an empty object to decode the request object into.
+	newObject func() metav1.Object
+	// template returns the object's pod template, or nil when it has none.
+	template func(obj metav1.Object) *corev1.PodTemplateSpec
+	// templatePath is the JSON Pointer of the pod template in the object.
+	templatePath string
+	// platforms, when set, replaces GetPodTemplateSupportedPlatforms.
+	platforms func(
+		ctx context.Context, cache Cache, config *PlatformTolerationConfig,
+		obj metav1.Object, registryHosts []config.Host,
+	) []string
+}
+
+// newPodTemplateKind returns the podTemplateKind of the object type T, whose
+// pod template template returns and templatePath locates.
+func newPodTemplateKind[T any, P interface {
+	*T
+	metav1.Object
+}](templatePath string, template func(P) *corev1.PodTemplateSpec) podTemplateKind {
+	return podTemplateKind{
+		newObject:    func() metav1.Object { return P(new(T)) },
+		template:     func(obj metav1.Object) *corev1.PodTemplateSpec { return template(obj.(P)) },
+		templatePath: templatePath,
+	}
+}
+
+// podTemplateKinds holds the kinds other than Pod that mutateAdmissionReview
+// supports, by kind name.
+var podTemplateKinds = map[string]podTemplateKind{
+	"DaemonSet": func() podTemplateKind {
+		kind := newPodTemplateKind("/spec/template", func(ds *appsv1.DaemonSet) *corev1.PodTemplateSpec {
+			return &ds.Spec.Template
+		})
+		kind.platforms = func(
+			ctx context.Context, cache Cache, config *PlatformTolerationConfig,
+			obj metav1.Object, registryHosts []config.Host,
+		) []string {
+			return GetDaemonSetSupportedPlatforms(ctx, cache, config, obj.(*appsv1.DaemonSet), registryHosts)
+		}
+		return kind
+	}(),
+	// Unlike the apps/v1 workloads, a ReplicationController's template is
+	// optional, and there is nothing to mutate without one.
+	"ReplicationController": newPodTemplateKind("/spec/template",
+		func(rc *corev1.ReplicationController) *corev1.PodTemplateSpec { return rc.Spec.Template }),
+	// The pods a CronJob creates come from the template nested in its
+	// jobTemplate, which is what gets inspected and patched.
+	"CronJob": newPodTemplateKind("/spec/jobTemplate/spec/template",
+		func(cj *batchv1.CronJob) *corev1.PodTemplateSpec { return &cj.Spec.JobTemplate.Spec.Template }),
+}
+
+// specMutation describes the change made to an admitted object's pod spec,
+// from which the patch is built.
+type specMutation struct {
+	originalBytes []byte
+	modifiedBytes []byte
+	// tolerationsPath, existingTolerations, strippedTolerations, and
+	// addedTolerations describe the toleration change for the append patch
+	// strategy.
+	tolerationsPath     string
+	existingTolerations []corev1.Toleration
+	strippedTolerations []int
+	addedTolerations    []corev1.Toleration
+	// nodeSelectorPath, hadNodeSelector, and addedNodeSelector describe the
+	// nodeSelector change the same way.
+	nodeSelectorPath  string
+	hadNodeSelector   bool
+	addedNodeSelector map[string]string
+	// platforms are the supported platforms the change was made for.
+	platforms []string
+	// name and namespace identify the mutated object in logs.
+	name      string
+	namespace string
+}
+
+// mutatePodSpec adds the tolerations and node selector labels for
+// supportedPlatforms to spec, found at the JSON Pointer specPath, after
+// stripping tolerations under StripUnsupportedTolerations when strip is set.
+func mutatePodSpec(
+	ctx context.Context,
+	config *PlatformTolerationConfig,
+	spec *corev1.PodSpec,
+	specPath string,
+	supportedPlatforms []string,
+	strip bool,
+) *specMutation {
+	m := &specMutation{
+		tolerationsPath:  specPath + "/tolerations",
+		nodeSelectorPath: specPath + "/nodeSelector",
+		hadNodeSelector:  spec.NodeSelector != nil,
+		platforms:        supportedPlatforms,
+	}
+	if strip {
+		m.strippedTolerations = stripUnsupportedTolerations(config, supportedPlatforms, &spec.Tolerations)
+	}
+	m.existingTolerations = spec.Tolerations
+	addTolerationsToSlice(ctx, config, supportedPlatforms, &spec.Tolerations)
+	m.addedTolerations = spec.Tolerations[len(m.existingTolerations):]
+	m.addedNodeSelector = addNodeSelectorToMap(config, supportedPlatforms, &spec.NodeSelector)
+	return m
+}
+
+// mutateAdmissionReview fills in the response for a decoded AdmissionReview.
+func mutateAdmissionReview(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	namespaceFilterCfg *NamespaceFilterConfig,
+	review *admissionv1.AdmissionReview,
+) (*admissionv1.AdmissionReview, error) {
 	response := admissionv1.AdmissionResponse{
 		UID:     review.Request.UID,
 		Allowed: true,
 	}
+	ctx = withNamespaceMemo(ctx)
+	// warnings collects invalid image references and, when EmitWarnings is set,
+	// the warnings raised during platform detection. Every return hands back
+	// &response, so they are attached on the way out.
+	warnings := &[]string{}
+	if config.EmitWarnings {
+		ctx, warnings = withAdmissionWarnings(ctx)
+	}
+	defer func() {
+		if len(*warnings) > 0 {
+			response.Warnings = *warnings
+		}
+	}()
 
-	var originalBytes []byte
-	var modifiedBytes []byte
+	var mutation *specMutation
+	var err error
+	if kind := review.Request.Kind.Kind; kind == "Pod" {
+		mutation, err = mutatePod(ctx, cache, config, namespaceFilterCfg, review.Request, &response, warnings)
+	} else if templateKind, ok := podTemplateKinds[kind]; ok {
+		mutation, err = mutatePodTemplate(
+			ctx, cache, config, namespaceFilterCfg, review.Request, templateKind, &response, warnings,
+		)
+	} else {
+		if config.StrictKinds {
+			err := fmt.Errorf("%w: got a request for an unsupported kind: %s", ErrBadRequest, kind)
+			slog.Error("invalid request kind", "error", err)
+			return review, err
+		}
+		// A webhook rule matching more than the supported kinds should not block
+		// unrelated resources under failurePolicy: Fail, so they pass through.
+		slog.Warn("allowing request for an unsupported kind without mutation", "kind", kind)
+	}
+	if err != nil {
+		return review, err
+	}
+	if mutation == nil {
+		review.Response = &response
+		return review, nil
+	}
 
-	switch review.Request.Kind.Kind {
-	case "Pod":
-		obj := review.Request.Object
-		pod := &corev1.Pod{}
-		err = json.Unmarshal(obj.Raw, pod)
+	var patch []jsonpatch.JsonPatchOperation
+	if config.PatchStrategy == PatchStrategyAppend {
+		patch = removeTolerationsPatch(mutation.tolerationsPath, mutation.strippedTolerations)
+		patch = append(patch, appendTolerationsPatch(
+			mutation.tolerationsPath, mutation.existingTolerations, mutation.addedTolerations,
+		)...)
+		patch = append(patch, appendStringMapPatch(
+			mutation.nodeSelectorPath, mutation.hadNodeSelector, mutation.addedNodeSelector,
+		)...)
+	} else {
+		patch, err = jsonpatch.CreatePatch(mutation.originalBytes, mutation.modifiedBytes)
 		if err != nil {
-			slog.Error("failed to unmarshal pod", "error", err)
-			return nil, err
+			slog.Error("failed to create patch", "error", err)
+			return review, fmt.Errorf("%w: failed to create patch: %w", ErrInternal, err)
 		}
+	}
 
-		// Use review.Request.Namespace as it's the authoritative source, falling back to pod.Namespace
-		namespace := review.Request.Namespace
-		if namespace == "" {
-			namespace = pod.Namespace
-		}
+	jsonPatch, err := json.Marshal(patch)
+	if err != nil {
+		slog.Error("failed to marshal patch", "error", err)
+		return review, fmt.Errorf("%w: failed to marshal patch: %w", ErrInternal, err)
+	}
+	if config.PatchWarnBytes > 0 && len(jsonPatch) > config.PatchWarnBytes {
+		slog.Warn("admission patch exceeds PATCH_WARN_BYTES",
+			"kind", review.Request.Kind.Kind, "name", mutation.name, "namespace", mutation.namespace,
+			"bytes", len(jsonPatch), "limit", config.PatchWarnBytes)
+	}
 
-		if shouldSkipMutation(ctx, "Pod", pod.Name, namespace, PodHasSkipAnnotation(pod), namespaceFilterCfg) {
-			review.Response = &response
-			return review, nil
-		}
+	pt := admissionv1.PatchTypeJSONPatch
+	response.PatchType = &pt
+	response.Patch = jsonPatch
+	review.Response = &response
+	auditMutation(review.Request, mutation)
 
-		registryHosts := GetRegistryHosts(ctx, namespace, &pod.Spec)
-		supportedPlatforms := GetPodSupportedPlatforms(ctx, cache, config, pod, registryHosts)
-		if len(supportedPlatforms) == 0 {
-			review.Response = &response
-			return review, nil
-		}
+	return review, nil
+}
 
-		AddTolerationsToPod(config, pod, supportedPlatforms)
-		modifiedBytes, err = json.Marshal(pod)
-		if err != nil {
-			slog.Error("failed to marshal pod", "error", err)
-			return nil, err
-		}
-		originalBytes = obj.Raw
+// mutatePod inspects the pod of a Pod admission request and returns the change
+// made to it, or nil when the pod is left unpatched or response was already
+// decided, such as a rejection or DECISION_ONLY patch.
+func mutatePod(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	namespaceFilterCfg *NamespaceFilterConfig,
+	request *admissionv1.AdmissionRequest,
+	response *admissionv1.AdmissionResponse,
+	warnings *[]string,
+) (*specMutation, error) {
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		slog.Error("failed to unmarshal pod", "error", err)
+		return nil, fmt.Errorf("%w: failed to unmarshal pod: %w", ErrBadRequest, err)
+	}
 
-	case "DaemonSet":
-		obj := review.Request.Object
-		daemonSet := &appsv1.DaemonSet{}
-		err = json.Unmarshal(obj.Raw, daemonSet)
-		if err != nil {
-			slog.Error("failed to unmarshal daemonset", "error", err)
-			return nil, err
+	// Use request.Namespace as it's the authoritative source, falling back to pod.Namespace
+	namespace := cmp.Or(request.Namespace, pod.Namespace)
+
+	if shouldSkipMutation(
+		ctx, "Pod", pod.Name, namespace,
+		PodHasSkipAnnotation(pod), pod.Labels, namespaceFilterCfg,
+	) {
+		return nil, nil
+	}
+
+	config = namespacePlatformConfig(ctx, namespace, config)
+
+	if request.SubResource == subResourceEphemeralContainers {
+		logEphemeralContainersUpdate(request, pod, namespace)
+		return nil, nil
+	}
+
+	if config.SkipToleratedUpdates && isToleratedPodUpdate(config, request, pod) {
+		slog.Debug("skipping platform detection for an already tolerated pod update",
+			"pod", pod.Name, "namespace", namespace)
+		return nil, nil
+	}
+
+	if checkImageReferences(config, &pod.Spec, response, warnings) {
+		return nil, nil
+	}
+
+	ctx = withNoCacheAnnotation(ctx, pod.Annotations)
+	registryHosts := GetRegistryHosts(ctx, namespace, &pod.Spec)
+	if checkRequiredPlatforms(ctx, cache, config, &pod.Spec, registryHosts, response) {
+		return nil, nil
+	}
+	supportedPlatforms := restrictToPinnedArch(
+		&pod.Spec, GetPodSupportedPlatforms(ctx, cache, config, pod, registryHosts),
+	)
+	if config.DecisionOnly {
+		return nil, setDecisionPatch(response, pod.Annotations, supportedPlatforms)
+	}
+	if len(supportedPlatforms) == 0 {
+		return nil, nil
+	}
+
+	// A pod update may only add tolerations, so they are stripped on create.
+	mutation := mutatePodSpec(ctx, config, &pod.Spec, "/spec", supportedPlatforms, request.Operation != admissionv1.Update)
+	modifiedBytes, err := json.Marshal(pod)
+	if err != nil {
+		slog.Error("failed to marshal pod", "error", err)
+		return nil, fmt.Errorf("%w: failed to marshal pod: %w", ErrInternal, err)
+	}
+	mutation.originalBytes, mutation.modifiedBytes = request.Object.Raw, modifiedBytes
+	mutation.name, mutation.namespace = pod.Name, namespace
+	return mutation, nil
+}
+
+// mutatePodTemplate inspects the pod template of an admission request for one
+// of podTemplateKinds and returns the change made to it, like mutatePod.
+func mutatePodTemplate(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	namespaceFilterCfg *NamespaceFilterConfig,
+	request *admissionv1.AdmissionRequest,
+	kind podTemplateKind,
+	response *admissionv1.AdmissionResponse,
+	warnings *[]string,
+) (*specMutation, error) {
+	kindName := request.Kind.Kind
+	obj := kind.newObject()
+	if err := json.Unmarshal(request.Object.Raw, obj); err != nil {
+		slog.Error("failed to unmarshal "+strings.ToLower(kindName), "error", err)
+		return nil, fmt.Errorf("%w: failed to unmarshal %s: %w", ErrBadRequest, strings.ToLower(kindName), err)
+	}
+	template := kind.template(obj)
+	if template == nil {
+		return nil, nil
+	}
+
+	// Use request.Namespace as it's the authoritative source, falling back to the object's namespace
+	namespace := cmp.Or(request.Namespace, obj.GetNamespace())
+
+	if shouldSkipMutation(
+		ctx, kindName, obj.GetName(), namespace,
+		PodTemplateHasSkipAnnotation(template), template.Labels, namespaceFilterCfg,
+	) {
+		return nil, nil
+	}
+
+	config = namespacePlatformConfig(ctx, namespace, config)
+	if checkImageReferences(config, &template.Spec, response, warnings) {
+		return nil, nil
+	}
+	ctx = withNoCacheAnnotation(ctx, template.Annotations)
+	registryHosts := GetRegistryHosts(ctx, namespace, &template.Spec)
+	var supportedPlatforms []string
+	if kind.platforms != nil {
+		supportedPlatforms = kind.platforms(ctx, cache, config, obj, registryHosts)
+	} else {
+		supportedPlatforms = GetPodTemplateSupportedPlatforms(ctx, cache, config, template, registryHosts)
+	}
+	supportedPlatforms = restrictToPinnedArch(&template.Spec, supportedPlatforms)
+	if config.DecisionOnly {
+		return nil, setDecisionPatch(response, obj.GetAnnotations(), supportedPlatforms)
+	}
+	if len(supportedPlatforms) == 0 {
+		return nil, nil
+	}
+
+	mutation := mutatePodSpec(ctx, config, &template.Spec, kind.templatePath+"/spec", supportedPlatforms, true)
+	modifiedBytes, err := json.Marshal(obj)
+	if err != nil {
+		slog.Error("failed to marshal "+strings.ToLower(kindName), "error", err)
+		return nil, fmt.Errorf("%w: failed to marshal %s: %w", ErrInternal, strings.ToLower(kindName), err)
+	}
+	mutation.originalBytes, mutation.modifiedBytes = request.Object.Raw, modifiedBytes
+	mutation.name, mutation.namespace = obj.GetName(), namespace
+	return mutation, nil
+}
+
+// logEphemeralContainersUpdate handles a pods/ephemeralcontainers subresource
+// request by logging the images of the ephemeral containers it adds. The
+// subresource rejects changes to any other part of the pod spec, and the pod is
+// already bound to a node, so tolerations are never patched and the images are
+// not looked up. The request is always allowed, even with an unreadable
+// oldObject.
+func logEphemeralContainersUpdate(request *admissionv1.AdmissionRequest, pod *corev1.Pod, namespace string) {
+	oldPod := &corev1.Pod{}
+	if len(request.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(request.OldObject.Raw, oldPod); err != nil {
+			slog.Warn("failed to unmarshal old pod of ephemeral containers update",
+				"pod", pod.Name, "namespace", namespace, "error", err)
+			return
 		}
+	}
+
+	added := newEphemeralContainers(oldPod, pod)
+	if len(added) == 0 {
+		return
+	}
+	images := make([]string, 0, len(added))
+	for _, c := range added {
+		images = append(images, c.Image)
+	}
+	slog.Info("ephemeral containers added; tolerations are not patched on the ephemeralcontainers subresource",
+		"pod", pod.Name, "namespace", namespace, "images", images)
+}
 
-		// Use review.Request.Namespace as it's the authoritative source, falling back to daemonSet.Namespace
-		namespace := review.Request.Namespace
-		if namespace == "" {
-			namespace = daemonSet.Namespace
+// newEphemeralContainers returns the ephemeral containers present in pod but not
+// in oldPod, matched by name, as plain containers for platform detection.
+func newEphemeralContainers(oldPod, pod *corev1.Pod) []corev1.Container {
+	existing := map[string]bool{}
+	for _, ec := range oldPod.Spec.EphemeralContainers {
+		existing[ec.Name] = true
+	}
+	var added []corev1.Container
+	for _, ec := range pod.Spec.EphemeralContainers {
+		if !existing[ec.Name] {
+			added = append(added, corev1.Container{Name: ec.Name, Image: ec.Image})
 		}
+	}
+	return added
+}
 
-		if shouldSkipMutation(
-			ctx, "DaemonSet", daemonSet.Name, namespace,
-			PodTemplateHasSkipAnnotation(&daemonSet.Spec.Template), namespaceFilterCfg,
-		) {
-			review.Response = &response
-			return review, nil
+// checkImageReferences reports the container images of podSpec that are not
+// valid references, so users learn their image is malformed instead of only
+// losing tolerations: as a warning each under InvalidImagePolicyWarn, or by
+// denying response under InvalidImagePolicyReject. It returns whether response
+// was denied.
+func checkImageReferences(
+	config *PlatformTolerationConfig,
+	podSpec *corev1.PodSpec,
+	response *admissionv1.AdmissionResponse,
+	warnings *[]string,
+) bool {
+	problems := []string{}
+	for _, image := range podSpecImages(podSpec) {
+		if _, err := parseImageRef(image); err != nil {
+			problem := fmt.Sprintf("image %q is not a valid image reference: %v", image, err)
+			if !slices.Contains(problems, problem) {
+				problems = append(problems, problem)
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return false
+	}
+	slog.Warn("admission request has invalid image references", "problems", problems, "policy", config.InvalidImagePolicy)
+	if config.InvalidImagePolicy == InvalidImagePolicyReject {
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: strings.Join(problems, "; "),
 		}
+		return true
+	}
+	for _, problem := range problems {
+		*warnings = append(*warnings, problem+"; no platform tolerations can be detected for it")
+	}
+	return false
+}
 
-		registryHosts := GetRegistryHosts(ctx, namespace, &daemonSet.Spec.Template.Spec)
-		supportedPlatforms := GetPodTemplateSupportedPlatforms(ctx, cache, config, &daemonSet.Spec.Template, registryHosts)
-		if len(supportedPlatforms) == 0 {
-			review.Response = &response
-			return review, nil
+// checkRequiredPlatforms rejects the request through response when an image in
+// spec does not support every platform in config.RequiredPlatforms, listing
+// each failing image. Images that cannot be inspected fail the check too. It
+// reports whether the request was rejected.
+func checkRequiredPlatforms(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	spec *corev1.PodSpec,
+	registryHosts []config.Host,
+	response *admissionv1.AdmissionResponse,
+) bool {
+	if len(config.RequiredPlatforms) == 0 {
+		return false
+	}
+	// Detect the required platforms rather than the configured mappings.
+	required := *config
+	required.Mappings = make([]PlatformTolerationMapping, len(config.RequiredPlatforms))
+	for i, platform := range config.RequiredPlatforms {
+		required.Mappings[i] = PlatformTolerationMapping{Platform: platform}
+	}
+
+	problems := []string{}
+	checked := map[string]bool{}
+	for _, container := range inspectableContainers(config, podSpecContainers(config, spec)) {
+		if checked[container.Image] {
+			continue
+		}
+		checked[container.Image] = true
+		supported := getContainersSupportedPlatforms(
+			ctx, cache, &required, []corev1.Container{container}, registryHosts,
+		)
+		missing := slices.DeleteFunc(slices.Clone(config.RequiredPlatforms), func(p string) bool {
+			return slices.Contains(supported, p)
+		})
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("image %q does not support %s",
+				container.Image, strings.Join(missing, ", ")))
 		}
+	}
+	if len(problems) == 0 {
+		return false
+	}
+	slog.Warn("rejecting admission request with images missing required platforms", "problems", problems)
+	response.Allowed = false
+	response.Result = &metav1.Status{
+		Status: metav1.StatusFailure,
+		Code:   http.StatusForbidden,
+		Reason: metav1.StatusReasonForbidden,
+		Message: fmt.Sprintf("images must support all of REQUIRE_PLATFORMS (%s): %s",
+			strings.Join(config.RequiredPlatforms, ", "), strings.Join(problems, "; ")),
+	}
+	return true
+}
 
-		AddTolerationsToPodTemplate(config, &daemonSet.Spec.Template, supportedPlatforms)
-		modifiedBytes, err = json.Marshal(daemonSet)
-		if err != nil {
-			slog.Error("failed to marshal daemonset", "error", err)
-			return nil, err
+// isToleratedPodUpdate reports whether request is an UPDATE that leaves the
+// pod's container images unchanged and whose pod already carries everything
+// detection could add: every configured platform toleration, the
+// FullyPortableToleration, and the node selector keys of every mapping. Such a
+// pod was mutated on an earlier admission with all platforms supported, and
+// detecting the same images again would add nothing, so the update can pass
+// unpatched. A pod tolerating only some platforms is detected again, since the
+// cached results may now support more.
+func isToleratedPodUpdate(
+	config *PlatformTolerationConfig,
+	request *admissionv1.AdmissionRequest,
+	pod *corev1.Pod,
+) bool {
+	if request.Operation != admissionv1.Update || len(request.OldObject.Raw) == 0 {
+		return false
+	}
+	oldPod := &corev1.Pod{}
+	if err := json.Unmarshal(request.OldObject.Raw, oldPod); err != nil {
+		slog.Warn("failed to unmarshal old pod; running platform detection", "error", err)
+		return false
+	}
+	if !slices.Equal(podSpecImages(&oldPod.Spec), podSpecImages(&pod.Spec)) {
+		return false
+	}
+	wanted := make([]corev1.Toleration, 0, len(config.Mappings)+1)
+	for _, m := range config.Mappings {
+		wanted = append(wanted, m.Toleration)
+	}
+	if config.FullyPortableToleration != nil {
+		wanted = append(wanted, *config.FullyPortableToleration)
+	}
+	for _, toleration := range wanted {
+		if !slices.Contains(pod.Spec.Tolerations, toleration) && !coveredByCatchAll(pod.Spec.Tolerations, toleration) {
+			return false
+		}
+	}
+	if config.NodeSelectorEnabled {
+		for key := range config.GetNodeSelectorForPlatforms(config.GetPlatforms()) {
+			if _, ok := pod.Spec.NodeSelector[key]; !ok {
+				return false
+			}
 		}
-		originalBytes = obj.Raw
+	}
+	return true
+}
 
-	default:
-		err := fmt.Errorf("got a request for an unsupported kind: %s", review.Request.Kind.Kind)
-		slog.Error("invalid request kind", "error", err)
-		return nil, err
+// podSpecImages returns the images of the PodSpec's init containers and
+// containers, in order.
+func podSpecImages(podSpec *corev1.PodSpec) []string {
+	images := []string{}
+	for _, c := range podSpec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range podSpec.Containers {
+		images = append(images, c.Image)
 	}
+	return images
+}
 
-	patch, err := jsonpatch.CreatePatch(originalBytes, modifiedBytes)
-	if err != nil {
-		slog.Error("failed to create patch", "error", err)
-		return nil, err
+// appendTolerationsPatch builds targeted JSONPatch operations that append only
+// the added tolerations to the array at path, rather than rewriting it. When
+// the object had no tolerations array, a single add creates it.
+func appendTolerationsPatch(
+	path string,
+	existing []corev1.Toleration,
+	added []corev1.Toleration,
+) []jsonpatch.JsonPatchOperation {
+	if len(added) == 0 {
+		return []jsonpatch.JsonPatchOperation{}
+	}
+	if existing == nil {
+		return []jsonpatch.JsonPatchOperation{{Operation: "add", Path: path, Value: added}}
+	}
+	ops := make([]jsonpatch.JsonPatchOperation, 0, len(added))
+	for _, toleration := range added {
+		ops = append(ops, jsonpatch.JsonPatchOperation{Operation: "add", Path: path + "/-", Value: toleration})
+	}
+	return ops
+}
+
+// removeTolerationsPatch builds JSONPatch operations removing the tolerations
+// at the indexes removed from the array at path, highest first so each index
+// is still valid when applied. They precede the append operations.
+func removeTolerationsPatch(path string, removed []int) []jsonpatch.JsonPatchOperation {
+	ops := make([]jsonpatch.JsonPatchOperation, 0, len(removed))
+	for _, i := range slices.Backward(removed) {
+		ops = append(ops, jsonpatch.JsonPatchOperation{Operation: "remove", Path: path + "/" + strconv.Itoa(i)})
 	}
+	return ops
+}
 
+// appendStringMapPatch builds JSONPatch operations that add only the added
+// entries to the string map at path, such as a nodeSelector or annotations.
+// When the object had no map there (hadMap is false), a single add creates it.
+func appendStringMapPatch(
+	path string,
+	hadMap bool,
+	added map[string]string,
+) []jsonpatch.JsonPatchOperation {
+	if len(added) == 0 {
+		return nil
+	}
+	if !hadMap {
+		return []jsonpatch.JsonPatchOperation{{Operation: "add", Path: path, Value: added}}
+	}
+	ops := make([]jsonpatch.JsonPatchOperation, 0, len(added))
+	for _, key := range slices.Sorted(maps.Keys(added)) {
+		ops = append(ops, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      path + "/" + jsonPointerEscaper.Replace(key),
+			Value:     added[key],
+		})
+	}
+	return ops
+}
+
+// setDecisionPatch sets a patch on response recording supportedPlatforms in the
+// object's AnnotationDetectedPlatforms, for DECISION_ONLY. An empty value
+// records that no platform is supported. No patch is set when the annotation
+// already holds the decision. Errors wrap ErrInternal.
+func setDecisionPatch(
+	response *admissionv1.AdmissionResponse,
+	annotations map[string]string,
+	supportedPlatforms []string,
+) error {
+	decision := strings.Join(supportedPlatforms, ",")
+	if current, ok := annotations[AnnotationDetectedPlatforms]; ok && current == decision {
+		return nil
+	}
+	patch := appendStringMapPatch("/metadata/annotations", annotations != nil,
+		map[string]string{AnnotationDetectedPlatforms: decision})
 	jsonPatch, err := json.Marshal(patch)
 	if err != nil {
-		slog.Error("failed to marshal patch", "error", err)
-		return nil, err
+		slog.Error("failed to marshal decision patch", "error", err)
+		return fmt.Errorf("%w: failed to marshal decision patch: %w", ErrInternal, err)
 	}
-
 	pt := admissionv1.PatchTypeJSONPatch
 	response.PatchType = &pt
 	response.Patch = jsonPatch
-	review.Response = &response
-
-	return review, nil
+	return nil
 }
 
+// jsonPointerEscaper escapes a map key for use as a JSON Pointer token (RFC 6901).
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// AdmissionReviewFromRequest decodes an AdmissionReview request body. Both
+// admission.k8s.io/v1 and v1beta1 are accepted; the two share a wire format, so
+// v1beta1 reviews are decoded into the v1 type and keep their apiVersion so the
+// response is returned in the version the API server sent.
 func AdmissionReviewFromRequest(body []byte) (*admissionv1.AdmissionReview, error) {
 	var review admissionv1.AdmissionReview
 	err := json.Unmarshal(body, &review)
 	if err != nil {
 		slog.Error("failed to unmarshal request body", "error", err)
+		return nil, fmt.Errorf("%w: failed to unmarshal request body: %w", ErrBadRequest, err)
+	}
+
+	switch review.APIVersion {
+	case admissionv1.SchemeGroupVersion.String(), admissionv1beta1.SchemeGroupVersion.String():
+	case "":
+		review.APIVersion = admissionv1.SchemeGroupVersion.String()
+	default:
+		err := fmt.Errorf("%w: unsupported admission review apiVersion: %s", ErrBadRequest, review.APIVersion)
+		slog.Error("invalid admission review version", "error", err)
 		return nil, err
 	}
+	review.Kind = "AdmissionReview"
 
 	if review.Request == nil {
-		err := fmt.Errorf("got an invalid admission request")
+		err := fmt.Errorf("%w: got an invalid admission request", ErrBadRequest)
 		slog.Error("invalid admission request", "error", err)
 		return nil, err
 	}
@@ -212,21 +809,7 @@ func GetPodSupportedPlatforms(
 	pod *corev1.Pod,
 	registryHosts []config.Host,
 ) []string {
-	// Combine all container types: regular, init, and ephemeral
-	allContainers := make(
-		[]corev1.Container,
-		0,
-		len(pod.Spec.Containers)+len(pod.Spec.InitContainers)+len(pod.Spec.EphemeralContainers),
-	)
-	allContainers = append(allContainers, pod.Spec.Containers...)
-	allContainers = append(allContainers, pod.Spec.InitContainers...)
-	for _, ec := range pod.Spec.EphemeralContainers {
-		allContainers = append(allContainers, corev1.Container{
-			Name:  ec.Name,
-			Image: ec.Image,
-		})
-	}
-	return getContainersSupportedPlatforms(ctx, cache, config, allContainers, registryHosts)
+	return podSpecSupportedPlatforms(ctx, cache, config, &pod.Spec, registryHosts)
 }
 
 // GetPodTemplateSupportedPlatforms returns platforms supported by all images in the pod template
@@ -237,21 +820,104 @@ func GetPodTemplateSupportedPlatforms(
 	template *corev1.PodTemplateSpec,
 	registryHosts []config.Host,
 ) []string {
+	return podSpecSupportedPlatforms(ctx, cache, config, &template.Spec, registryHosts)
+}
+
+// restrictToPinnedArch returns the platforms whose architecture matches the
+// spec's kubernetes.io/arch nodeSelector, since the pod can never schedule onto
+// another architecture's nodes and their tolerations would be pointless.
+// Without that label, platforms is returned unchanged.
+func restrictToPinnedArch(spec *corev1.PodSpec, platforms []string) []string {
+	arch := spec.NodeSelector[corev1.LabelArchStable]
+	if arch == "" {
+		return platforms
+	}
+	pinned := slices.DeleteFunc(slices.Clone(platforms), func(p string) bool {
+		parsed, err := parsePlatform(p)
+		return err != nil || parsed.Architecture != arch
+	})
+	if len(pinned) < len(platforms) {
+		slog.Debug("restricting supported platforms to the pinned architecture",
+			"arch", arch, "supported", platforms, "pinned", pinned)
+	}
+	return pinned
+}
+
+// GetDaemonSetSupportedPlatforms returns the platforms to tolerate for the
+// DaemonSet's pod template according to config.DaemonSetPolicy.
+func GetDaemonSetSupportedPlatforms(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	daemonSet *appsv1.DaemonSet,
+	registryHosts []config.Host,
+) []string {
+	if config.DaemonSetPolicy != DaemonSetPolicyAny {
+		return GetPodTemplateSupportedPlatforms(ctx, cache, config, &daemonSet.Spec.Template, registryHosts)
+	}
+	return anyContainerSupportedPlatforms(
+		ctx, cache, config, podSpecContainers(config, &daemonSet.Spec.Template.Spec), registryHosts,
+	)
+}
+
+// podSpecContainers returns the PodSpec's containers taking part in platform
+// detection: regular, ephemeral, and init containers under
+// InitContainerPolicyInclude.
+func podSpecContainers(config *PlatformTolerationConfig, spec *corev1.PodSpec) []corev1.Container {
+	includeInit := config.InitContainerPolicy == "" || config.InitContainerPolicy == InitContainerPolicyInclude
+
 	// Combine all container types: regular, init, and ephemeral
 	allContainers := make(
 		[]corev1.Container,
 		0,
-		len(template.Spec.Containers)+len(template.Spec.InitContainers)+len(template.Spec.EphemeralContainers),
+		len(spec.Containers)+len(spec.InitContainers)+len(spec.EphemeralContainers),
 	)
-	allContainers = append(allContainers, template.Spec.Containers...)
-	allContainers = append(allContainers, template.Spec.InitContainers...)
-	for _, ec := range template.Spec.EphemeralContainers {
+	allContainers = append(allContainers, spec.Containers...)
+	if includeInit {
+		allContainers = append(allContainers, spec.InitContainers...)
+	}
+	for _, ec := range spec.EphemeralContainers {
 		allContainers = append(allContainers, corev1.Container{
 			Name:  ec.Name,
 			Image: ec.Image,
 		})
 	}
-	return getContainersSupportedPlatforms(ctx, cache, config, allContainers, registryHosts)
+	return allContainers
+}
+
+// podSpecSupportedPlatforms returns platforms supported by all images in the
+// PodSpec. Init containers take part according to config.InitContainerPolicy.
+func podSpecSupportedPlatforms(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	spec *corev1.PodSpec,
+	registryHosts []config.Host,
+) []string {
+	supportedPlatforms := getContainersSupportedPlatforms(
+		ctx, cache, config, podSpecContainers(config, spec), registryHosts,
+	)
+
+	inspectableInit := slices.ContainsFunc(spec.InitContainers, func(c corev1.Container) bool {
+		return c.Image != "" && !config.IgnoreContainerNames[c.Name]
+	})
+	if config.InitContainerPolicy == InitContainerPolicyWarnOnly && inspectableInit && len(supportedPlatforms) > 0 {
+		// The tolerations are added regardless, so the per-image warnings of this
+		// check would be misleading; one warning per platform is emitted instead.
+		initSupported := getContainersSupportedPlatforms(
+			withoutAdmissionWarnings(ctx), cache, config.RestrictToPlatforms(supportedPlatforms),
+			spec.InitContainers, registryHosts,
+		)
+		for _, platform := range supportedPlatforms {
+			if !slices.Contains(initSupported, platform) {
+				slog.Warn("init containers do not support a platform tolerated for the main containers",
+					"platform", platform)
+				addAdmissionWarning(ctx, fmt.Sprintf("init containers lack %s support; %s toleration added anyway",
+					platform, platform))
+			}
+		}
+	}
+	return supportedPlatforms
 }
 
 // getContainersSupportedPlatforms checks which configured platforms are supported by all container images
@@ -265,51 +931,448 @@ func getContainersSupportedPlatforms(
 	configuredPlatforms := config.GetPlatforms()
 	supportedPlatforms := []string{}
 
+	// A workload with no inspectable images gets no tolerations.
+	containers = inspectableContainers(config, containers)
+	if len(containers) == 0 {
+		return supportedPlatforms
+	}
+
+	if exceedsMaxLookups(ctx, cache, config, containers) {
+		return supportedPlatforms
+	}
+
+	supports := func(image, platform string) bool {
+		return DoesImageSupportPlatform(ctx, cache, image, platform, registryHosts)
+	}
+	if config.LookupParallelism > 1 {
+		results := lookupImagePlatformsParallel(ctx, cache, config, containers, configuredPlatforms, registryHosts)
+		supports = func(image, platform string) bool { return results[imagePlatform{image, platform}] }
+	}
+
 	for _, platform := range configuredPlatforms {
 		allSupport := true
+		// skipped counts images left out of the intersection by ON_AUTH_ERROR.
+		skipped := 0
 		var errs []error
 		for _, container := range containers {
-			if !DoesImageSupportPlatform(ctx, cache, container.Image, platform, registryHosts) {
+			if isImagePlatformDenied(config, container.Image, platform) {
+				allSupport = false
+				errs = append(errs, fmt.Errorf("image %s is denied %s", container.Image, platform))
+				break
+			}
+			if config.LocalImagePolicy == LocalImagePolicyAssumeSupported && isLocalImage(container) {
+				continue
+			}
+			if !supports(container.Image, platform) {
+				if config.OnAuthError != OnAuthErrorStrip && imageLookupAuthFailed(cache, container.Image, platform) {
+					slog.Warn("registry authentication failed, leaving image out of platform detection",
+						"image", container.Image, "platform", platform, "policy", config.OnAuthError)
+					if config.OnAuthError == OnAuthErrorSkipImage {
+						skipped++
+					}
+					continue
+				}
 				allSupport = false
 				errs = append(errs, fmt.Errorf("image %s lacks %s support", container.Image, platform))
 				// Early exit since we know this platform isn't supported by all containers
 				break
 			}
 		}
+		if allSupport && skipped == len(containers) {
+			// Like a workload with no inspectable images, skipping every image
+			// leaves nothing to decide the platform.
+			allSupport = false
+			errs = append(errs, fmt.Errorf("no image could be inspected for %s", platform))
+		}
 		if allSupport {
 			supportedPlatforms = append(supportedPlatforms, platform)
 		} else {
 			slog.Info("containers have images without platform support", "platform", platform, "error", errors.Join(errs...))
+			for _, err := range errs {
+				addAdmissionWarning(ctx, fmt.Sprintf("%v; no %s toleration added", err, platform))
+			}
+		}
+	}
+
+	return supportedPlatforms
+}
+
+// isImagePlatformDenied reports whether DENY_PLATFORM_IMAGES denies platform
+// to image.
+func isImagePlatformDenied(config *PlatformTolerationConfig, image, platform string) bool {
+	return slices.ContainsFunc(config.DeniedPlatforms(image), func(p string) bool {
+		return platformsMatch(platform, p)
+	})
+}
+
+// imagePlatform identifies the lookup of one image for one platform.
+type imagePlatform struct {
+	image    string
+	platform string
+}
+
+// lookupImagePlatformsParallel inspects each distinct image and platform pair
+// of containers that getContainersSupportedPlatforms could need, running at
+// most config.LookupParallelism lookups at a time. Pairs that are denied, or
+// local images assumed supported, are not looked up.
+func lookupImagePlatformsParallel(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	containers []corev1.Container,
+	platforms []string,
+	registryHosts []config.Host,
+) map[imagePlatform]bool {
+	var pairs []imagePlatform
+	for _, platform := range platforms {
+		for _, container := range containers {
+			if isImagePlatformDenied(config, container.Image, platform) ||
+				(config.LocalImagePolicy == LocalImagePolicyAssumeSupported && isLocalImage(container)) {
+				continue
+			}
+			if pair := (imagePlatform{container.Image, platform}); !slices.Contains(pairs, pair) {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+
+	supported := make([]bool, len(pairs))
+	slots := make(chan struct{}, config.LookupParallelism)
+	var wg sync.WaitGroup
+	for i, pair := range pairs {
+		wg.Go(func() {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			supported[i] = DoesImageSupportPlatform(ctx, cache, pair.image, pair.platform, registryHosts)
+		})
+	}
+	wg.Wait()
+
+	results := make(map[imagePlatform]bool, len(pairs))
+	for i, pair := range pairs {
+		results[pair] = supported[i]
+	}
+	return results
+}
+
+// anyContainerSupportedPlatforms returns the configured platforms supported by
+// at least one of the container images, for DaemonSetPolicyAny.
+func anyContainerSupportedPlatforms(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	containers []corev1.Container,
+	registryHosts []config.Host,
+) []string {
+	containers = inspectableContainers(config, containers)
+	if exceedsMaxLookups(ctx, cache, config, containers) {
+		return []string{}
+	}
+
+	// Each container is checked on its own, so its per-image warnings would
+	// report platforms that another container supports.
+	quietCtx := withoutAdmissionWarnings(ctx)
+	supported := map[string]bool{}
+	for _, container := range containers {
+		if len(supported) == len(config.Mappings) {
+			break
+		}
+		for _, platform := range getContainersSupportedPlatforms(
+			quietCtx, cache, config, []corev1.Container{container}, registryHosts,
+		) {
+			supported[platform] = true
 		}
 	}
 
+	supportedPlatforms := []string{}
+	for _, platform := range config.GetPlatforms() {
+		if supported[platform] {
+			supportedPlatforms = append(supportedPlatforms, platform)
+			continue
+		}
+		slog.Info("no container image supports the platform", "platform", platform)
+		addAdmissionWarning(ctx, fmt.Sprintf("no container image supports %s; no %s toleration added", platform, platform))
+	}
 	return supportedPlatforms
 }
 
-// addTolerationsToSlice adds tolerations for supported platforms to the given tolerations slice.
+// inspectableContainers returns the containers taking part in platform
+// detection. An empty image cannot be inspected and must not veto every
+// platform, nor may an ignored container or, under LocalImagePolicySkip, a
+// local image.
+func inspectableContainers(config *PlatformTolerationConfig, containers []corev1.Container) []corev1.Container {
+	return slices.DeleteFunc(slices.Clone(containers), func(c corev1.Container) bool {
+		return c.Image == "" || config.IgnoreContainerNames[c.Name] ||
+			(config.LocalImagePolicy == LocalImagePolicySkip && isLocalImage(c))
+	})
+}
+
+// exceedsMaxLookups reports whether the containers have more uncached images
+// than config.MaxLookupsPerAdmission allows, warning when they do.
+func exceedsMaxLookups(
+	ctx context.Context,
+	cache Cache,
+	config *PlatformTolerationConfig,
+	containers []corev1.Container,
+) bool {
+	if config.MaxLookupsPerAdmission <= 0 {
+		return false
+	}
+	lookups := containers
+	if config.LocalImagePolicy == LocalImagePolicyAssumeSupported {
+		lookups = slices.DeleteFunc(slices.Clone(containers), isLocalImage)
+	}
+	uncached := countUncachedImages(cache, config.GetPlatforms(), lookups)
+	if uncached <= config.MaxLookupsPerAdmission {
+		return false
+	}
+	slog.Warn(
+		"too many uncached images for a single admission, skipping platform detection",
+		"uncached",
+		uncached,
+		"max",
+		config.MaxLookupsPerAdmission,
+	)
+	addAdmissionWarning(ctx, fmt.Sprintf(
+		"%d images are not cached, more than MAX_LOOKUPS_PER_ADMISSION (%d); no platform tolerations added",
+		uncached, config.MaxLookupsPerAdmission,
+	))
+	return true
+}
+
+// isLocalImage reports whether c uses imagePullPolicy Never, i.e. its image is
+// expected to exist on the node rather than in a registry.
+func isLocalImage(c corev1.Container) bool {
+	return c.ImagePullPolicy == corev1.PullNever
+}
+
+// admissionWarningsKey is the context key under which the warnings collected
+// for an admission response are stored.
+type admissionWarningsKey struct{}
+
+// withAdmissionWarnings returns a context that collects admission warnings into
+// the returned slice.
+func withAdmissionWarnings(ctx context.Context) (context.Context, *[]string) {
+	warnings := &[]string{}
+	return context.WithValue(ctx, admissionWarningsKey{}, warnings), warnings
+}
+
+// withoutAdmissionWarnings returns a context in which addAdmissionWarning does
+// nothing.
+func withoutAdmissionWarnings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, admissionWarningsKey{}, (*[]string)(nil))
+}
+
+// addAdmissionWarning records warning for the admission response when ctx
+// collects warnings, i.e. when EMIT_WARNINGS is set.
+func addAdmissionWarning(ctx context.Context, warning string) {
+	if warnings, _ := ctx.Value(admissionWarningsKey{}).(*[]string); warnings != nil {
+		*warnings = append(*warnings, warning)
+	}
+}
+
+// countUncachedImages returns the number of distinct container images that lack
+// a cached result for at least one of the given platforms. Images from trusted
+// multi-arch registries never need a lookup and are not counted.
+func countUncachedImages(cache Cache, platforms []string, containers []corev1.Container) int {
+	seen := map[string]bool{}
+	uncached := 0
+	for _, container := range containers {
+		if seen[container.Image] {
+			continue
+		}
+		seen[container.Image] = true
+		if r, err := parseImageRef(container.Image); err == nil && isTrustedMultiarchRegistry(r.Registry) {
+			continue
+		}
+		for _, platform := range platforms {
+			if _, ok := cache.Get(imageCacheKey(container.Image, platform)); !ok {
+				uncached++
+				break
+			}
+		}
+	}
+	return uncached
+}
+
+// addTolerationsToSlice adds tolerations for supported platforms to the given
+// tolerations slice, plus the FullyPortableToleration when every configured
+// platform is supported. Tolerations already covered by a catch-all toleration
+// in the slice are skipped. The added tolerations are sorted, so the patch is
+// the same for every admission of the same workload whatever order the
+// platforms were detected or configured in.
 func addTolerationsToSlice(
+	ctx context.Context,
 	config *PlatformTolerationConfig,
 	supportedPlatforms []string,
 	tolerations *[]corev1.Toleration,
 ) {
-	newTolerations := config.GetTolerationsForPlatforms(supportedPlatforms)
+	newTolerations := config.GetTolerationsForPlatforms(ctx, supportedPlatforms)
+	if config.FullyPortableToleration != nil && supportsAllPlatforms(config, supportedPlatforms) {
+		newTolerations = append(newTolerations, *config.FullyPortableToleration)
+	}
+	slices.SortStableFunc(newTolerations, compareTolerations)
 	for _, toleration := range newTolerations {
+		if coveredByCatchAll(*tolerations, toleration) {
+			continue
+		}
 		if !slices.Contains(*tolerations, toleration) {
 			*tolerations = append(*tolerations, toleration)
 		}
 	}
 }
 
+// stripUnsupportedTolerations removes from tolerations, under
+// StripUnsupportedTolerations, each toleration with the key and value of a
+// mapping whose platform is not in supportedPlatforms, unless a mapping with
+// the same key and value is for a supported platform. It returns the indexes
+// of the removed tolerations in ascending order.
+func stripUnsupportedTolerations(
+	config *PlatformTolerationConfig,
+	supportedPlatforms []string,
+	tolerations *[]corev1.Toleration,
+) []int {
+	if !config.StripUnsupportedTolerations {
+		return nil
+	}
+	var removed []int
+	kept := (*tolerations)[:0:0]
+	for i, toleration := range *tolerations {
+		if isUnsupportedPlatformToleration(config, supportedPlatforms, toleration) {
+			slog.Debug("stripping toleration for an unsupported platform",
+				"key", toleration.Key, "value", toleration.Value)
+			removed = append(removed, i)
+			continue
+		}
+		kept = append(kept, toleration)
+	}
+	if len(removed) > 0 {
+		*tolerations = kept
+	}
+	return removed
+}
+
+// isUnsupportedPlatformToleration reports whether toleration has the key and
+// value of a mapping, and every mapping with that key and value is for a
+// platform missing from supportedPlatforms.
+func isUnsupportedPlatformToleration(
+	config *PlatformTolerationConfig,
+	supportedPlatforms []string,
+	toleration corev1.Toleration,
+) bool {
+	if toleration.Key == "" {
+		return false
+	}
+	matched := false
+	for _, m := range config.Mappings {
+		if m.Toleration.Key != toleration.Key || m.Toleration.Value != toleration.Value {
+			continue
+		}
+		if slices.Contains(supportedPlatforms, m.Platform) {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// compareTolerations orders tolerations by key, value, effect, operator, and
+// tolerationSeconds, with unset seconds first.
+func compareTolerations(a, b corev1.Toleration) int {
+	return cmp.Or(
+		cmp.Compare(a.Key, b.Key),
+		cmp.Compare(a.Value, b.Value),
+		cmp.Compare(a.Effect, b.Effect),
+		cmp.Compare(a.Operator, b.Operator),
+		cmp.Compare(ptr.Deref(a.TolerationSeconds, -1), ptr.Deref(b.TolerationSeconds, -1)),
+	)
+}
+
+// supportsAllPlatforms reports whether supportedPlatforms includes the platform
+// of every mapping in config.
+func supportsAllPlatforms(config *PlatformTolerationConfig, supportedPlatforms []string) bool {
+	if len(config.Mappings) == 0 {
+		return false
+	}
+	for _, m := range config.Mappings {
+		if !slices.Contains(supportedPlatforms, m.Platform) {
+			return false
+		}
+	}
+	return true
+}
+
+// coveredByCatchAll reports whether tolerations contains a catch-all toleration
+// (empty key with operator Exists) whose effect is empty or equal to the
+// effect of toleration, so that toleration would be redundant.
+func coveredByCatchAll(tolerations []corev1.Toleration, toleration corev1.Toleration) bool {
+	return slices.ContainsFunc(tolerations, func(t corev1.Toleration) bool {
+		return t.Key == "" && t.Operator == corev1.TolerationOpExists &&
+			(t.Effect == "" || t.Effect == toleration.Effect)
+	})
+}
+
 // AddTolerationsToPod adds tolerations for supported platforms to a pod
-func AddTolerationsToPod(config *PlatformTolerationConfig, pod *corev1.Pod, supportedPlatforms []string) {
-	addTolerationsToSlice(config, supportedPlatforms, &pod.Spec.Tolerations)
+func AddTolerationsToPod(
+	ctx context.Context,
+	config *PlatformTolerationConfig,
+	pod *corev1.Pod,
+	supportedPlatforms []string,
+) {
+	addTolerationsToSlice(ctx, config, supportedPlatforms, &pod.Spec.Tolerations)
+}
+
+// addNodeSelectorToMap merges the node selector labels for supported platforms
+// into nodeSelector without overwriting keys it already has, and returns the
+// labels it added. It does nothing unless NodeSelectorEnabled is set.
+func addNodeSelectorToMap(
+	config *PlatformTolerationConfig,
+	supportedPlatforms []string,
+	nodeSelector *map[string]string,
+) map[string]string {
+	if !config.NodeSelectorEnabled {
+		return nil
+	}
+	added := map[string]string{}
+	for key, value := range config.GetNodeSelectorForPlatforms(supportedPlatforms) {
+		if _, ok := (*nodeSelector)[key]; ok {
+			continue
+		}
+		if *nodeSelector == nil {
+			*nodeSelector = map[string]string{}
+		}
+		(*nodeSelector)[key] = value
+		added[key] = value
+	}
+	return added
+}
+
+// AddNodeSelectorToPod merges node selector labels for supported platforms into
+// a pod and returns the labels it added
+func AddNodeSelectorToPod(
+	config *PlatformTolerationConfig,
+	pod *corev1.Pod,
+	supportedPlatforms []string,
+) map[string]string {
+	return addNodeSelectorToMap(config, supportedPlatforms, &pod.Spec.NodeSelector)
+}
+
+// AddNodeSelectorToPodTemplate merges node selector labels for supported
+// platforms into a pod template and returns the labels it added
+func AddNodeSelectorToPodTemplate(
+	config *PlatformTolerationConfig,
+	template *corev1.PodTemplateSpec,
+	supportedPlatforms []string,
+) map[string]string {
+	return addNodeSelectorToMap(config, supportedPlatforms, &template.Spec.NodeSelector)
 }
 
 // AddTolerationsToPodTemplate adds tolerations for supported platforms to a pod template
 func AddTolerationsToPodTemplate(
+	ctx context.Context,
 	config *PlatformTolerationConfig,
 	template *corev1.PodTemplateSpec,
 	supportedPlatforms []string,
 ) {
-	addTolerationsToSlice(config, supportedPlatforms, &template.Spec.Tolerations)
+	addTolerationsToSlice(ctx, config, supportedPlatforms, &template.Spec.Tolerations)
 }
@@ -168,8 +168,8 @@ func goldenDaemonSetBody(t *testing.T) []byte {
 // removed struct field is a build failure; a changed wire shape is not).
 func TestProcessAdmissionReview_Golden(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
-	cache.Set(goldenImage+":linux/arm64", true, 0)
-	cache.Set(goldenImage+":linux/amd64", true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
 
 	cfg := goldenConfig()
 
@@ -1,22 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/mattbaird/jsonpatch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	jsonpatchv4 "gopkg.in/evanphx/json-patch.v4"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
 )
 
 func TestProcessAdmissionReview_DaemonSet(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
 	// Set up cache with multi-platform support
-	cache.Set("nginx:latest:linux/arm64", true, 0)
-	cache.Set("nginx:latest:linux/amd64", true, 0)
+	cache.Set(imageCacheKey("nginx:latest", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("nginx:latest", "linux/amd64"), true, 0)
 
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -138,10 +154,404 @@ func TestProcessAdmissionReview_DaemonSet(t *testing.T) {
 	}
 }
 
+func TestProcessAdmissionReview_DaemonSetPolicyAny(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("agent:v1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("agent:v1", "linux/amd64"), false, 0)
+	cache.Set(imageCacheKey("exporter:v1", "linux/arm64"), false, 0)
+	cache.Set(imageCacheKey("exporter:v1", "linux/amd64"), true, 0)
+
+	daemonSet := &appsv1.DaemonSet{
+		TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "node-agent", Namespace: "default"},
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "agent", Image: "agent:v1"},
+				{Name: "exporter", Image: "exporter:v1"},
+			}}},
+		},
+	}
+	body := mustMarshal(t, &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: mustMarshal(t, daemonSet)},
+		},
+	})
+
+	config := goldenConfig()
+	result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if len(result.Response.Patch) != 0 {
+		t.Errorf("patch = %s, want none when no platform is supported by every container", result.Response.Patch)
+	}
+
+	config.DaemonSetPolicy = DaemonSetPolicyAny
+	result, err = ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	for _, value := range []string{`"arm64"`, `"amd64"`} {
+		if !bytes.Contains(result.Response.Patch, []byte(value)) {
+			t.Errorf("patch = %s, want the %s toleration supported by one container", result.Response.Patch, value)
+		}
+	}
+}
+
+func TestProcessAdmissionReview_ReplicationController(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), false, 0)
+
+	review := func(rc *corev1.ReplicationController) []byte {
+		return mustMarshal(t, &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "test-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ReplicationController"},
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: mustMarshal(t, rc)},
+			},
+		})
+	}
+	rc := &corev1.ReplicationController{
+		TypeMeta:   metav1.TypeMeta{Kind: "ReplicationController", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "default"},
+		Spec: corev1.ReplicationControllerSpec{
+			Template: &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "nginx", Image: goldenImage}},
+			}},
+		},
+	}
+
+	result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, review(rc))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	var patches []map[string]any
+	if err := json.Unmarshal(result.Response.Patch, &patches); err != nil {
+		t.Fatalf("Failed to unmarshal patch: %v", err)
+	}
+	if len(patches) != 1 || patches[0]["path"] != "/spec/template/spec/tolerations" {
+		t.Fatalf("patches = %v, want the template tolerations added", patches)
+	}
+	patch := result.Response.Patch
+	if !bytes.Contains(patch, []byte(`"arm64"`)) || bytes.Contains(patch, []byte(`"amd64"`)) {
+		t.Errorf("patch = %s, want only the arm64 toleration", patch)
+	}
+
+	rc.Spec.Template = nil
+	result, err = ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, review(rc))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed for a nil template: %v", err)
+	}
+	if !result.Response.Allowed || len(result.Response.Patch) != 0 {
+		t.Errorf("response = %+v, want allowed without a patch for a nil template", result.Response)
+	}
+}
+
+func TestProcessAdmissionReview_CronJob(t *testing.T) {
+	const jobImage = "registry.example.com/backup:v2"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(jobImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(jobImage, "linux/amd64"), false, 0)
+
+	cronJob := &batchv1.CronJob{
+		TypeMeta:   metav1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly-backup", Namespace: "default"},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          "0 2 * * *",
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					BackoffLimit: ptr.To[int32](3),
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "backup"}},
+						Spec: corev1.PodSpec{
+							RestartPolicy: corev1.RestartPolicyOnFailure,
+							Containers:    []corev1.Container{{Name: "backup", Image: jobImage}},
+							Tolerations: []corev1.Toleration{
+								{Key: "dedicated", Value: "batch", Effect: corev1.TaintEffectNoSchedule},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	body := mustMarshal(t, &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: mustMarshal(t, cronJob)},
+		},
+	})
+
+	for _, strategy := range []string{PatchStrategyDiff, PatchStrategyAppend} {
+		t.Run(strategy, func(t *testing.T) {
+			config := goldenConfig()
+			config.PatchStrategy = strategy
+			result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+
+			var patch []jsonpatch.JsonPatchOperation
+			if err := json.Unmarshal(result.Response.Patch, &patch); err != nil {
+				t.Fatalf("failed to unmarshal patch: %v", err)
+			}
+			if len(patch) != 1 {
+				t.Fatalf("patch = %s, want a single operation adding the arm64 toleration", result.Response.Patch)
+			}
+			if !strings.HasPrefix(patch[0].Path, "/spec/jobTemplate/spec/template/spec/tolerations/") {
+				t.Errorf("patch path = %q, want the jobTemplate pod template tolerations", patch[0].Path)
+			}
+			var added corev1.Toleration
+			if err := json.Unmarshal(mustMarshal(t, patch[0].Value), &added); err != nil {
+				t.Fatal(err)
+			}
+			if added != config.Mappings[0].Toleration {
+				t.Errorf("added toleration = %+v, want %+v", added, config.Mappings[0].Toleration)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_PatchPathsPerKind(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	podSpec := corev1.PodSpec{
+		Containers:  []corev1.Container{{Name: "app", Image: goldenImage}},
+		Tolerations: []corev1.Toleration{{Key: "dedicated", Value: "batch", Effect: corev1.TaintEffectNoSchedule}},
+	}
+	template := corev1.PodTemplateSpec{Spec: podSpec}
+	meta := metav1.ObjectMeta{Name: "app", Namespace: "default"}
+	tests := []struct {
+		gvk      metav1.GroupVersionKind
+		object   any
+		specPath string
+	}{
+		{
+			gvk:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			object:   &corev1.Pod{ObjectMeta: meta, Spec: podSpec},
+			specPath: "/spec",
+		},
+		{
+			gvk:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+			object:   &appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: template}},
+			specPath: "/spec/template/spec",
+		},
+		{
+			gvk: metav1.GroupVersionKind{Version: "v1", Kind: "ReplicationController"},
+			object: &corev1.ReplicationController{
+				ObjectMeta: meta, Spec: corev1.ReplicationControllerSpec{Template: &template},
+			},
+			specPath: "/spec/template/spec",
+		},
+		{
+			gvk: metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+			object: &batchv1.CronJob{ObjectMeta: meta, Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+			}},
+			specPath: "/spec/jobTemplate/spec/template/spec",
+		},
+	}
+	for _, tt := range tests {
+		for _, strategy := range []string{PatchStrategyDiff, PatchStrategyAppend} {
+			t.Run(tt.gvk.Kind+"/"+strategy, func(t *testing.T) {
+				config := goldenConfig()
+				config.PatchStrategy = strategy
+				config.NodeSelectorEnabled = true
+				config.Mappings[0].NodeSelector = map[string]string{"pool": "arm"}
+				body := admissionReviewBytes(t, tt.gvk, mustMarshal(t, tt.object))
+				result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+				if err != nil {
+					t.Fatalf("ProcessAdmissionReview failed: %v", err)
+				}
+
+				var patch []jsonpatch.JsonPatchOperation
+				if err := json.Unmarshal(result.Response.Patch, &patch); err != nil {
+					t.Fatalf("failed to unmarshal patch: %v", err)
+				}
+				var tolerations, nodeSelector bool
+				for _, op := range patch {
+					switch {
+					case strings.HasPrefix(op.Path, tt.specPath+"/tolerations/"):
+						tolerations = true
+					case op.Path == tt.specPath+"/nodeSelector" ||
+						strings.HasPrefix(op.Path, tt.specPath+"/nodeSelector/"):
+						nodeSelector = true
+					default:
+						t.Errorf("patch operation %s %s is outside %s", op.Operation, op.Path, tt.specPath)
+					}
+				}
+				if !tolerations || !nodeSelector {
+					t.Errorf("patch = %s, want tolerations and nodeSelector patched under %s",
+						result.Response.Patch, tt.specPath)
+				}
+			})
+		}
+	}
+
+	t.Run("ReplicationController without template", func(t *testing.T) {
+		rc := &corev1.ReplicationController{ObjectMeta: meta}
+		body := admissionReviewBytes(t,
+			metav1.GroupVersionKind{Version: "v1", Kind: "ReplicationController"}, mustMarshal(t, rc))
+		result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, body)
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if !result.Response.Allowed || len(result.Response.Patch) != 0 {
+			t.Errorf("response = %+v, want allowed without a patch", result.Response)
+		}
+	})
+}
+
+func TestProcessAdmissionReview_StripUnsupportedTolerations(t *testing.T) {
+	const amd64Image = "registry.example.com/legacy:v1"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(amd64Image, "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey(amd64Image, "linux/arm64"), false, 0)
+
+	manual := corev1.Toleration{Key: "arch", Operator: corev1.TolerationOpEqual, Value: "arm64"}
+	dedicated := corev1.Toleration{Key: "dedicated", Value: "batch", Effect: corev1.TaintEffectNoSchedule}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:  []corev1.Container{{Name: "app", Image: amd64Image}},
+			Tolerations: []corev1.Toleration{manual, dedicated},
+		},
+	}
+	podBytes := mustMarshal(t, pod)
+	review := func(operation admissionv1.Operation) []byte {
+		request := &admissionv1.AdmissionRequest{
+			UID:       "test-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: podBytes},
+		}
+		if operation == admissionv1.Update {
+			request.OldObject = runtime.RawExtension{Raw: podBytes}
+		}
+		return mustMarshal(t, &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request:  request,
+		})
+	}
+	patchedTolerations := func(t *testing.T, response *admissionv1.AdmissionResponse) []corev1.Toleration {
+		t.Helper()
+		patch, err := jsonpatchv4.DecodePatch(response.Patch)
+		if err != nil {
+			t.Fatalf("failed to decode patch %s: %v", response.Patch, err)
+		}
+		patched, err := patch.Apply(podBytes)
+		if err != nil {
+			t.Fatalf("failed to apply patch %s: %v", response.Patch, err)
+		}
+		var got corev1.Pod
+		if err := json.Unmarshal(patched, &got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Spec.Tolerations
+	}
+
+	amd64 := goldenConfig().Mappings[1].Toleration
+	for _, strategy := range []string{PatchStrategyDiff, PatchStrategyAppend} {
+		t.Run(strategy, func(t *testing.T) {
+			config := goldenConfig()
+			config.PatchStrategy = strategy
+			config.StripUnsupportedTolerations = true
+			result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, review(admissionv1.Create))
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			want := []corev1.Toleration{dedicated, amd64}
+			if got := patchedTolerations(t, result.Response); !reflect.DeepEqual(got, want) {
+				t.Errorf("tolerations = %+v, want the manual arm64 toleration stripped: %+v", got, want)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, review(admissionv1.Create))
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if got := patchedTolerations(t, result.Response); !slices.Contains(got, manual) {
+			t.Errorf("tolerations = %+v, want the manual arm64 toleration kept", got)
+		}
+	})
+
+	t.Run("pod update", func(t *testing.T) {
+		config := goldenConfig()
+		config.StripUnsupportedTolerations = true
+		result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, review(admissionv1.Update))
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if got := patchedTolerations(t, result.Response); !slices.Contains(got, manual) {
+			t.Errorf("tolerations = %+v, want tolerations kept on a pod update", got)
+		}
+	})
+}
+
+func TestProcessAdmissionReview_RequirePlatforms(t *testing.T) {
+	const singleArchImage = "registry.example.com/legacy:v1"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	for _, platform := range []string{"linux/arm64", "linux/amd64"} {
+		cache.Set(imageCacheKey(goldenImage, platform), true, 0)
+	}
+	cache.Set(imageCacheKey(singleArchImage, "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey(singleArchImage, "linux/arm64"), false, 0)
+
+	config := goldenConfig()
+	config.RequiredPlatforms = []string{"linux/arm64", "linux/amd64"}
+	podWith := func(images ...string) []byte {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+		for _, image := range images {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "c", Image: image})
+		}
+		return admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	}
+
+	result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, podWith(goldenImage))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if !result.Response.Allowed || len(result.Response.Patch) == 0 {
+		t.Errorf("response = %+v, want a multi-arch pod allowed and patched", result.Response)
+	}
+
+	result, err = ProcessAdmissionReview(context.Background(), cache, config, nil, podWith(goldenImage, singleArchImage))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if result.Response.Allowed || result.Response.Result == nil {
+		t.Fatalf("response = %+v, want the pod with a single-arch image rejected", result.Response)
+	}
+	message := result.Response.Result.Message
+	if !strings.Contains(message, `image "`+singleArchImage+`" does not support linux/arm64`) ||
+		strings.Contains(message, goldenImage) {
+		t.Errorf("message = %q, want only the single-arch image listed", message)
+	}
+	if result.Response.Result.Code != http.StatusForbidden {
+		t.Errorf("code = %d, want %d", result.Response.Result.Code, http.StatusForbidden)
+	}
+}
+
 func TestProcessAdmissionReview_Pod(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
 	// Set up cache with arm64 support
-	cache.Set("nginx:latest:linux/arm64", true, 0)
+	cache.Set(imageCacheKey("nginx:latest", "linux/arm64"), true, 0)
 
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -221,3 +631,794 @@ func TestProcessAdmissionReview_Pod(t *testing.T) {
 		t.Fatal("Expected patch to be present")
 	}
 }
+
+func TestProcessAdmissionReview_NamespacePlatformsOverride(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "default",
+			Labels:      map[string]string{"team": "a"},
+			Annotations: map[string]string{AnnotationNamespacePlatforms: "linux/amd64"},
+		},
+	})
+	withKubeClient(t, client)
+	filter := &NamespaceFilterConfig{NamespaceSelector: labels.SelectorFromSet(labels.Set{"team": "a"})}
+
+	result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), filter, goldenPodBody(t))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	// The selector, disabled annotation, and platforms override share one GET.
+	gets := 0
+	for _, action := range client.Actions() {
+		if action.Matches("get", "namespaces") {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("namespace GETs = %d, want 1 per admission", gets)
+	}
+
+	var patches []struct {
+		Path  string              `json:"path"`
+		Value []corev1.Toleration `json:"value"`
+	}
+	if err := json.Unmarshal(result.Response.Patch, &patches); err != nil {
+		t.Fatalf("Failed to unmarshal patch: %v", err)
+	}
+	if len(patches) != 1 || len(patches[0].Value) != 1 || patches[0].Value[0].Value != "amd64" {
+		t.Errorf("expected only the amd64 toleration to be added, got %+v", patches)
+	}
+}
+
+func TestProcessAdmissionReview_PodLabelSelector(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	tests := []struct {
+		name      string
+		selector  string
+		body      []byte
+		wantPatch bool
+	}{
+		{name: "matching daemonset template", selector: "app=golden", body: goldenDaemonSetBody(t), wantPatch: true},
+		{name: "non-matching daemonset template", selector: "app!=golden", body: goldenDaemonSetBody(t)},
+		{name: "unlabeled pod does not match", selector: "app=golden", body: goldenPodBody(t)},
+		{name: "unlabeled pod matches negated selector", selector: "!app", body: goldenPodBody(t), wantPatch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			if err != nil {
+				t.Fatalf("labels.Parse(%q) failed: %v", tt.selector, err)
+			}
+			filter := &NamespaceFilterConfig{PodSelector: selector}
+
+			result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), filter, tt.body)
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			if got := result.Response.Patch != nil; got != tt.wantPatch {
+				t.Errorf("patched = %v, want %v", got, tt.wantPatch)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_APIVersions(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "versioned-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "nginx", Image: goldenImage}},
+		},
+	}
+	podKind := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	object := runtime.RawExtension{Raw: mustMarshal(t, pod)}
+
+	tests := []struct {
+		name       string
+		apiVersion string
+		uid        types.UID
+		body       []byte
+	}{
+		{
+			name:       "v1",
+			apiVersion: admissionv1.SchemeGroupVersion.String(),
+			uid:        "uid-v1",
+			body: mustMarshal(t, &admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+				Request:  &admissionv1.AdmissionRequest{UID: "uid-v1", Kind: podKind, Object: object},
+			}),
+		},
+		{
+			name:       "v1beta1",
+			apiVersion: admissionv1beta1.SchemeGroupVersion.String(),
+			uid:        "uid-v1beta1",
+			body: mustMarshal(t, &admissionv1beta1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1beta1"},
+				Request:  &admissionv1beta1.AdmissionRequest{UID: "uid-v1beta1", Kind: podKind, Object: object},
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, tt.body)
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+
+			// Decode the wire response into the requested version's type.
+			var decoded admissionv1beta1.AdmissionReview
+			if err := json.Unmarshal(mustMarshal(t, result), &decoded); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if decoded.APIVersion != tt.apiVersion || decoded.Kind != "AdmissionReview" {
+				t.Errorf("response TypeMeta = %+v, want apiVersion %s", decoded.TypeMeta, tt.apiVersion)
+			}
+			if decoded.Response == nil || decoded.Response.UID != tt.uid {
+				t.Fatalf("response UID mismatch: %+v", decoded.Response)
+			}
+			if decoded.Response.PatchType == nil || *decoded.Response.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+				t.Errorf("expected JSONPatch patch type, got %v", decoded.Response.PatchType)
+			}
+			if len(decoded.Response.Patch) == 0 {
+				t.Error("expected a non-empty patch")
+			}
+		})
+	}
+}
+
+func TestAdmissionReviewFromRequest_UnsupportedVersion(t *testing.T) {
+	body := []byte(`{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview", "request": {"uid": "x"}}`)
+	if _, err := AdmissionReviewFromRequest(body); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("error = %v, want ErrBadRequest for an unsupported apiVersion", err)
+	}
+}
+
+func TestProcessAdmissionReview_PatchWarnBytes(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	var logs bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+	for _, tt := range []struct {
+		name      string
+		warnBytes int
+		wantWarn  bool
+	}{
+		{name: "disabled", warnBytes: 0, wantWarn: false},
+		{name: "under threshold", warnBytes: 1 << 20, wantWarn: false},
+		{name: "over threshold", warnBytes: 1, wantWarn: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			config := goldenConfig()
+			config.PatchWarnBytes = tt.warnBytes
+
+			if _, err := ProcessAdmissionReview(context.Background(), cache, config, nil, goldenPodBody(t)); err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			warned := strings.Contains(logs.String(), "admission patch exceeds PATCH_WARN_BYTES")
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v, want %v; logs=%s", warned, tt.wantWarn, logs.String())
+			}
+			if warned && !strings.Contains(logs.String(), "name=golden-pod") {
+				t.Errorf("expected the warning to identify the pod; logs=%s", logs.String())
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_NodeSelector(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), false, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	podBody := func(nodeSelector map[string]string) []byte {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "selector-pod", Namespace: "default"},
+			Spec: corev1.PodSpec{
+				Containers:   []corev1.Container{{Name: "nginx", Image: goldenImage}},
+				Tolerations:  []corev1.Toleration{},
+				NodeSelector: nodeSelector,
+			},
+		}
+		return admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	}
+
+	tests := []struct {
+		name         string
+		strategy     string
+		nodeSelector map[string]string
+		want         map[string]any
+	}{
+		{
+			name:         "diff merges into existing selector",
+			strategy:     PatchStrategyDiff,
+			nodeSelector: map[string]string{"disk": "ssd"},
+			want:         map[string]any{"/spec/nodeSelector/kubernetes.io~1arch": "arm64"},
+		},
+		{
+			name:         "append merges into existing selector",
+			strategy:     PatchStrategyAppend,
+			nodeSelector: map[string]string{"disk": "ssd"},
+			want:         map[string]any{"/spec/nodeSelector/kubernetes.io~1arch": "arm64"},
+		},
+		{
+			name:     "append creates missing selector",
+			strategy: PatchStrategyAppend,
+			want:     map[string]any{"/spec/nodeSelector": map[string]any{"kubernetes.io/arch": "arm64"}},
+		},
+		{
+			name:         "existing key is not overwritten",
+			strategy:     PatchStrategyAppend,
+			nodeSelector: map[string]string{"kubernetes.io/arch": "arm64", "disk": "ssd"},
+			want:         map[string]any{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := goldenConfig()
+			config.PatchStrategy = tt.strategy
+			config.NodeSelectorEnabled = true
+			config.Mappings[0].NodeSelector = map[string]string{"kubernetes.io/arch": "arm64"}
+
+			result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, podBody(tt.nodeSelector))
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+
+			var patches []map[string]any
+			if err := json.Unmarshal(result.Response.Patch, &patches); err != nil {
+				t.Fatalf("Failed to unmarshal patch: %v", err)
+			}
+			got := map[string]any{}
+			for _, patch := range patches {
+				if path := patch["path"].(string); strings.HasPrefix(path, "/spec/nodeSelector") {
+					got[path] = patch["value"]
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeSelector patch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_PinnedArch(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	podBody := func(arch string) []byte {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "pinned-pod", Namespace: "default"},
+			Spec: corev1.PodSpec{
+				Containers:   []corev1.Container{{Name: "nginx", Image: goldenImage}},
+				NodeSelector: map[string]string{corev1.LabelArchStable: arch},
+			},
+		}
+		return admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	}
+
+	config := goldenConfig()
+	config.PatchStrategy = PatchStrategyAppend
+	result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, podBody("arm64"))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	var patches []struct {
+		Value []corev1.Toleration `json:"value"`
+	}
+	if err := json.Unmarshal(result.Response.Patch, &patches); err != nil {
+		t.Fatalf("Failed to unmarshal patch: %v", err)
+	}
+	if len(patches) != 1 || len(patches[0].Value) != 1 || patches[0].Value[0].Value != "arm64" {
+		t.Errorf("patch = %s, want only the pinned arm64 toleration", result.Response.Patch)
+	}
+
+	result, err = ProcessAdmissionReview(context.Background(), cache, config, nil, podBody("s390x"))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if len(result.Response.Patch) != 0 {
+		t.Errorf("patch = %s, want none for an architecture without a mapping", result.Response.Patch)
+	}
+}
+
+func TestProcessAdmissionReview_DecisionOnly(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), false, 0)
+	cache.Set(imageCacheKey("example.com/legacy:1", "linux/arm64"), false, 0)
+	cache.Set(imageCacheKey("example.com/legacy:1", "linux/amd64"), false, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	podBody := func(image string, annotations map[string]string) []byte {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "decision-pod", Namespace: "default", Annotations: annotations},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+		return admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	}
+
+	tests := []struct {
+		name        string
+		image       string
+		annotations map[string]string
+		want        []jsonpatch.JsonPatchOperation
+	}{
+		{
+			name:  "creates the annotations",
+			image: goldenImage,
+			want: []jsonpatch.JsonPatchOperation{{
+				Operation: "add",
+				Path:      "/metadata/annotations",
+				Value:     map[string]any{AnnotationDetectedPlatforms: "linux/arm64"},
+			}},
+		},
+		{
+			name:        "adds to existing annotations",
+			image:       goldenImage,
+			annotations: map[string]string{"team": "web"},
+			want: []jsonpatch.JsonPatchOperation{{
+				Operation: "add",
+				Path:      "/metadata/annotations/k8smultiarcher.programmerq.io~1detected-platforms",
+				Value:     "linux/arm64",
+			}},
+		},
+		{
+			name:  "records that no platform is supported",
+			image: "example.com/legacy:1",
+			want: []jsonpatch.JsonPatchOperation{{
+				Operation: "add",
+				Path:      "/metadata/annotations",
+				Value:     map[string]any{AnnotationDetectedPlatforms: ""},
+			}},
+		},
+		{
+			name:        "unchanged decision",
+			image:       goldenImage,
+			annotations: map[string]string{AnnotationDetectedPlatforms: "linux/arm64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := goldenConfig()
+			config.DecisionOnly = true
+			result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, podBody(tt.image, tt.annotations))
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			var got []jsonpatch.JsonPatchOperation
+			if len(result.Response.Patch) > 0 {
+				if err := json.Unmarshal(result.Response.Patch, &got); err != nil {
+					t.Fatalf("Failed to unmarshal patch: %v", err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patch = %s, want only the annotation %+v", result.Response.Patch, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_UnsupportedKind(t *testing.T) {
+	body := admissionReviewBytes(t,
+		metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		[]byte(`{"metadata":{"name":"web","namespace":"default"}}`))
+	cache := NewInMemoryCache(cacheSizeDefault)
+
+	result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, body)
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if !result.Response.Allowed || len(result.Response.Patch) != 0 {
+		t.Errorf("expected an allowed response with no patch, got %+v", result.Response)
+	}
+
+	config := goldenConfig()
+	config.StrictKinds = true
+	if _, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("error = %v, want ErrBadRequest for an unsupported kind with StrictKinds", err)
+	}
+}
+
+func TestProcessAdmissionReview_EmitWarnings(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), false, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, goldenPodBody(t))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	if len(result.Response.Warnings) != 0 {
+		t.Errorf("expected no warnings without EmitWarnings, got %q", result.Response.Warnings)
+	}
+
+	config := goldenConfig()
+	config.EmitWarnings = true
+	result, err = ProcessAdmissionReview(context.Background(), cache, config, nil, goldenPodBody(t))
+	if err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+	want := []string{"image nginx:latest lacks linux/arm64 support; no linux/arm64 toleration added"}
+	if !slices.Equal(result.Response.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", result.Response.Warnings, want)
+	}
+	if len(result.Response.Patch) == 0 {
+		t.Error("expected the amd64 toleration to still be patched")
+	}
+}
+
+func TestProcessAdmissionReview_InvalidImage(t *testing.T) {
+	const invalidImage = "nginx:not a tag"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	body := mustMarshal(t, &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "invalid-image-uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Object: runtime.RawExtension{Raw: mustMarshal(t, &corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "invalid-image-pod", Namespace: "default"},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: invalidImage}},
+				},
+			})},
+		},
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, body)
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if !result.Response.Allowed {
+			t.Fatalf("expected an allowed response, got %+v", result.Response)
+		}
+		warnings := result.Response.Warnings
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "not a valid image reference") {
+			t.Errorf("warnings = %q, want one invalid reference warning", warnings)
+		}
+		for _, platform := range []string{"linux/arm64", "linux/amd64"} {
+			if _, ok := cache.Get(imageCacheKey(invalidImage, platform)); ok {
+				t.Errorf("expected no cached result for the invalid image on %s", platform)
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		config := goldenConfig()
+		config.InvalidImagePolicy = InvalidImagePolicyReject
+		counter := admissionRequests.WithLabelValues("Pod", "default", admissionOutcomeRejected)
+		before := testutil.ToFloat64(counter)
+
+		result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if result.Response.Allowed || result.Response.Result == nil ||
+			!strings.Contains(result.Response.Result.Message, invalidImage) {
+			t.Errorf("expected a denied response naming the image, got %+v", result.Response)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("rejected outcome increased by %v, want 1", got)
+		}
+	})
+}
+
+func TestProcessAdmissionReview_AppendPatchStrategy(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	config := goldenConfig()
+	config.PatchStrategy = PatchStrategyAppend
+
+	existing := corev1.Toleration{Key: "other", Operator: corev1.TolerationOpExists}
+	podBody := func(tolerations []corev1.Toleration) []byte {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "append-pod", Namespace: "default"},
+			Spec: corev1.PodSpec{
+				Containers:  []corev1.Container{{Name: "nginx", Image: goldenImage}},
+				Tolerations: tolerations,
+			},
+		}
+		return admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	}
+
+	tests := []struct {
+		name      string
+		body      []byte
+		wantPaths []string
+	}{
+		{
+			name:      "existing tolerations are appended to",
+			body:      podBody([]corev1.Toleration{existing}),
+			wantPaths: []string{"/spec/tolerations/-", "/spec/tolerations/-"},
+		},
+		{
+			name:      "missing tolerations array is created",
+			body:      podBody(nil),
+			wantPaths: []string{"/spec/tolerations"},
+		},
+		{
+			name:      "missing daemonset template tolerations array is created",
+			body:      goldenDaemonSetBody(t),
+			wantPaths: []string{"/spec/template/spec/tolerations"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, tt.body)
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+
+			var patches []map[string]any
+			if err := json.Unmarshal(result.Response.Patch, &patches); err != nil {
+				t.Fatalf("Failed to unmarshal patch: %v", err)
+			}
+			gotPaths := make([]string, 0, len(patches))
+			for _, patch := range patches {
+				if patch["op"] != "add" {
+					t.Errorf("expected only add operations, got %v", patch)
+				}
+				gotPaths = append(gotPaths, patch["path"].(string))
+			}
+			if !slices.Equal(gotPaths, tt.wantPaths) {
+				t.Errorf("patch paths = %v, want %v", gotPaths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_EphemeralContainersSubresource(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+
+	oldPod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "debugged-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "uncached-app"}},
+		},
+	}
+	pod := oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "debug-image"}},
+	}
+
+	for name, oldRaw := range map[string][]byte{
+		"added container":    mustMarshal(t, oldPod),
+		"unreadable old pod": []byte(`{"spec":"not-a-spec"}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := mustMarshal(t, &admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:         "ephemeral-uid",
+					Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					SubResource: "ephemeralcontainers",
+					Operation:   admissionv1.Update,
+					Object:      runtime.RawExtension{Raw: mustMarshal(t, pod)},
+					OldObject:   runtime.RawExtension{Raw: oldRaw},
+				},
+			})
+
+			result, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, body)
+			if err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			if result.Response == nil || !result.Response.Allowed {
+				t.Fatalf("expected an allowed response, got %+v", result.Response)
+			}
+			if result.Response.Patch != nil {
+				t.Errorf("expected no patch on the ephemeralcontainers subresource, got %s", result.Response.Patch)
+			}
+			// The images are only logged; a lookup would have cached a failure.
+			for _, image := range []string{"uncached-app", "debug-image"} {
+				if _, ok := cache.Get(imageCacheKey(image, "linux/arm64")); ok {
+					t.Errorf("expected %s not to be looked up", image)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReview_SkipToleratedUpdates(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+
+	config := goldenConfig()
+	config.SkipToleratedUpdates = true
+
+	oldPod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "tolerated-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:  []corev1.Container{{Name: "app", Image: "uncached-app"}},
+			Tolerations: []corev1.Toleration{config.Mappings[0].Toleration, config.Mappings[1].Toleration},
+		},
+	}
+	updateBody := func(pod *corev1.Pod) []byte {
+		return mustMarshal(t, &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "update-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: mustMarshal(t, pod)},
+				OldObject: runtime.RawExtension{Raw: mustMarshal(t, oldPod)},
+			},
+		})
+	}
+
+	t.Run("unchanged images are not inspected", func(t *testing.T) {
+		pod := oldPod.DeepCopy()
+		pod.Labels = map[string]string{"updated": "true"}
+		result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, updateBody(pod))
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if !result.Response.Allowed || result.Response.Patch != nil {
+			t.Errorf("expected an allowed response with no patch, got %+v", result.Response)
+		}
+		if _, ok := cache.Get(imageCacheKey("uncached-app", "linux/arm64")); ok {
+			t.Error("expected the unchanged image not to be inspected")
+		}
+	})
+
+	t.Run("partially tolerated pods are inspected", func(t *testing.T) {
+		oldPod := oldPod.DeepCopy()
+		oldPod.Spec.Containers[0].Image = goldenImage
+		oldPod.Spec.Tolerations = []corev1.Toleration{config.Mappings[0].Toleration}
+		pod := oldPod.DeepCopy()
+		pod.Labels = map[string]string{"updated": "true"}
+		body := mustMarshal(t, &admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       "update-uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Operation: admissionv1.Update,
+				Object:    runtime.RawExtension{Raw: mustMarshal(t, pod)},
+				OldObject: runtime.RawExtension{Raw: mustMarshal(t, oldPod)},
+			},
+		})
+		result, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body)
+		if err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if !strings.Contains(string(result.Response.Patch), `"amd64"`) {
+			t.Errorf("expected the missing amd64 toleration to be patched, got %s", result.Response.Patch)
+		}
+	})
+
+	t.Run("changed images are inspected", func(t *testing.T) {
+		cache := newRecordingCache()
+		cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+		cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+		pod := oldPod.DeepCopy()
+		pod.Spec.Containers[0].Image = goldenImage
+		if _, err := ProcessAdmissionReview(context.Background(), cache, config, nil, updateBody(pod)); err != nil {
+			t.Fatalf("ProcessAdmissionReview failed: %v", err)
+		}
+		if cache.gets == 0 {
+			t.Error("expected the changed image to be inspected")
+		}
+	})
+}
+
+func TestNewEphemeralContainers(t *testing.T) {
+	ephemeral := func(name, image string) corev1.EphemeralContainer {
+		return corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name, Image: image}}
+	}
+	oldPod := &corev1.Pod{Spec: corev1.PodSpec{
+		EphemeralContainers: []corev1.EphemeralContainer{ephemeral("debug-1", "busybox")},
+	}}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		EphemeralContainers: []corev1.EphemeralContainer{ephemeral("debug-1", "busybox"), ephemeral("debug-2", "alpine")},
+	}}
+
+	got := newEphemeralContainers(oldPod, pod)
+	if len(got) != 1 || got[0].Name != "debug-2" || got[0].Image != "alpine" {
+		t.Errorf("newEphemeralContainers() = %+v, want only debug-2", got)
+	}
+}
+
+func TestProcessAdmissionReview_OutcomeMetrics(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), true, 0)
+	withKubeClient(t, fake.NewSimpleClientset())
+
+	prev := metricsNamespaceLabel
+	t.Cleanup(func() { metricsNamespaceLabel = prev })
+
+	// The API server always sets the request namespace; the golden body does not.
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(goldenPodBody(t), &review); err != nil {
+		t.Fatalf("failed to unmarshal golden review: %v", err)
+	}
+	review.Request.Namespace = "default"
+	body := mustMarshal(t, &review)
+
+	for _, tt := range []struct {
+		name           string
+		namespaceLabel bool
+		wantNamespace  string
+	}{
+		{name: "namespace label enabled", namespaceLabel: true, wantNamespace: "default"},
+		{name: "namespace label disabled", namespaceLabel: false, wantNamespace: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			metricsNamespaceLabel = tt.namespaceLabel
+			counter := admissionRequests.WithLabelValues("Pod", tt.wantNamespace, admissionOutcomeMutated)
+			before := testutil.ToFloat64(counter)
+
+			if _, err := ProcessAdmissionReview(context.Background(), cache, goldenConfig(), nil, body); err != nil {
+				t.Fatalf("ProcessAdmissionReview failed: %v", err)
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("mutated counter for namespace %q increased by %v, want 1", tt.wantNamespace, got)
+			}
+		})
+	}
+}
+
+func TestAdmissionOutcome(t *testing.T) {
+	const tolerationsPatch = `[{"op":"add","path":"/spec/tolerations","value":[]}]`
+	withPatch := func(patch string) *admissionv1.AdmissionReview {
+		return &admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{Allowed: true, Patch: []byte(patch)}}
+	}
+	denied := &admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{Allowed: false}}
+
+	tests := []struct {
+		name   string
+		review *admissionv1.AdmissionReview
+		err    error
+		want   string
+	}{
+		{name: "error", err: errors.New("boom"), want: admissionOutcomeError},
+		{name: "no patch", review: withPatch(""), want: admissionOutcomeUnchanged},
+		{name: "empty patch", review: withPatch("[]"), want: admissionOutcomeUnchanged},
+		{name: "null patch", review: withPatch("null"), want: admissionOutcomeUnchanged},
+		{name: "patch", review: withPatch(tolerationsPatch), want: admissionOutcomeMutated},
+		{name: "denied", review: denied, want: admissionOutcomeRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := admissionOutcome(tt.review, tt.err); got != tt.want {
+				t.Errorf("admissionOutcome() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/config"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestGetPodSupportedPlatforms(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
-	cache.Set("image1:linux/arm64", true, 0)
-	cache.Set("image1:linux/amd64", true, 0)
-	cache.Set("image2:linux/arm64", true, 0)
-	cache.Set("image2:linux/amd64", false, 0)
-	cache.Set("image3:linux/arm64", false, 0)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image1", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("image2", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image2", "linux/amd64"), false, 0)
+	cache.Set(imageCacheKey("image3", "linux/arm64"), false, 0)
 
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -104,12 +118,12 @@ func TestGetPodSupportedPlatforms(t *testing.T) {
 
 func TestGetPodSupportedPlatforms_WithInitContainers(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
-	cache.Set("image1:linux/arm64", true, 0)
-	cache.Set("image1:linux/amd64", true, 0)
-	cache.Set("image2:linux/arm64", true, 0)
-	cache.Set("image2:linux/amd64", false, 0)
-	cache.Set("init-image:linux/arm64", true, 0)
-	cache.Set("init-image:linux/amd64", false, 0)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image1", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("image2", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image2", "linux/amd64"), false, 0)
+	cache.Set(imageCacheKey("init-image", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("init-image", "linux/amd64"), false, 0)
 
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -204,6 +218,296 @@ func TestGetPodSupportedPlatforms_WithInitContainers(t *testing.T) {
 	}
 }
 
+func TestGetPodSupportedPlatforms_InitContainerPolicy(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image1", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("amd64-migrator", "linux/arm64"), false, 0)
+	cache.Set(imageCacheKey("amd64-migrator", "linux/amd64"), true, 0)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:     []corev1.Container{{Name: "app", Image: "image1"}},
+			InitContainers: []corev1.Container{{Name: "migrate", Image: "amd64-migrator"}},
+		},
+	}
+
+	tests := []struct {
+		policy   string
+		expected []string
+		wantWarn bool
+	}{
+		{policy: "", expected: []string{"linux/amd64"}},
+		{policy: InitContainerPolicyInclude, expected: []string{"linux/amd64"}},
+		{policy: InitContainerPolicyExclude, expected: []string{"linux/arm64", "linux/amd64"}},
+		{policy: InitContainerPolicyWarnOnly, expected: []string{"linux/arm64", "linux/amd64"}, wantWarn: true},
+	}
+
+	var logs bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+	for _, tt := range tests {
+		t.Run(cmp.Or(tt.policy, "unset"), func(t *testing.T) {
+			logs.Reset()
+			config := &PlatformTolerationConfig{
+				Mappings:            []PlatformTolerationMapping{{Platform: "linux/arm64"}, {Platform: "linux/amd64"}},
+				InitContainerPolicy: tt.policy,
+			}
+
+			got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("GetPodSupportedPlatforms() = %v, want %v", got, tt.expected)
+			}
+			warned := strings.Contains(logs.String(), "init containers do not support")
+			if warned != tt.wantWarn {
+				t.Errorf("warned about init containers = %v, want %v; logs=%s", warned, tt.wantWarn, logs.String())
+			}
+		})
+	}
+}
+
+func TestGetPodSupportedPlatforms_EmptyImage(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{{Platform: "linux/arm64"}},
+	}
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "image1"}},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}},
+			},
+		},
+	}
+
+	got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+	if !slices.Equal(got, []string{"linux/arm64"}) {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want [linux/arm64]", got)
+	}
+
+	// A pod with only empty images has nothing to inspect and gets no platforms.
+	pod.Spec.Containers = nil
+	if got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil); len(got) != 0 {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want no platforms", got)
+	}
+}
+
+func TestGetPodSupportedPlatforms_IgnoreContainerNames(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("amd64-only-proxy", "linux/arm64"), false, 0)
+
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{{Platform: "linux/arm64"}},
+	}
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "image1"},
+				{Name: "istio-proxy", Image: "amd64-only-proxy"},
+			},
+		},
+	}
+
+	if got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil); len(got) != 0 {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want the sidecar to veto linux/arm64", got)
+	}
+
+	config.IgnoreContainerNames = map[string]bool{"istio-proxy": true}
+	got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+	if !slices.Equal(got, []string{"linux/arm64"}) {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want [linux/arm64] with the sidecar ignored", got)
+	}
+}
+
+func TestGetPodSupportedPlatforms_DeniedImagePlatforms(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image1", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("legacy-app", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("legacy-app", "linux/amd64"), true, 0)
+
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{{Platform: "linux/arm64"}, {Platform: "linux/amd64"}},
+		DeniedImagePlatforms: []DeniedImagePlatforms{
+			{Pattern: "legacy-*", Platforms: []string{"linux/arm64"}},
+		},
+	}
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "image1"},
+				{Name: "legacy", Image: "legacy-app"},
+			},
+		},
+	}
+
+	got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+	if !slices.Equal(got, []string{"linux/amd64"}) {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want [linux/amd64]", got)
+	}
+
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	got = GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+	if !slices.Equal(got, []string{"linux/arm64", "linux/amd64"}) {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want both platforms without the denied image", got)
+	}
+}
+
+func TestGetPodSupportedPlatforms_OnAuthError(t *testing.T) {
+	const private = "private.example.com/app:v1"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	for _, platform := range []string{"linux/arm64", "linux/amd64"} {
+		cache.Set(imageCacheKey("image1", platform), true, 0)
+		cache.Set(imageCacheKey(private, platform), false, 0)
+		cache.Set(authFailedCacheKey(imageCacheKey(private, platform)), true, 0)
+	}
+
+	both := []string{"linux/arm64", "linux/amd64"}
+	tests := []struct {
+		policy string
+		images []string
+		want   []string
+	}{
+		{policy: OnAuthErrorStrip, images: []string{"image1", private}, want: []string{}},
+		{policy: OnAuthErrorSkipImage, images: []string{"image1", private}, want: both},
+		{policy: OnAuthErrorAssumeSupported, images: []string{"image1", private}, want: both},
+		{policy: OnAuthErrorSkipImage, images: []string{private}, want: []string{}},
+		{policy: OnAuthErrorAssumeSupported, images: []string{private}, want: both},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d images", tt.policy, len(tt.images)), func(t *testing.T) {
+			config := &PlatformTolerationConfig{
+				Mappings:    []PlatformTolerationMapping{{Platform: "linux/arm64"}, {Platform: "linux/amd64"}},
+				OnAuthError: tt.policy,
+			}
+			pod := &corev1.Pod{}
+			for i, image := range tt.images {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: fmt.Sprint(i), Image: image})
+			}
+			got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GetPodSupportedPlatforms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPodSupportedPlatforms_LocalImagePolicy(t *testing.T) {
+	const local = "local/app:dev"
+	cache := NewInMemoryCache(cacheSizeDefault)
+	for _, platform := range []string{"linux/arm64", "linux/amd64"} {
+		cache.Set(imageCacheKey("image1", platform), true, 0)
+		// A local image is not in any registry, so its lookup finds nothing.
+		cache.Set(imageCacheKey(local, platform), false, 0)
+	}
+
+	both := []string{"linux/arm64", "linux/amd64"}
+	tests := []struct {
+		policy     string
+		withImage1 bool
+		want       []string
+	}{
+		{policy: LocalImagePolicyInspect, withImage1: true, want: []string{}},
+		{policy: LocalImagePolicySkip, withImage1: true, want: both},
+		{policy: LocalImagePolicyAssumeSupported, withImage1: true, want: both},
+		{policy: LocalImagePolicySkip, want: []string{}},
+		{policy: LocalImagePolicyAssumeSupported, want: both},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/with image1 %v", tt.policy, tt.withImage1), func(t *testing.T) {
+			config := &PlatformTolerationConfig{
+				Mappings:         []PlatformTolerationMapping{{Platform: "linux/arm64"}, {Platform: "linux/amd64"}},
+				LocalImagePolicy: tt.policy,
+			}
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "local", Image: local, ImagePullPolicy: corev1.PullNever},
+			}}}
+			if tt.withImage1 {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "app", Image: "image1"})
+			}
+			got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GetPodSupportedPlatforms() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPodSupportedPlatforms_MaxLookupsPerAdmission(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("cached-image", "linux/arm64"), true, 0)
+
+	config := &PlatformTolerationConfig{
+		Mappings:               []PlatformTolerationMapping{{Platform: "linux/arm64"}},
+		MaxLookupsPerAdmission: 1,
+	}
+
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "cached-image"},
+				{Image: "uncached-image-1"},
+				{Image: "uncached-image-2"},
+			},
+		},
+	}
+
+	got := GetPodSupportedPlatforms(context.Background(), cache, config, pod, nil)
+	if len(got) != 0 {
+		t.Errorf("GetPodSupportedPlatforms() = %v, want no platforms when over the lookup cap", got)
+	}
+	if _, ok := cache.Get(imageCacheKey("uncached-image-1", "linux/arm64")); ok {
+		t.Error("expected no registry lookup to be attempted when over the lookup cap")
+	}
+}
+
+func TestCountUncachedImages(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("image1", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image1", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("image2", "linux/arm64"), true, 0)
+
+	containers := []corev1.Container{
+		{Image: "image1"},
+		{Image: "image2"},
+		{Image: "image3"},
+		{Image: "image3"},
+	}
+
+	got := countUncachedImages(cache, []string{"linux/arm64", "linux/amd64"}, containers)
+	if got != 2 {
+		t.Errorf("countUncachedImages() = %d, want 2", got)
+	}
+}
+
+func TestWithNoCacheAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "no annotations", annotations: nil, want: false},
+		{name: "annotation true", annotations: map[string]string{AnnotationNoCache: "true"}, want: true},
+		{name: "annotation false", annotations: map[string]string{AnnotationNoCache: "false"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheBypassed(withNoCacheAnnotation(context.Background(), tt.annotations)); got != tt.want {
+				t.Errorf("cacheBypassed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestAddTolerationsToPod(t *testing.T) {
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -235,7 +539,7 @@ func TestAddTolerationsToPod(t *testing.T) {
 	}
 
 	supportedPlatforms := []string{"linux/arm64", "linux/amd64"}
-	AddTolerationsToPod(config, pod, supportedPlatforms)
+	AddTolerationsToPod(context.Background(), config, pod, supportedPlatforms)
 
 	if len(pod.Spec.Tolerations) != 2 {
 		t.Errorf("Expected 2 tolerations, got %d", len(pod.Spec.Tolerations))
@@ -263,6 +567,30 @@ func TestAddTolerationsToPod(t *testing.T) {
 	}
 }
 
+func TestAddTolerationsToPod_StableOrder(t *testing.T) {
+	arm := PlatformTolerationMapping{Platform: "linux/arm64", Toleration: corev1.Toleration{Key: "arch", Value: "arm64"}}
+	amd := PlatformTolerationMapping{Platform: "linux/amd64", Toleration: corev1.Toleration{Key: "arch", Value: "amd64"}}
+	armv7 := PlatformTolerationMapping{Platform: "linux/arm/v7", Toleration: corev1.Toleration{Key: "arm", Value: "v7"}}
+	portable := &corev1.Toleration{Key: "a-portable", Operator: corev1.TolerationOpExists}
+
+	want := []corev1.Toleration{*portable, arm.Toleration, amd.Toleration, armv7.Toleration}
+	slices.SortFunc(want, compareTolerations)
+	for _, mappings := range [][]PlatformTolerationMapping{{arm, amd, armv7}, {armv7, amd, arm}, {amd, armv7, arm}} {
+		for _, platforms := range [][]string{
+			{"linux/arm64", "linux/amd64", "linux/arm/v7"},
+			{"linux/arm/v7", "linux/amd64", "linux/arm64"},
+		} {
+			config := &PlatformTolerationConfig{Mappings: mappings, FullyPortableToleration: portable}
+			pod := &corev1.Pod{}
+			AddTolerationsToPod(context.Background(), config, pod, platforms)
+			if !slices.Equal(pod.Spec.Tolerations, want) {
+				t.Errorf("mappings %v, platforms %v: tolerations = %v, want %v",
+					config.GetPlatforms(), platforms, pod.Spec.Tolerations, want)
+			}
+		}
+	}
+}
+
 func TestAddTolerationsToPod_NoDuplicates(t *testing.T) {
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -292,13 +620,133 @@ func TestAddTolerationsToPod_NoDuplicates(t *testing.T) {
 	}
 
 	supportedPlatforms := []string{"linux/arm64"}
-	AddTolerationsToPod(config, pod, supportedPlatforms)
+	AddTolerationsToPod(context.Background(), config, pod, supportedPlatforms)
 
 	if len(pod.Spec.Tolerations) != 1 {
 		t.Errorf("Expected 1 toleration (no duplicate), got %d", len(pod.Spec.Tolerations))
 	}
 }
 
+func TestAddTolerationsToPod_CatchAll(t *testing.T) {
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{
+			{
+				Platform: "linux/arm64",
+				Toleration: corev1.Toleration{
+					Key:      "arch",
+					Value:    "arm64",
+					Operator: corev1.TolerationOpEqual,
+					Effect:   corev1.TaintEffectNoSchedule,
+				},
+			},
+			{
+				Platform: "linux/amd64",
+				Toleration: corev1.Toleration{
+					Key:      "arch",
+					Value:    "amd64",
+					Operator: corev1.TolerationOpEqual,
+					Effect:   corev1.TaintEffectNoExecute,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		catchAll corev1.Toleration
+		want     int
+	}{
+		{
+			name:     "catch-all with no effect covers everything",
+			catchAll: corev1.Toleration{Operator: corev1.TolerationOpExists},
+			want:     1,
+		},
+		{
+			name:     "catch-all with matching effect covers only that effect",
+			catchAll: corev1.Toleration{Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+			want:     2,
+		},
+		{
+			name:     "keyed Exists toleration is not a catch-all",
+			catchAll: corev1.Toleration{Key: "arch", Operator: corev1.TolerationOpExists},
+			want:     3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Tolerations: []corev1.Toleration{tt.catchAll},
+				},
+			}
+			AddTolerationsToPod(context.Background(), config, pod, []string{"linux/arm64", "linux/amd64"})
+
+			if len(pod.Spec.Tolerations) != tt.want {
+				t.Errorf("Expected %d tolerations, got %d: %v", tt.want, len(pod.Spec.Tolerations), pod.Spec.Tolerations)
+			}
+		})
+	}
+}
+
+func TestAddTolerationsToPod_FullyPortable(t *testing.T) {
+	portable := corev1.Toleration{
+		Key:      "k8smultiarcher/portable",
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectPreferNoSchedule,
+	}
+	config := goldenConfig()
+	config.FullyPortableToleration = &portable
+
+	tests := []struct {
+		name      string
+		platforms []string
+		want      bool
+		wantCount int
+	}{
+		{name: "all platforms supported", platforms: []string{"linux/arm64", "linux/amd64"}, want: true, wantCount: 3},
+		{name: "partial support", platforms: []string{"linux/amd64"}, want: false, wantCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{}
+			AddTolerationsToPod(context.Background(), config, pod, tt.platforms)
+
+			if got := slices.Contains(pod.Spec.Tolerations, portable); got != tt.want {
+				t.Errorf("fully portable toleration added = %v, want %v: %v", got, tt.want, pod.Spec.Tolerations)
+			}
+			if len(pod.Spec.Tolerations) != tt.wantCount {
+				t.Errorf("Expected %d tolerations, got %d: %v", tt.wantCount, len(pod.Spec.Tolerations), pod.Spec.Tolerations)
+			}
+		})
+	}
+}
+
+func TestAddNodeSelectorToPod(t *testing.T) {
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{
+			{Platform: "linux/arm64", NodeSelector: map[string]string{"kubernetes.io/arch": "arm64", "disk": "hdd"}},
+			{Platform: "linux/amd64", NodeSelector: map[string]string{"kubernetes.io/arch": "amd64", "zone": "a"}},
+		},
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"disk": "ssd"}}}
+
+	if added := AddNodeSelectorToPod(config, pod, []string{"linux/arm64", "linux/amd64"}); added != nil {
+		t.Errorf("expected no labels added while disabled, got %v", added)
+	}
+
+	config.NodeSelectorEnabled = true
+	added := AddNodeSelectorToPod(config, pod, []string{"linux/arm64", "linux/amd64"})
+
+	wantAdded := map[string]string{"kubernetes.io/arch": "arm64", "zone": "a"}
+	if !maps.Equal(added, wantAdded) {
+		t.Errorf("added = %v, want %v", added, wantAdded)
+	}
+	want := map[string]string{"disk": "ssd", "kubernetes.io/arch": "arm64", "zone": "a"}
+	if !maps.Equal(pod.Spec.NodeSelector, want) {
+		t.Errorf("nodeSelector = %v, want %v", pod.Spec.NodeSelector, want)
+	}
+}
+
 func TestPodHasSkipAnnotation(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -414,3 +862,92 @@ func TestPodTemplateHasSkipAnnotation(t *testing.T) {
 		})
 	}
 }
+
+// missCache is a Cache that never holds an entry, so every check looks the
+// image up.
+type missCache struct{}
+
+func (missCache) Get(string) (bool, bool)         { return false, false }
+func (missCache) Set(string, bool, time.Duration) {}
+func (missCache) FlushAll() error                 { return nil }
+
+// newIndexRegistry serves testIndex for every manifest after delay and counts
+// the manifest requests per repository.
+func newIndexRegistry(tb testing.TB, delay time.Duration) (string, []config.Host, *sync.Map) {
+	tb.Helper()
+	indexDigest := digest.FromString(testIndex)
+	requests := &sync.Map{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		count, _ := requests.LoadOrStore(repo, &atomic.Int32{})
+		count.(*atomic.Int32).Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", indexDigest.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(testIndex))
+		}
+	}))
+	tb.Cleanup(server.Close)
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	return registry, []config.Host{*host}, requests
+}
+
+func TestGetPodTemplateSupportedPlatforms_LookupParallelism(t *testing.T) {
+	registry, hosts, requests := newIndexRegistry(t, 0)
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "app", Image: registry + "/app:v1"},
+			{Name: "sidecar", Image: registry + "/sidecar:v1"},
+			{Name: "app-copy", Image: registry + "/app:v1"},
+		},
+	}}
+
+	config := goldenConfig()
+	config.LookupParallelism = 4
+	got := GetPodTemplateSupportedPlatforms(context.Background(), missCache{}, config, template, hosts)
+	if want := []string{"linux/arm64", "linux/amd64"}; !slices.Equal(got, want) {
+		t.Errorf("supported = %v, want %v", got, want)
+	}
+
+	count := func(repo string) int32 {
+		n, ok := requests.Load(repo)
+		if !ok {
+			return 0
+		}
+		return n.(*atomic.Int32).Load()
+	}
+	if app, sidecar := count("app"), count("sidecar"); app == 0 || app != sidecar {
+		t.Errorf("manifest requests: app %d, sidecar %d; want the repeated image looked up once per platform",
+			app, sidecar)
+	}
+}
+
+func BenchmarkGetPodTemplateSupportedPlatforms(b *testing.B) {
+	registry, hosts, _ := newIndexRegistry(b, 2*time.Millisecond)
+	template := &corev1.PodTemplateSpec{}
+	for i := range 20 {
+		template.Spec.Containers = append(template.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("c%d", i),
+			Image: fmt.Sprintf("%s/image%d:v1", registry, i),
+		})
+	}
+
+	for _, parallelism := range []int{1, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			config := goldenConfig()
+			config.LookupParallelism = parallelism
+			for b.Loop() {
+				GetPodTemplateSupportedPlatforms(context.Background(), missCache{}, config, template, hosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// auditRotationCheckInterval is how often the audit log checks whether its
+// file was rotated away.
+const auditRotationCheckInterval = time.Second
+
+// auditLogger records every patched admission when AUDIT_LOG_PATH is set, and
+// is nil otherwise. It is set at startup by configureAuditLog.
+var auditLogger *auditLog
+
+// auditRecord is one line of the audit log, describing the change made to an
+// admitted object.
+type auditRecord struct {
+	Time         time.Time           `json:"time"`
+	UID          string              `json:"uid"`
+	Operation    string              `json:"operation"`
+	Kind         string              `json:"kind"`
+	Namespace    string              `json:"namespace"`
+	Name         string              `json:"name"`
+	Platforms    []string            `json:"platforms"`
+	Tolerations  []corev1.Toleration `json:"tolerations"`
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	// StrippedTolerations counts the tolerations removed under
+	// STRIP_UNSUPPORTED_TOLERATIONS.
+	StrippedTolerations int `json:"strippedTolerations,omitempty"`
+}
+
+// auditLog appends JSON Lines records to a file. Each record is flushed as it
+// is written, so none are lost when the pod is killed, and the buffer turns it
+// into a single append. When the file is renamed or removed, e.g. by
+// logrotate, a new one is opened at the same path.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	// file is nil after a failed reopen, which is retried on the next write.
+	file      *os.File
+	w         *bufio.Writer
+	lastCheck time.Time
+}
+
+// openAuditLog opens path for appending, creating it if needed.
+func openAuditLog(path string) (*auditLog, error) {
+	l := &auditLog{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.file = file
+	l.w = bufio.NewWriter(file)
+	l.lastCheck = time.Now()
+	return nil
+}
+
+// reopenIfRotated opens a new file when the one at path is no longer the one
+// being written, checking at most once per auditRotationCheckInterval.
+func (l *auditLog) reopenIfRotated() error {
+	if time.Since(l.lastCheck) < auditRotationCheckInterval {
+		return nil
+	}
+	l.lastCheck = time.Now()
+	current, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if onDisk, err := os.Stat(l.path); err == nil && os.SameFile(current, onDisk) {
+		return nil
+	}
+	slog.Info("audit log was rotated, reopening", "path", l.path)
+	if err := l.file.Close(); err != nil {
+		slog.Warn("failed to close rotated audit log", "path", l.path, "error", err)
+	}
+	l.file, l.w = nil, nil
+	return l.open()
+}
+
+// Write appends record as a single line.
+func (l *auditLog) Write(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	} else if err := l.reopenIfRotated(); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+// Close flushes and closes the file.
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// auditMutation records the change m made to the object of request, when the
+// audit log is enabled. A failed write is logged without affecting admission.
+func auditMutation(request *admissionv1.AdmissionRequest, m *specMutation) {
+	if auditLogger == nil {
+		return
+	}
+	record := auditRecord{
+		Time:                time.Now().UTC(),
+		UID:                 string(request.UID),
+		Operation:           string(request.Operation),
+		Kind:                request.Kind.Kind,
+		Namespace:           m.namespace,
+		Name:                m.name,
+		Platforms:           m.platforms,
+		Tolerations:         m.addedTolerations,
+		NodeSelector:        m.addedNodeSelector,
+		StrippedTolerations: len(m.strippedTolerations),
+	}
+	if err := auditLogger.Write(record); err != nil {
+		slog.Error("failed to write audit record",
+			"kind", record.Kind, "name", record.Name, "namespace", record.Namespace, "error", err)
+	}
+}
+
+// configureAuditLog opens the audit log at AUDIT_LOG_PATH, when set.
+func configureAuditLog() {
+	path := os.Getenv("AUDIT_LOG_PATH")
+	if path == "" {
+		return
+	}
+	l, err := openAuditLog(path)
+	if err != nil {
+		slog.Error("failed to configure audit log", "error", err)
+		os.Exit(1)
+	}
+	auditLogger = l
+	slog.Info("writing mutation audit log", "path", path)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readAuditRecords parses the JSON Lines audit log at path.
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditLog_WriteAndRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toleration := goldenConfig().Mappings[0].Toleration
+	for _, name := range []string{"web", "worker", "cron"} {
+		record := auditRecord{
+			Kind: "Pod", Namespace: "default", Name: name,
+			Platforms: []string{"linux/arm64"}, Tolerations: []corev1.Toleration{toleration},
+		}
+		if err := l.Write(record); err != nil {
+			t.Fatalf("Write(%s) error = %v", name, err)
+		}
+	}
+	records := readAuditRecords(t, path)
+	if len(records) != 3 || records[0].Name != "web" || records[2].Name != "cron" {
+		t.Fatalf("records = %+v, want web, worker, and cron in order", records)
+	}
+	if !slices.Equal(records[1].Tolerations, []corev1.Toleration{toleration}) {
+		t.Errorf("tolerations = %+v, want %+v", records[1].Tolerations, toleration)
+	}
+
+	// Rotate the file away as logrotate would; the next write opens a new one.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	l.lastCheck = time.Time{}
+	if err := l.Write(auditRecord{Kind: "Pod", Name: "after-rotation"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if records := readAuditRecords(t, path); len(records) != 1 || records[0].Name != "after-rotation" {
+		t.Errorf("records after rotation = %+v, want only after-rotation", records)
+	}
+	if records := readAuditRecords(t, path+".1"); len(records) != 3 {
+		t.Errorf("rotated file has %d records, want 3", len(records))
+	}
+}
+
+func TestAuditLog_ReopenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.jsonl")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Rotate the file away and take the directory with it, so the reopen fails.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	rotated := filepath.Join(filepath.Dir(dir), "audit.rotated")
+	if err := os.Rename(dir, rotated); err != nil {
+		t.Fatal(err)
+	}
+	l.lastCheck = time.Time{}
+	if err := l.Write(auditRecord{Kind: "Pod", Name: "lost"}); err == nil {
+		t.Fatal("expected an error while the audit log directory is missing")
+	}
+
+	// Once the directory is back, the next write opens the file again.
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(auditRecord{Kind: "Pod", Name: "recovered"}); err != nil {
+		t.Fatalf("Write() after the directory returned error = %v", err)
+	}
+	if records := readAuditRecords(t, path); len(records) != 1 || records[0].Name != "recovered" {
+		t.Errorf("records = %+v, want only recovered", records)
+	}
+}
+
+func TestProcessAdmissionReview_AuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLogger = l
+	t.Cleanup(func() {
+		auditLogger = nil
+		l.Close()
+	})
+
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(goldenImage, "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey(goldenImage, "linux/amd64"), false, 0)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: goldenImage}}},
+	}
+	body := admissionReviewBytes(t, metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}, mustMarshal(t, pod))
+	config := goldenConfig()
+	if _, err := ProcessAdmissionReview(context.Background(), cache, config, nil, body); err != nil {
+		t.Fatalf("ProcessAdmissionReview failed: %v", err)
+	}
+
+	records := readAuditRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("records = %+v, want one", records)
+	}
+	got := records[0]
+	if got.UID != "golden-uid" || got.Kind != "Pod" || got.Namespace != "team-a" || got.Name != "app" {
+		t.Errorf("record = %+v, want the golden-uid Pod team-a/app", got)
+	}
+	if got.Time.IsZero() {
+		t.Error("expected the record to be timestamped")
+	}
+	if !slices.Equal(got.Platforms, []string{"linux/arm64"}) ||
+		!slices.Equal(got.Tolerations, []corev1.Toleration{config.Mappings[0].Toleration}) {
+		t.Errorf("record platforms = %v, tolerations = %+v; want the arm64 toleration", got.Platforms, got.Tolerations)
+	}
+}
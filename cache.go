@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bluele/gcache"
@@ -10,38 +14,79 @@ import (
 )
 
 const (
-	cacheSizeDefault = 100000
-	redisAddrDefault = "localhost:6379"
+	cacheSizeDefault  = 100000
+	redisAddrDefault  = "localhost:6379"
+	cacheL1TTLDefault = time.Minute
+	// cachePolicyDefault is the in-memory eviction policy used when CACHE_POLICY is unset.
+	cachePolicyDefault = gcache.TYPE_ARC
+	// redisErrorLogInterval is the minimum time between logged Redis errors.
+	redisErrorLogInterval = time.Minute
+	// redisHealthTimeout bounds the PING made by each readiness check, well
+	// under the kubelet's default one-second probe timeout.
+	redisHealthTimeout = 500 * time.Millisecond
+	// redisFlushBatchSize is the number of keys scanned and deleted per round
+	// trip when flushing a prefixed Redis cache.
+	redisFlushBatchSize = 1000
 )
 
 type Cache interface {
 	Get(key string) (bool, bool)
 	Set(key string, value bool, ttl time.Duration)
+	// FlushAll removes every entry, e.g. after a detection fix makes cached
+	// results wrong.
+	FlushAll() error
 }
 
+// cachePolicies are the eviction policies accepted by CACHE_POLICY, named as in
+// gcache.
+var cachePolicies = []string{gcache.TYPE_ARC, gcache.TYPE_LRU, gcache.TYPE_LFU, gcache.TYPE_SIMPLE}
+
 type InMemoryCache struct {
-	cache gcache.Cache
+	cache  gcache.Cache
+	size   int
+	policy string
+	// maxAge, when positive, caps the TTL of every entry, including entries set
+	// without one. It is set from CACHE_MAX_AGE.
+	maxAge time.Duration
 }
 
 func NewInMemoryCache(cacheSize int) *InMemoryCache {
-	gc := gcache.New(cacheSize).ARC().Build()
-	return &InMemoryCache{gc}
+	return NewInMemoryCacheWithPolicy(cacheSize, cachePolicyDefault)
+}
+
+// NewInMemoryCacheWithPolicy builds an in-memory cache using the given eviction
+// policy, which must be one of cachePolicies.
+func NewInMemoryCacheWithPolicy(cacheSize int, policy string) *InMemoryCache {
+	gc := gcache.New(cacheSize).EvictType(policy).Build()
+	return &InMemoryCache{cache: gc, size: cacheSize, policy: policy}
 }
 
 func (c InMemoryCache) Get(key string) (bool, bool) {
-	val, err := c.cache.Get(key)
+	return cachedValue[bool](c.cache, key)
+}
+
+// cachedValue returns the value stored under key in gc as a T. A value of any
+// other type, such as one stored by a different kind of cache entry sharing
+// the key, is logged and treated as a miss.
+func cachedValue[T any](gc gcache.Cache, key string) (T, bool) {
+	var zero T
+	val, err := gc.Get(key)
 	if err != nil {
-		return false, false
+		return zero, false
 	}
-	boolVal, ok := val.(bool)
+	typed, ok := val.(T)
 	if !ok {
-		slog.Error("found non boolean cache value")
-		return false, false
+		slog.Error("unexpected cache value type, treating as a miss",
+			"key", key, "type", fmt.Sprintf("%T", val), "want", fmt.Sprintf("%T", zero))
+		return zero, false
 	}
-	return boolVal, true
+	return typed, true
 }
 
 func (c *InMemoryCache) Set(key string, value bool, ttl time.Duration) {
+	if c.maxAge > 0 && (ttl <= 0 || ttl > c.maxAge) {
+		ttl = c.maxAge
+	}
 	var err error
 	if ttl > 0 {
 		err = c.cache.SetWithExpire(key, value, ttl)
@@ -53,22 +98,46 @@ func (c *InMemoryCache) Set(key string, value bool, ttl time.Duration) {
 	}
 }
 
+func (c *InMemoryCache) FlushAll() error {
+	c.cache.Purge()
+	return nil
+}
+
+// healthChecker is implemented by caches backed by an external service whose
+// availability /readyz reports.
+type healthChecker interface {
+	CheckHealth() error
+}
+
+// RedisCache stores entries in Redis. While Redis is unreachable every Get is
+// a miss, so lookups fall through to the registry, and errors are logged at
+// most once per redisErrorLogInterval.
 type RedisCache struct {
 	client *redis.Client
+
+	mu         sync.Mutex
+	err        error
+	lastErrLog time.Time
+	suppressed int
 }
 
 func NewRedisCache(redisAddr string) *RedisCache {
 	return &RedisCache{
-		redis.NewClient(&redis.Options{
+		client: redis.NewClient(&redis.Options{
 			Addr: redisAddr,
 		}),
 	}
 }
 
-func (c RedisCache) Get(key string) (bool, bool) {
+func (c *RedisCache) Get(key string) (bool, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	val, err := c.client.Get(ctx, key).Bool()
+	if errors.Is(err, redis.Nil) {
+		c.recordResult(nil)
+		return false, false
+	}
+	c.recordResult(err)
 	if err != nil {
 		return false, false
 	}
@@ -78,8 +147,137 @@ func (c RedisCache) Get(key string) (bool, bool) {
 func (c *RedisCache) Set(key string, value bool, ttl time.Duration) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := c.client.Set(ctx, key, value, ttl).Err()
+	c.recordResult(c.client.Set(ctx, key, value, ttl).Err())
+}
+
+// FlushAll deletes the keys under cacheKeyPrefix, so a Redis instance shared
+// with other applications keeps their data. Without a prefix the cache is
+// assumed to own the database, which is flushed.
+func (c *RedisCache) FlushAll() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if cacheKeyPrefix == "" {
+		err := c.client.FlushDB(ctx).Err()
+		c.recordResult(err)
+		return err
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := c.client.Scan(ctx, cursor, redisGlobEscape(cacheKeyPrefix)+"*", redisFlushBatchSize).Result()
+		if err == nil && len(keys) > 0 {
+			err = c.client.Del(ctx, keys...).Err()
+		}
+		c.recordResult(err)
+		if err != nil {
+			return err
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// redisGlobEscape escapes the characters Redis MATCH patterns treat specially.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CheckHealth pings Redis. Readiness tracks Redis itself rather than the last
+// cache operation, since a replica marked not ready receives no admissions and
+// would never make another operation to notice Redis recovering.
+func (c *RedisCache) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisHealthTimeout)
+	defer cancel()
+	err := c.client.Ping(ctx).Err()
+	c.recordResult(err)
 	if err != nil {
-		slog.Error("failed to set key on RedisCache", "error", err)
+		return fmt.Errorf("redis cache unavailable: %w", err)
+	}
+	return nil
+}
+
+// recordResult tracks Redis availability from an operation's error, logging
+// failures at most once per redisErrorLogInterval.
+func (c *RedisCache) recordResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		if c.err != nil {
+			slog.Info("redis cache available again")
+		}
+		c.err = nil
+		c.suppressed = 0
+		return
+	}
+	c.err = err
+	if time.Since(c.lastErrLog) < redisErrorLogInterval {
+		c.suppressed++
+		return
+	}
+	slog.Error("redis cache operation failed", "error", err, "suppressed", c.suppressed)
+	c.lastErrLog = time.Now()
+	c.suppressed = 0
+}
+
+// TieredCache is a read-through cache with a replica-local L1 in front of a
+// shared L2, so repeated lookups on the same replica skip the L2 round trip.
+// Entries are held in L1 for at most l1TTL, which bounds how long a replica can
+// serve a value after another replica changes it in L2.
+type TieredCache struct {
+	l1    Cache
+	l2    Cache
+	l1TTL time.Duration
+}
+
+func NewTieredCache(l1, l2 Cache, l1TTL time.Duration) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2, l1TTL: l1TTL}
+}
+
+// CheckHealth reports the health of the L2 cache.
+func (c *TieredCache) CheckHealth() error {
+	if hc, ok := c.l2.(healthChecker); ok {
+		return hc.CheckHealth()
+	}
+	return nil
+}
+
+// FlushAll flushes L2 and then this replica's L1. Other replicas keep serving
+// their L1 entries for at most the L1 TTL.
+func (c *TieredCache) FlushAll() error {
+	if err := c.l2.FlushAll(); err != nil {
+		return err
+	}
+	return c.l1.FlushAll()
+}
+
+func (c *TieredCache) Get(key string) (bool, bool) {
+	if val, ok := c.l1.Get(key); ok {
+		return val, true
+	}
+	val, ok := c.l2.Get(key)
+	if !ok {
+		return false, false
+	}
+	c.l1.Set(key, val, c.l1TTL)
+	return val, true
+}
+
+// Set writes the entry to L2 with ttl and to L1 with the shorter of ttl and
+// the L1 TTL.
+func (c *TieredCache) Set(key string, value bool, ttl time.Duration) {
+	c.l2.Set(key, value, ttl)
+	l1TTL := c.l1TTL
+	if ttl > 0 && ttl < l1TTL {
+		l1TTL = ttl
 	}
+	c.l1.Set(key, value, l1TTL)
 }
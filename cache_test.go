@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/redis/go-redis/v9"
+)
+
+// recordingCache is a Cache that remembers the TTL each key was last set with.
+type recordingCache struct {
+	values map[string]bool
+	ttls   map[string]time.Duration
+	gets   int
+}
+
+func newRecordingCache() *recordingCache {
+	return &recordingCache{values: map[string]bool{}, ttls: map[string]time.Duration{}}
+}
+
+func (c *recordingCache) Get(key string) (bool, bool) {
+	c.gets++
+	val, ok := c.values[key]
+	return val, ok
+}
+
+func (c *recordingCache) Set(key string, value bool, ttl time.Duration) {
+	c.values[key] = value
+	c.ttls[key] = ttl
+}
+
+func (c *recordingCache) FlushAll() error {
+	clear(c.values)
+	clear(c.ttls)
+	return nil
+}
+
+func TestInMemoryCache_Policies(t *testing.T) {
+	for _, policy := range cachePolicies {
+		t.Run(policy, func(t *testing.T) {
+			c := NewInMemoryCacheWithPolicy(10, policy)
+			if _, ok := c.Get("k"); ok {
+				t.Fatal("expected a miss on an empty cache")
+			}
+			c.Set("k", true, time.Minute)
+			if val, ok := c.Get("k"); !ok || !val {
+				t.Errorf("Get() = %v, %v; want true, true", val, ok)
+			}
+		})
+	}
+}
+
+func TestInMemoryCache_NonBoolValue(t *testing.T) {
+	c := NewInMemoryCache(10)
+	platforms := []string{"linux/amd64", "linux/arm64"}
+	if err := c.cache.Set("platforms", platforms); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value of another type is a miss for the boolean Cache interface...
+	if val, ok := c.Get("platforms"); ok || val {
+		t.Errorf("Get() = %v, %v; want a miss for a non-bool value", val, ok)
+	}
+	// ...but can be read back through a typed accessor.
+	if got, ok := cachedValue[[]string](c.cache, "platforms"); !ok || !slices.Equal(got, platforms) {
+		t.Errorf("cachedValue[[]string]() = %v, %v; want %v", got, ok, platforms)
+	}
+	if _, ok := cachedValue[[]string](c.cache, "missing"); ok {
+		t.Error("expected a miss for an unset key")
+	}
+}
+
+func TestInMemoryCache_MaxAge(t *testing.T) {
+	clock := gcache.NewFakeClock()
+	c := &InMemoryCache{cache: gcache.New(10).Clock(clock).Build(), maxAge: time.Hour}
+
+	c.Set("long", true, 24*time.Hour)
+	c.Set("short", true, 30*time.Minute)
+	c.Set("forever", true, 0)
+
+	clock.Advance(45 * time.Minute)
+	if _, ok := c.Get("short"); ok {
+		t.Error("expected the entry set with a TTL below the max age to keep its TTL")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Error("expected the clamped entry to still be cached before the max age")
+	}
+
+	clock.Advance(30 * time.Minute)
+	if _, ok := c.Get("long"); ok {
+		t.Error("expected the 24h entry to expire at the 1h max age")
+	}
+	if _, ok := c.Get("forever"); ok {
+		t.Error("expected the entry set without a TTL to expire at the max age")
+	}
+}
+
+func TestTieredCache_Get(t *testing.T) {
+	l1, l2 := newRecordingCache(), newRecordingCache()
+	tiered := NewTieredCache(l1, l2, time.Minute)
+
+	if _, ok := tiered.Get("missing"); ok {
+		t.Error("expected a miss when neither tier has the key")
+	}
+
+	l2.Set("shared", true, time.Hour)
+	if val, ok := tiered.Get("shared"); !ok || !val {
+		t.Fatalf("Get(shared) = %v, %v; want true, true", val, ok)
+	}
+	if val, ok := l1.values["shared"]; !ok || !val {
+		t.Error("expected an L2 hit to be written through to L1")
+	}
+	if l1.ttls["shared"] != time.Minute {
+		t.Errorf("L1 TTL after write-through = %s, want 1m", l1.ttls["shared"])
+	}
+
+	l2Gets := l2.gets
+	if val, ok := tiered.Get("shared"); !ok || !val {
+		t.Fatalf("Get(shared) = %v, %v; want true, true", val, ok)
+	}
+	if l2.gets != l2Gets {
+		t.Error("expected an L1 hit not to read L2")
+	}
+}
+
+func TestTieredCache_Set(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttl    time.Duration
+		wantL1 time.Duration
+		wantL2 time.Duration
+	}{
+		{name: "long TTL is capped in L1", ttl: 24 * time.Hour, wantL1: time.Minute, wantL2: 24 * time.Hour},
+		{name: "short TTL is kept in L1", ttl: 10 * time.Second, wantL1: 10 * time.Second, wantL2: 10 * time.Second},
+		{name: "no expiry is capped in L1", ttl: 0, wantL1: time.Minute, wantL2: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l1, l2 := newRecordingCache(), newRecordingCache()
+			NewTieredCache(l1, l2, time.Minute).Set("key", false, tt.ttl)
+
+			if _, ok := l1.values["key"]; !ok {
+				t.Error("expected the entry in L1")
+			}
+			if _, ok := l2.values["key"]; !ok {
+				t.Error("expected the entry in L2")
+			}
+			if l1.ttls["key"] != tt.wantL1 || l2.ttls["key"] != tt.wantL2 {
+				t.Errorf("TTLs = L1 %s, L2 %s; want L1 %s, L2 %s", l1.ttls["key"], l2.ttls["key"], tt.wantL1, tt.wantL2)
+			}
+		})
+	}
+}
+
+func TestInMemoryCache_FlushAll(t *testing.T) {
+	c := NewInMemoryCache(10)
+	c.Set("a", true, 0)
+	c.Set("b", false, time.Minute)
+	if err := c.FlushAll(); err != nil {
+		t.Fatalf("FlushAll() error = %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("Get(%q) hit after FlushAll", key)
+		}
+	}
+}
+
+func TestTieredCache_FlushAll(t *testing.T) {
+	l1, l2 := newRecordingCache(), newRecordingCache()
+	c := NewTieredCache(l1, l2, time.Minute)
+	c.Set("key", true, 0)
+	if err := c.FlushAll(); err != nil {
+		t.Fatalf("FlushAll() error = %v", err)
+	}
+	if len(l1.values) != 0 || len(l2.values) != 0 {
+		t.Errorf("entries after FlushAll: L1 %v, L2 %v", l1.values, l2.values)
+	}
+}
+
+// fakeRedis is a go-redis hook answering SCAN, DEL, and FLUSHDB from an
+// in-memory key set instead of a server.
+type fakeRedis struct {
+	keys    map[string]bool
+	flushed bool
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (f *fakeRedis) ProcessHook(redis.ProcessHook) redis.ProcessHook {
+	return func(_ context.Context, cmd redis.Cmder) error {
+		args := cmd.Args()
+		switch cmd := cmd.(type) {
+		case *redis.ScanCmd:
+			// Args are SCAN cursor MATCH pattern COUNT n; the prefix is unescaped
+			// for a plain prefix comparison.
+			pattern := strings.TrimSuffix(args[3].(string), "*")
+			prefix := regexp.MustCompile(`\\(.)`).ReplaceAllString(pattern, "$1")
+			page := []string{}
+			for key := range f.keys {
+				if strings.HasPrefix(key, prefix) {
+					page = append(page, key)
+				}
+			}
+			cmd.SetVal(page, 0)
+		case *redis.IntCmd:
+			for _, key := range args[1:] {
+				delete(f.keys, key.(string))
+			}
+			cmd.SetVal(int64(len(args) - 1))
+		case *redis.StatusCmd:
+			f.flushed = true
+			cmd.SetVal("OK")
+		}
+		return nil
+	}
+}
+
+func TestRedisCache_FlushAll(t *testing.T) {
+	prev := cacheKeyPrefix
+	t.Cleanup(func() { cacheKeyPrefix = prev })
+
+	newFake := func() (*RedisCache, *fakeRedis) {
+		fake := &fakeRedis{keys: map[string]bool{
+			"team[a]:nginx:linux/arm64": true,
+			"team[a]:nginx:linux/amd64": true,
+			"teamb:nginx:linux/arm64":   true,
+			"session:42":                true,
+		}}
+		c := unreachableRedisCache()
+		c.client.AddHook(fake)
+		return c, fake
+	}
+
+	t.Run("prefix deletes only prefixed keys", func(t *testing.T) {
+		cacheKeyPrefix = "team[a]:"
+		c, fake := newFake()
+		// Stale-while-revalidate and auth failure markers go with their entries.
+		fake.keys[freshCacheKey("team[a]:nginx:linux/arm64")] = true
+		fake.keys[authFailedCacheKey("team[a]:nginx:linux/amd64")] = true
+		if err := c.FlushAll(); err != nil {
+			t.Fatalf("FlushAll() error = %v", err)
+		}
+		if fake.flushed || len(fake.keys) != 2 || !fake.keys["teamb:nginx:linux/arm64"] || !fake.keys["session:42"] {
+			t.Errorf("keys after FlushAll = %v (flushed %v), want only the other applications' keys",
+				fake.keys, fake.flushed)
+		}
+	})
+
+	t.Run("no prefix flushes the database", func(t *testing.T) {
+		cacheKeyPrefix = ""
+		c, fake := newFake()
+		if err := c.FlushAll(); err != nil {
+			t.Fatalf("FlushAll() error = %v", err)
+		}
+		if !fake.flushed {
+			t.Error("expected FLUSHDB without a key prefix")
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		cacheKeyPrefix = "team[a]:"
+		if err := unreachableRedisCache().FlushAll(); err == nil {
+			t.Error("expected an error while Redis is unreachable")
+		}
+	})
+}
+
+func TestRedisGlobEscape(t *testing.T) {
+	if got, want := redisGlobEscape(`a*b?c[d]e\f`), `a\*b\?c\[d\]e\\f`; got != want {
+		t.Errorf("redisGlobEscape() = %q, want %q", got, want)
+	}
+}
+
+// unreachableRedisCache returns a RedisCache whose server refuses connections.
+func unreachableRedisCache() *RedisCache {
+	return &RedisCache{client: redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialerRetries: 1})}
+}
+
+func TestRedisCache_Unavailable(t *testing.T) {
+	var logs bytes.Buffer
+	prevLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(prevLogger) })
+
+	c := unreachableRedisCache()
+	if _, ok := c.Get("key"); ok {
+		t.Error("expected a miss while Redis is unreachable")
+	}
+	for range 3 {
+		c.Set("key", true, time.Minute)
+	}
+
+	if err := c.CheckHealth(); err == nil {
+		t.Error("expected CheckHealth to report Redis as unavailable")
+	}
+	if n := strings.Count(logs.String(), "redis cache operation failed"); n != 1 {
+		t.Errorf("logged %d Redis errors, want 1; logs=%s", n, logs.String())
+	}
+}
+
+// flakyRedis is a go-redis hook that fails every command while down and
+// otherwise answers PING.
+type flakyRedis struct {
+	down atomic.Bool
+}
+
+func (f *flakyRedis) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (f *flakyRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (f *flakyRedis) ProcessHook(redis.ProcessHook) redis.ProcessHook {
+	return func(_ context.Context, cmd redis.Cmder) error {
+		if f.down.Load() {
+			err := errors.New("connection refused")
+			cmd.SetErr(err)
+			return err
+		}
+		if cmd, ok := cmd.(*redis.StatusCmd); ok {
+			cmd.SetVal("PONG")
+		}
+		return nil
+	}
+}
+
+func TestReadyzHandler_RedisRecovers(t *testing.T) {
+	platformConfig = nil
+	flaky := &flakyRedis{}
+	flaky.down.Store(true)
+	c := unreachableRedisCache()
+	c.client.AddHook(flaky)
+	cache = NewTieredCache(NewInMemoryCache(cacheSizeDefault), c, time.Minute)
+	t.Cleanup(func() { cache = NewInMemoryCache(cacheSizeDefault) })
+
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		newTestRouter(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+	c.Get("key")
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("status while Redis is down = %d, want 503", code)
+	}
+
+	// No cache operation runs in between, as on a replica receiving no
+	// admissions while not ready.
+	flaky.down.Store(false)
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("status after Redis recovered = %d, want 200", code)
+	}
+}
+
+func TestReadyzHandler_RedisUnavailable(t *testing.T) {
+	platformConfig = nil
+	c := unreachableRedisCache()
+	c.Get("key")
+	cache = NewTieredCache(NewInMemoryCache(cacheSizeDefault), c, time.Minute)
+	t.Cleanup(func() { cache = NewInMemoryCache(cacheSizeDefault) })
+
+	w := httptest.NewRecorder()
+	newTestRouter(t).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503; body=%s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	breakerThresholdDefault = 5
+	breakerWindowDefault    = time.Minute
+	breakerCooldownDefault  = 30 * time.Second
+)
+
+// Circuit breaker states, as exported by the
+// k8smultiarcher_registry_circuit_state metric.
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2
+)
+
+// errRegistryCircuitOpen is returned for lookups short-circuited because the
+// registry's circuit breaker is open.
+var errRegistryCircuitOpen = errors.New("registry circuit breaker is open")
+
+// registryBreaker guards manifest fetches per registry host. It is replaced at
+// startup from the REGISTRY_CIRCUIT_BREAKER_* environment variables.
+var registryBreaker = newCircuitBreaker(breakerThresholdDefault, breakerWindowDefault, breakerCooldownDefault)
+
+// circuitBreaker tracks consecutive failures per registry host. Once threshold
+// failures occur with no more than window between them, the host's circuit
+// opens and lookups fail immediately for cooldown. After the cooldown a single
+// trial lookup is let through: success closes the circuit, failure reopens it.
+// A threshold of 0 disables the breaker.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*breakerHost
+}
+
+type breakerHost struct {
+	state       int
+	failures    int
+	lastFailure time.Time
+	openedAt    time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+		hosts:     map[string]*breakerHost{},
+	}
+}
+
+// Allow reports whether a lookup against registry may proceed.
+func (b *circuitBreaker) Allow(registry string) bool {
+	if b.threshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[registry]
+	if !ok || h.state == breakerClosed {
+		return true
+	}
+	now := b.now()
+	if now.Sub(h.openedAt) < b.cooldown {
+		registryCircuitShortCircuits.WithLabelValues(registry).Inc()
+		return false
+	}
+	// Let one trial lookup through. Restarting the cooldown means a trial that
+	// never reports back is retried after another cooldown.
+	h.openedAt = now
+	b.setState(registry, h, breakerHalfOpen)
+	return true
+}
+
+// RecordSuccess closes the circuit for registry and resets its failure count.
+func (b *circuitBreaker) RecordSuccess(registry string) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[registry]
+	if !ok {
+		return
+	}
+	h.failures = 0
+	b.setState(registry, h, breakerClosed)
+}
+
+// RecordFailure counts a failed lookup against registry, opening the circuit
+// when the threshold is reached or a half-open trial fails.
+func (b *circuitBreaker) RecordFailure(registry string) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	h, ok := b.hosts[registry]
+	if !ok {
+		h = &breakerHost{}
+		b.hosts[registry] = h
+	}
+	if h.failures > 0 && now.Sub(h.lastFailure) > b.window {
+		h.failures = 0
+	}
+	h.failures++
+	h.lastFailure = now
+
+	if h.state == breakerHalfOpen || h.failures >= b.threshold {
+		h.openedAt = now
+		b.setState(registry, h, breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(registry string, h *breakerHost, state int) {
+	h.state = state
+	registryCircuitState.WithLabelValues(registry).Set(float64(state))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const registry = "registry.example.com"
+
+	now := time.Unix(0, 0)
+	newBreaker := func() *circuitBreaker {
+		b := newCircuitBreaker(3, time.Minute, 30*time.Second)
+		b.now = func() time.Time { return now }
+		return b
+	}
+
+	t.Run("opens after threshold consecutive failures", func(t *testing.T) {
+		b := newBreaker()
+		for range 2 {
+			b.RecordFailure(registry)
+		}
+		if !b.Allow(registry) {
+			t.Fatal("expected the circuit to stay closed below the threshold")
+		}
+		b.RecordFailure(registry)
+		if b.Allow(registry) {
+			t.Fatal("expected the circuit to open at the threshold")
+		}
+		if !b.Allow("other.example.com") {
+			t.Error("expected other registries to be unaffected")
+		}
+	})
+
+	t.Run("success resets the failure count", func(t *testing.T) {
+		b := newBreaker()
+		b.RecordFailure(registry)
+		b.RecordFailure(registry)
+		b.RecordSuccess(registry)
+		b.RecordFailure(registry)
+		if !b.Allow(registry) {
+			t.Error("expected the circuit to stay closed after a success reset")
+		}
+	})
+
+	t.Run("failures outside the window do not accumulate", func(t *testing.T) {
+		b := newBreaker()
+		start := now
+		t.Cleanup(func() { now = start })
+		b.RecordFailure(registry)
+		b.RecordFailure(registry)
+		now = now.Add(2 * time.Minute)
+		b.RecordFailure(registry)
+		if !b.Allow(registry) {
+			t.Error("expected stale failures to be forgotten")
+		}
+	})
+
+	t.Run("half-open trial closes or reopens the circuit", func(t *testing.T) {
+		b := newBreaker()
+		start := now
+		t.Cleanup(func() { now = start })
+		for range 3 {
+			b.RecordFailure(registry)
+		}
+
+		now = now.Add(31 * time.Second)
+		if !b.Allow(registry) {
+			t.Fatal("expected a trial lookup after the cooldown")
+		}
+		if b.Allow(registry) {
+			t.Fatal("expected only one trial lookup while half-open")
+		}
+		b.RecordFailure(registry)
+		if b.Allow(registry) {
+			t.Fatal("expected a failed trial to reopen the circuit")
+		}
+
+		now = now.Add(31 * time.Second)
+		if !b.Allow(registry) {
+			t.Fatal("expected another trial after the second cooldown")
+		}
+		b.RecordSuccess(registry)
+		if !b.Allow(registry) || !b.Allow(registry) {
+			t.Error("expected a successful trial to close the circuit")
+		}
+	})
+
+	t.Run("zero threshold disables the breaker", func(t *testing.T) {
+		b := newCircuitBreaker(0, time.Minute, time.Minute)
+		for range 10 {
+			b.RecordFailure(registry)
+		}
+		if !b.Allow(registry) {
+			t.Error("expected a disabled breaker to always allow lookups")
+		}
+	})
+}
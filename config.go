@@ -1,25 +1,181 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// PatchStrategyDiff emits a JSONPatch computed by diffing the whole object.
+	PatchStrategyDiff = "diff"
+	// PatchStrategyAppend emits targeted add operations for only the new tolerations.
+	PatchStrategyAppend = "append"
+)
+
+const (
+	// InitContainerPolicyInclude counts init containers in the platform
+	// intersection like any other container.
+	InitContainerPolicyInclude = "include"
+	// InitContainerPolicyExclude leaves init containers out of platform detection.
+	InitContainerPolicyExclude = "exclude"
+	// InitContainerPolicyWarnOnly leaves init containers out of the intersection
+	// but logs a warning for tolerated platforms they do not support.
+	InitContainerPolicyWarnOnly = "warn-only"
+)
+
+const (
+	// OnAuthErrorStrip treats an image whose registry rejected our credentials
+	// as supporting no platform, which strips every toleration.
+	OnAuthErrorStrip = "strip"
+	// OnAuthErrorSkipImage leaves such an image out of the platform
+	// intersection, so the remaining images decide.
+	OnAuthErrorSkipImage = "skip-image"
+	// OnAuthErrorAssumeSupported treats such an image as supporting every
+	// configured platform.
+	OnAuthErrorAssumeSupported = "assume-supported"
+)
+
+const (
+	// LocalImagePolicyInspect looks up images of containers with
+	// imagePullPolicy Never in their registry like any other image.
+	LocalImagePolicyInspect = "inspect"
+	// LocalImagePolicySkip leaves such containers out of the platform
+	// intersection, so the remaining images decide.
+	LocalImagePolicySkip = "skip"
+	// LocalImagePolicyAssumeSupported treats such containers as supporting every
+	// configured platform.
+	LocalImagePolicyAssumeSupported = "assume-supported"
+)
+
+const (
+	// DaemonSetPolicyAll tolerates a platform for a DaemonSet only when every
+	// container image supports it, like a pod.
+	DaemonSetPolicyAll = "all"
+	// DaemonSetPolicyAny tolerates a platform for a DaemonSet when any of its
+	// container images supports it.
+	DaemonSetPolicyAny = "any"
+)
+
+const (
+	// InvalidImagePolicyWarn adds an admission warning for each container image
+	// that is not a valid reference. Such images support no platform.
+	InvalidImagePolicyWarn = "warn"
+	// InvalidImagePolicyReject denies admission of objects with an invalid
+	// container image reference.
+	InvalidImagePolicyReject = "reject"
 )
 
 // PlatformTolerationConfig holds the configuration for platform-to-toleration mappings
 type PlatformTolerationConfig struct {
 	Mappings []PlatformTolerationMapping
+	// MaxLookupsPerAdmission caps the number of uncached images inspected for a
+	// single admission request. Zero means unlimited.
+	MaxLookupsPerAdmission int
+	// LookupParallelism is the number of distinct image and platform lookups
+	// run at once for a workload's containers. At most 1, images are inspected
+	// one at a time and the lookups for a platform stop at the first image
+	// lacking it.
+	LookupParallelism int
+	// PatchStrategy selects how the toleration patch is built: PatchStrategyDiff
+	// (the default) or PatchStrategyAppend.
+	PatchStrategy string
+	// PatchWarnBytes logs a warning for admission responses whose JSONPatch is
+	// larger than this many bytes. Zero disables the warning.
+	PatchWarnBytes int
+	// InitContainerPolicy controls how init containers affect the supported
+	// platforms: InitContainerPolicyInclude (the default),
+	// InitContainerPolicyExclude, or InitContainerPolicyWarnOnly.
+	InitContainerPolicy string
+	// OnAuthError controls how an image whose manifest lookup failed
+	// authentication affects the supported platforms: OnAuthErrorStrip (the
+	// default), OnAuthErrorSkipImage, or OnAuthErrorAssumeSupported.
+	OnAuthError string
+	// InvalidImagePolicy controls how a container image that is not a valid
+	// reference is reported: InvalidImagePolicyWarn (the default) or
+	// InvalidImagePolicyReject.
+	InvalidImagePolicy string
+	// LocalImagePolicy controls how containers with imagePullPolicy Never,
+	// whose images live on the node, affect the supported platforms:
+	// LocalImagePolicyInspect (the default), LocalImagePolicySkip, or
+	// LocalImagePolicyAssumeSupported.
+	LocalImagePolicy string
+	// DaemonSetPolicy controls which platforms are tolerated for DaemonSets:
+	// DaemonSetPolicyAll (the default) or DaemonSetPolicyAny.
+	DaemonSetPolicy string
+	// RequireExplicit makes CheckReady fail when the default mapping was used
+	// even though platform-toleration env vars were set.
+	RequireExplicit bool
+	// UnexpectedDefault is set when the loader fell back to the default mapping
+	// despite platform-toleration env vars being present.
+	UnexpectedDefault bool
+	// IgnoreContainerNames lists container names excluded from platform
+	// detection, such as injected single-arch sidecars.
+	IgnoreContainerNames map[string]bool
+	// DeniedImagePlatforms lists image globs and the platforms that must never
+	// be tolerated for matching images.
+	DeniedImagePlatforms []DeniedImagePlatforms
+	// StrictKinds makes admission requests for kinds other than Pod,
+	// DaemonSet, ReplicationController, and CronJob fail instead of being
+	// allowed unchanged.
+	StrictKinds bool
+	// NodeSelectorEnabled merges each supported platform's NodeSelector into
+	// the pod's nodeSelector alongside its toleration.
+	NodeSelectorEnabled bool
+	// EmitWarnings adds a warning to the admission response, shown by kubectl,
+	// for each configured platform left untolerated because of an image.
+	EmitWarnings bool
+	// SkipToleratedUpdates skips platform detection for pod UPDATE requests that
+	// keep the container images and already carry a configured toleration.
+	SkipToleratedUpdates bool
+	// StripUnsupportedTolerations removes tolerations matching a mapping's key
+	// and value when the images do not support the mapping's platform, such as
+	// one added by hand.
+	StripUnsupportedTolerations bool
+	// FullyPortableToleration, when set, is added alongside the per-platform
+	// tolerations when the images support every configured platform.
+	FullyPortableToleration *corev1.Toleration
+	// MatchExistingTaints drops tolerations that match no taint on any node in
+	// the cluster.
+	MatchExistingTaints bool
+	// DecisionOnly records the detected platforms in the
+	// AnnotationDetectedPlatforms annotation instead of adding tolerations,
+	// leaving enforcement to another component.
+	DecisionOnly bool
+	// RequiredPlatforms rejects pods with an image that does not support
+	// every one of these platforms.
+	RequiredPlatforms []string
+}
+
+// DeniedImagePlatforms excludes platforms for images matching a glob pattern.
+type DeniedImagePlatforms struct {
+	// Pattern is a path.Match glob compared against both the image as written
+	// and its normalized reference.
+	Pattern   string
+	Platforms []string
 }
 
 // PlatformTolerationMapping represents a single platform to toleration mapping
 type PlatformTolerationMapping struct {
 	Platform   string
 	Toleration corev1.Toleration
+	// NodeSelector holds optional node labels merged into the pod's
+	// nodeSelector when the platform is supported and NODE_SELECTOR_ENABLED is set.
+	NodeSelector map[string]string
 }
 
 // defaultPlatformTolerationMapping provides backward-compatible default
@@ -33,95 +189,308 @@ var defaultPlatformTolerationMapping = PlatformTolerationMapping{
 	},
 }
 
-// validateOperator validates and returns a toleration operator, defaulting to Equal if invalid
-func validateOperator(operator string) corev1.TolerationOperator {
+// parseOperator parses a toleration operator, defaulting to Equal when empty.
+func parseOperator(operator string) (corev1.TolerationOperator, error) {
 	if operator == "" {
-		return corev1.TolerationOpEqual
+		return corev1.TolerationOpEqual, nil
 	}
 	op := corev1.TolerationOperator(operator)
 	if op != corev1.TolerationOpEqual && op != corev1.TolerationOpExists {
-		slog.Error("invalid toleration operator, using default Equal", "operator", operator)
-		return corev1.TolerationOpEqual
+		return "", fmt.Errorf("invalid toleration operator %q: must be %q or %q",
+			operator, corev1.TolerationOpEqual, corev1.TolerationOpExists)
 	}
-	return op
+	return op, nil
 }
 
-// validateEffect validates and returns a taint effect, defaulting to NoSchedule if invalid
-func validateEffect(effect string) corev1.TaintEffect {
+// parseEffect parses a taint effect, defaulting to NoSchedule when empty.
+func parseEffect(effect string) (corev1.TaintEffect, error) {
 	if effect == "" {
-		return corev1.TaintEffectNoSchedule
+		return corev1.TaintEffectNoSchedule, nil
 	}
 	eff := corev1.TaintEffect(effect)
 	if eff != corev1.TaintEffectNoSchedule &&
 		eff != corev1.TaintEffectPreferNoSchedule &&
 		eff != corev1.TaintEffectNoExecute {
+		return "", fmt.Errorf("invalid toleration effect %q: must be %q, %q, or %q", effect,
+			corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute)
+	}
+	return eff, nil
+}
+
+// validateOperator validates and returns a toleration operator, defaulting to Equal if invalid
+func validateOperator(operator string) corev1.TolerationOperator {
+	op, err := parseOperator(operator)
+	if err != nil {
+		slog.Error("invalid toleration operator, using default Equal", "operator", operator)
+		configFallbacks.WithLabelValues(configFallbackInvalidField).Inc()
+		return corev1.TolerationOpEqual
+	}
+	return op
+}
+
+// validateEffect validates and returns a taint effect, defaulting to NoSchedule if invalid
+func validateEffect(effect string) corev1.TaintEffect {
+	eff, err := parseEffect(effect)
+	if err != nil {
 		slog.Error("invalid toleration effect, using default NoSchedule", "effect", effect)
+		configFallbacks.WithLabelValues(configFallbackInvalidField).Inc()
 		return corev1.TaintEffectNoSchedule
 	}
 	return eff
 }
 
+// tolerationOperatorAndEffect returns the operator and effect of a configured
+// toleration. Under STRICT_TOLERATION_VALIDATION an invalid value is an error;
+// otherwise it is logged and defaulted by validateOperator and validateEffect.
+func tolerationOperatorAndEffect(
+	operator, effect string,
+	strict bool,
+) (corev1.TolerationOperator, corev1.TaintEffect, error) {
+	if !strict {
+		return validateOperator(operator), validateEffect(effect), nil
+	}
+	op, err := parseOperator(operator)
+	if err != nil {
+		return "", "", err
+	}
+	eff, err := parseEffect(effect)
+	if err != nil {
+		return "", "", err
+	}
+	return op, eff, nil
+}
+
 // LoadPlatformTolerationConfig loads the configuration from environment
 // variables. A malformed PLATFORM_TOLERATIONS value is rejected with an error so
 // a typo fails fast at startup instead of silently falling back to other config.
 func LoadPlatformTolerationConfig() (*PlatformTolerationConfig, error) {
+	// strictValidation skips a mapping with an invalid operator or effect
+	// instead of defaulting the field.
+	strictValidation := os.Getenv("STRICT_TOLERATION_VALIDATION") == "true"
 	config := &PlatformTolerationConfig{
-		Mappings: []PlatformTolerationMapping{},
+		Mappings:                    []PlatformTolerationMapping{},
+		PatchStrategy:               PatchStrategyDiff,
+		InitContainerPolicy:         InitContainerPolicyInclude,
+		OnAuthError:                 OnAuthErrorStrip,
+		InvalidImagePolicy:          InvalidImagePolicyWarn,
+		LocalImagePolicy:            LocalImagePolicyInspect,
+		DaemonSetPolicy:             DaemonSetPolicyAll,
+		RequireExplicit:             os.Getenv("REQUIRE_EXPLICIT_CONFIG") == "true",
+		StrictKinds:                 os.Getenv("STRICT_KINDS") == "true",
+		NodeSelectorEnabled:         os.Getenv("NODE_SELECTOR_ENABLED") == "true",
+		EmitWarnings:                os.Getenv("EMIT_WARNINGS") == "true",
+		SkipToleratedUpdates:        os.Getenv("SKIP_TOLERATED_UPDATES") == "true",
+		StripUnsupportedTolerations: os.Getenv("STRIP_UNSUPPORTED_TOLERATIONS") == "true",
+		MatchExistingTaints:         os.Getenv("MATCH_EXISTING_TAINTS") == "true",
+		DecisionOnly:                os.Getenv("DECISION_ONLY") == "true",
+		RequiredPlatforms:           parsePlatformList(os.Getenv("REQUIRE_PLATFORMS")),
+		IgnoreContainerNames:        make(map[string]bool),
+	}
+
+	if ignoreStr := os.Getenv("IGNORE_CONTAINER_NAMES"); ignoreStr != "" {
+		for _, name := range strings.Split(ignoreStr, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				config.IgnoreContainerNames[name] = true
+			}
+		}
+		slog.Info("loaded container names to ignore", "count", len(config.IgnoreContainerNames), "names", ignoreStr)
+	}
+
+	if strategy := os.Getenv("PATCH_STRATEGY"); strategy != "" {
+		if strategy != PatchStrategyDiff && strategy != PatchStrategyAppend {
+			return nil, fmt.Errorf(
+				"invalid PATCH_STRATEGY %q: must be %q or %q",
+				strategy,
+				PatchStrategyDiff,
+				PatchStrategyAppend,
+			)
+		}
+		config.PatchStrategy = strategy
+		slog.Info("loaded patch strategy", "strategy", strategy)
+	}
+
+	if maxStr := os.Getenv("MAX_LOOKUPS_PER_ADMISSION"); maxStr != "" {
+		maxLookups, err := strconv.Atoi(maxStr)
+		if err != nil || maxLookups < 0 {
+			return nil, fmt.Errorf("invalid MAX_LOOKUPS_PER_ADMISSION %q: must be a non-negative integer", maxStr)
+		}
+		config.MaxLookupsPerAdmission = maxLookups
+		slog.Info("loaded max lookups per admission", "max", maxLookups)
+	}
+
+	if parallelStr := os.Getenv("IMAGE_LOOKUP_PARALLELISM"); parallelStr != "" {
+		parallelism, err := strconv.Atoi(parallelStr)
+		if err != nil || parallelism < 1 {
+			return nil, fmt.Errorf("invalid IMAGE_LOOKUP_PARALLELISM %q: must be a positive integer", parallelStr)
+		}
+		config.LookupParallelism = parallelism
+		slog.Info("loaded image lookup parallelism", "parallelism", parallelism)
+	}
+
+	if warnStr := os.Getenv("PATCH_WARN_BYTES"); warnStr != "" {
+		warnBytes, err := strconv.Atoi(warnStr)
+		if err != nil || warnBytes < 0 {
+			return nil, fmt.Errorf("invalid PATCH_WARN_BYTES %q: must be a non-negative integer", warnStr)
+		}
+		config.PatchWarnBytes = warnBytes
+		slog.Info("loaded patch size warning threshold", "bytes", warnBytes)
+	}
+
+	if policy := os.Getenv("INIT_CONTAINER_POLICY"); policy != "" {
+		switch policy {
+		case InitContainerPolicyInclude, InitContainerPolicyExclude, InitContainerPolicyWarnOnly:
+		default:
+			return nil, fmt.Errorf(
+				"invalid INIT_CONTAINER_POLICY %q: must be %q, %q, or %q",
+				policy,
+				InitContainerPolicyInclude,
+				InitContainerPolicyExclude,
+				InitContainerPolicyWarnOnly,
+			)
+		}
+		config.InitContainerPolicy = policy
+		slog.Info("loaded init container policy", "policy", policy)
+	}
+
+	if policy := os.Getenv("ON_AUTH_ERROR"); policy != "" {
+		switch policy {
+		case OnAuthErrorStrip, OnAuthErrorSkipImage, OnAuthErrorAssumeSupported:
+		default:
+			return nil, fmt.Errorf(
+				"invalid ON_AUTH_ERROR %q: must be %q, %q, or %q",
+				policy,
+				OnAuthErrorStrip,
+				OnAuthErrorSkipImage,
+				OnAuthErrorAssumeSupported,
+			)
+		}
+		config.OnAuthError = policy
+		slog.Info("loaded auth error policy", "policy", policy)
+	}
+
+	if portableStr := os.Getenv("FULLY_PORTABLE_TOLERATION"); portableStr != "" {
+		toleration, err := parseFullyPortableToleration(portableStr, strictValidation)
+		if err != nil {
+			return nil, err
+		}
+		config.FullyPortableToleration = toleration
+		slog.Info("loaded fully portable toleration", "key", toleration.Key, "value", toleration.Value)
+	}
+
+	if policy := os.Getenv("LOCAL_IMAGE_POLICY"); policy != "" {
+		switch policy {
+		case LocalImagePolicyInspect, LocalImagePolicySkip, LocalImagePolicyAssumeSupported:
+		default:
+			return nil, fmt.Errorf(
+				"invalid LOCAL_IMAGE_POLICY %q: must be %q, %q, or %q",
+				policy,
+				LocalImagePolicyInspect,
+				LocalImagePolicySkip,
+				LocalImagePolicyAssumeSupported,
+			)
+		}
+		config.LocalImagePolicy = policy
+		slog.Info("loaded local image policy", "policy", policy)
+	}
+
+	if policy := os.Getenv("DAEMONSET_POLICY"); policy != "" {
+		if policy != DaemonSetPolicyAll && policy != DaemonSetPolicyAny {
+			return nil, fmt.Errorf(
+				"invalid DAEMONSET_POLICY %q: must be %q or %q",
+				policy,
+				DaemonSetPolicyAll,
+				DaemonSetPolicyAny,
+			)
+		}
+		config.DaemonSetPolicy = policy
+		slog.Info("loaded daemonset policy", "policy", policy)
+	}
+
+	if policy := os.Getenv("INVALID_IMAGE_POLICY"); policy != "" {
+		if policy != InvalidImagePolicyWarn && policy != InvalidImagePolicyReject {
+			return nil, fmt.Errorf(
+				"invalid INVALID_IMAGE_POLICY %q: must be %q or %q",
+				policy,
+				InvalidImagePolicyWarn,
+				InvalidImagePolicyReject,
+			)
+		}
+		config.InvalidImagePolicy = policy
+		slog.Info("loaded invalid image policy", "policy", policy)
+	}
+
+	if denyStr := os.Getenv("DENY_PLATFORM_IMAGES"); denyStr != "" {
+		denied, err := parseDenyPlatformImages(denyStr)
+		if err != nil {
+			return nil, err
+		}
+		config.DeniedImagePlatforms = denied
+		slog.Info("loaded denied image platforms", "count", len(denied))
+	}
+
+	noExecuteSeconds, err := defaultNoExecuteSecondsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	platformEffects, err := parsePlatformEffects(os.Getenv("TOLERATION_EFFECTS"))
+	if err != nil {
+		return nil, err
 	}
 
 	// Check for JSON configuration first
 	if jsonConfig := os.Getenv("PLATFORM_TOLERATIONS"); jsonConfig != "" {
-		var mappings []struct {
-			Platform string `json:"platform"`
-			Key      string `json:"key"`
-			Value    string `json:"value"`
-			Operator string `json:"operator"`
-			Effect   string `json:"effect"`
-		}
-		if err := json.Unmarshal([]byte(jsonConfig), &mappings); err != nil {
-			return nil, fmt.Errorf("invalid PLATFORM_TOLERATIONS JSON: %w", err)
-		}
-		for _, m := range mappings {
-			config.Mappings = append(config.Mappings, PlatformTolerationMapping{
-				Platform: m.Platform,
-				Toleration: corev1.Toleration{
-					Key:      m.Key,
-					Value:    m.Value,
-					Operator: validateOperator(m.Operator),
-					Effect:   validateEffect(m.Effect),
-				},
-			})
+		mappings, err := parsePlatformTolerationsJSON(jsonConfig, strictValidation)
+		if err != nil {
+			return nil, err
 		}
+		config.Mappings = append(config.Mappings, mappings...)
 		// If JSON provided mappings, skip simple configuration to avoid mixing
 		// configuration methods.
 		if len(config.Mappings) > 0 {
 			slog.Info("loaded platform-toleration mappings from JSON", "count", len(config.Mappings))
+			if len(platformEffects) > 0 {
+				slog.Warn("TOLERATION_EFFECTS is ignored with PLATFORM_TOLERATIONS; set each entry's effect instead")
+			}
 			goto applyDefaults
 		}
 	}
 
 	// Check for simple single toleration configuration (backward compatible)
-	if key := os.Getenv("TOLERATION_KEY"); key != "" {
-		value := os.Getenv("TOLERATION_VALUE")
-		operator := validateOperator(os.Getenv("TOLERATION_OPERATOR"))
-		effect := validateEffect(os.Getenv("TOLERATION_EFFECT"))
-		platform := "linux/arm64"
-		if p := os.Getenv("TOLERATION_PLATFORM"); p != "" {
-			platform = p
-		}
-		config.Mappings = append(config.Mappings, PlatformTolerationMapping{
-			Platform: platform,
-			Toleration: corev1.Toleration{
-				Key:      key,
-				Value:    value,
-				Operator: operator,
-				Effect:   effect,
-			},
-		})
+	if m, ok, err := simpleTolerationMapping("", platformEffects, strictValidation); err != nil {
+		slog.Error("skipping invalid platform-toleration mapping from simple env vars", "error", err)
+		configFallbacks.WithLabelValues(configFallbackInvalidEntry).Inc()
+	} else if ok {
+		config.Mappings = append(config.Mappings, m)
 		slog.Info("loaded platform-toleration mapping from simple env vars")
 	}
 
+	// Check for indexed simple configuration (TOLERATION_KEY_1, TOLERATION_KEY_2, ...)
+	for i := 1; ; i++ {
+		m, ok, err := simpleTolerationMapping("_"+strconv.Itoa(i), platformEffects, strictValidation)
+		if !ok {
+			warnIgnoredIndexedTolerations(i - 1)
+			break
+		}
+		if err != nil {
+			slog.Error("skipping invalid platform-toleration mapping from indexed env vars", "index", i, "error", err)
+			configFallbacks.WithLabelValues(configFallbackInvalidEntry).Inc()
+			continue
+		}
+		config.Mappings = append(config.Mappings, m)
+		slog.Info("loaded platform-toleration mapping from indexed env vars", "index", i)
+	}
+
 applyDefaults:
+	applyNoExecuteDefault(config.Mappings, noExecuteSeconds)
+
+	if len(config.Mappings) == 0 && os.Getenv("DISABLE_DEFAULT_MAPPING") == "true" {
+		slog.Warn("no platform-toleration mappings configured and the default mapping is disabled; " +
+			"no tolerations will be added")
+		return config, nil
+	}
+
 	// Use default if no configuration provided
 	if len(config.Mappings) == 0 {
 		config.Mappings = append(config.Mappings, defaultPlatformTolerationMapping)
@@ -132,6 +501,15 @@ applyDefaults:
 			"key",
 			defaultPlatformTolerationMapping.Toleration.Key,
 		)
+		if platformTolerationEnvPresent() {
+			config.UnexpectedDefault = true
+			configFallbacks.WithLabelValues(configFallbackDefaultMapping).Inc()
+			slog.Error(
+				"platform-toleration env vars are set but no mapping was loaded from them; using the default mapping",
+				"requireExplicitConfig",
+				config.RequireExplicit,
+			)
+		}
 	} else {
 		for _, m := range config.Mappings {
 			slog.Info(
@@ -149,6 +527,330 @@ applyDefaults:
 	return config, nil
 }
 
+// parseDenyPlatformImages parses DENY_PLATFORM_IMAGES, a JSON object mapping
+// image glob patterns to the platforms to exclude for matching images. Entries
+// are returned sorted by pattern.
+func parseDenyPlatformImages(value string) ([]DeniedImagePlatforms, error) {
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid DENY_PLATFORM_IMAGES JSON: %w", err)
+	}
+	denied := []DeniedImagePlatforms{}
+	for _, pattern := range slices.Sorted(maps.Keys(raw)) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid DENY_PLATFORM_IMAGES pattern %q: %w", pattern, err)
+		}
+		denied = append(denied, DeniedImagePlatforms{Pattern: pattern, Platforms: raw[pattern]})
+	}
+	return denied, nil
+}
+
+// DeniedPlatforms returns the platforms denied for image by DeniedImagePlatforms.
+func (c *PlatformTolerationConfig) DeniedPlatforms(image string) []string {
+	if len(c.DeniedImagePlatforms) == 0 {
+		return nil
+	}
+	names := []string{image}
+	if r, err := parseImageRef(image); err == nil {
+		names = append(names, r.CommonName())
+	}
+	platforms := []string{}
+	for _, d := range c.DeniedImagePlatforms {
+		if slices.ContainsFunc(names, func(name string) bool {
+			matched, _ := path.Match(d.Pattern, name)
+			return matched
+		}) {
+			platforms = append(platforms, d.Platforms...)
+		}
+	}
+	return platforms
+}
+
+// defaultNoExecuteSecondsFromEnv parses DEFAULT_NOEXECUTE_SECONDS, the
+// tolerationSeconds applied to NoExecute mappings that do not set their own. It
+// returns nil when unset.
+func defaultNoExecuteSecondsFromEnv() (*int64, error) {
+	value := os.Getenv("DEFAULT_NOEXECUTE_SECONDS")
+	if value == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, fmt.Errorf("invalid DEFAULT_NOEXECUTE_SECONDS %q: must be a non-negative integer", value)
+	}
+	slog.Info("loaded default NoExecute toleration seconds", "seconds", seconds)
+	return &seconds, nil
+}
+
+// applyNoExecuteDefault sets tolerationSeconds to seconds on every NoExecute
+// mapping without an explicit value. A nil seconds leaves mappings unchanged,
+// so those tolerations tolerate the taint forever.
+func applyNoExecuteDefault(mappings []PlatformTolerationMapping, seconds *int64) {
+	if seconds == nil {
+		return
+	}
+	for i := range mappings {
+		t := &mappings[i].Toleration
+		if t.Effect == corev1.TaintEffectNoExecute && t.TolerationSeconds == nil {
+			t.TolerationSeconds = ptr.To(*seconds)
+		}
+	}
+}
+
+// validateTolerationSeconds returns seconds when it is allowed for effect.
+// Kubernetes only honors tolerationSeconds on NoExecute tolerations, so a value
+// given with any other effect is logged and dropped.
+func validateTolerationSeconds(effect corev1.TaintEffect, seconds *int64) *int64 {
+	if seconds == nil || effect == corev1.TaintEffectNoExecute {
+		return seconds
+	}
+	slog.Error("tolerationSeconds only applies to the NoExecute effect, ignoring", "effect", effect, "seconds", *seconds)
+	configFallbacks.WithLabelValues(configFallbackInvalidField).Inc()
+	return nil
+}
+
+// platformTolerationEnvPresent reports whether any env var that configures
+// platform-toleration mappings is set.
+func platformTolerationEnvPresent() bool {
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if value == "" {
+			continue
+		}
+		if name == "PLATFORM_TOLERATIONS" || strings.HasPrefix(name, "TOLERATION_") {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckReady returns an error when REQUIRE_EXPLICIT_CONFIG is enabled and the
+// loader fell back to the default mapping despite configuration being present.
+func (c *PlatformTolerationConfig) CheckReady() error {
+	if c.RequireExplicit && c.UnexpectedDefault {
+		return errors.New("platform-toleration config env vars are set but the default mapping is in use")
+	}
+	return nil
+}
+
+// parsePlatformEffects parses TOLERATION_EFFECTS, a comma-separated list of
+// platform=effect pairs (e.g. "linux/arm64=NoSchedule,linux/amd64=PreferNoSchedule")
+// giving the default effect of simple mappings for each platform. It returns
+// nil when unset.
+func parsePlatformEffects(value string) (map[string]corev1.TaintEffect, error) {
+	if value == "" {
+		return nil, nil
+	}
+	effects := map[string]corev1.TaintEffect{}
+	for _, pair := range strings.Split(value, ",") {
+		platform, effect, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		platform, effect = strings.TrimSpace(platform), strings.TrimSpace(effect)
+		if !ok || platform == "" {
+			return nil, fmt.Errorf("invalid TOLERATION_EFFECTS entry %q: must be platform=effect", pair)
+		}
+		switch eff := corev1.TaintEffect(effect); eff {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			effects[platform] = eff
+		default:
+			return nil, fmt.Errorf("invalid TOLERATION_EFFECTS effect %q for %s: must be %q, %q, or %q", effect,
+				platform, corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute)
+		}
+	}
+	slog.Info("loaded per-platform toleration effects", "effects", effects)
+	return effects, nil
+}
+
+// indexedTolerationEnvPattern matches the indexed simple configuration
+// variables, e.g. TOLERATION_KEY_2, capturing the index.
+var indexedTolerationEnvPattern = regexp.MustCompile(
+	`^TOLERATION_(?:KEY|VALUE|OPERATOR|EFFECT|PLATFORM|SECONDS)_(\d+)$`,
+)
+
+// warnIgnoredIndexedTolerations logs a warning, and counts a config fallback,
+// when indexed simple configuration variables are set beyond last, the last
+// index loaded, or at index 0, since parsing stops at the first missing
+// TOLERATION_KEY_<n> and starts at 1.
+func warnIgnoredIndexedTolerations(last int) {
+	var ignored []string
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		match := indexedTolerationEnvPattern.FindStringSubmatch(name)
+		if value == "" || match == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(match[1]); err != nil || n == 0 || n > last {
+			ignored = append(ignored, name)
+		}
+	}
+	if len(ignored) == 0 {
+		return
+	}
+	slices.Sort(ignored)
+	slog.Warn("ignoring indexed toleration variables after a gap in the TOLERATION_KEY_<n> sequence",
+		"lastIndex", last, "ignored", ignored)
+	configFallbacks.WithLabelValues(configFallbackIgnoredIndex).Inc()
+}
+
+// simpleTolerationMapping builds a mapping from the TOLERATION_* env vars with
+// the given suffix appended to each name (e.g. "" or "_1"). Without
+// TOLERATION_EFFECT<suffix>, the effect is taken from platformEffects for the
+// mapping's platform. It returns false when TOLERATION_KEY<suffix> is unset,
+// and an error for an invalid operator or effect when strict is set.
+func simpleTolerationMapping(
+	suffix string,
+	platformEffects map[string]corev1.TaintEffect,
+	strict bool,
+) (PlatformTolerationMapping, bool, error) {
+	key := os.Getenv("TOLERATION_KEY" + suffix)
+	if key == "" {
+		return PlatformTolerationMapping{}, false, nil
+	}
+	platform := "linux/arm64"
+	if p := os.Getenv("TOLERATION_PLATFORM" + suffix); p != "" {
+		platform = p
+	}
+	var seconds *int64
+	if secondsStr := os.Getenv("TOLERATION_SECONDS" + suffix); secondsStr != "" {
+		n, err := strconv.ParseInt(secondsStr, 10, 64)
+		if err != nil {
+			slog.Error("invalid toleration seconds, ignoring", "name", "TOLERATION_SECONDS"+suffix, "value", secondsStr)
+			configFallbacks.WithLabelValues(configFallbackInvalidField).Inc()
+		} else {
+			seconds = &n
+		}
+	}
+	effectName := os.Getenv("TOLERATION_EFFECT" + suffix)
+	operator, effect, err := tolerationOperatorAndEffect(os.Getenv("TOLERATION_OPERATOR"+suffix), effectName, strict)
+	if err != nil {
+		return PlatformTolerationMapping{}, true, err
+	}
+	if eff, ok := platformEffects[platform]; ok && effectName == "" {
+		effect = eff
+	}
+	return PlatformTolerationMapping{
+		Platform: platform,
+		Toleration: corev1.Toleration{
+			Key:               key,
+			Value:             os.Getenv("TOLERATION_VALUE" + suffix),
+			Operator:          operator,
+			Effect:            effect,
+			TolerationSeconds: validateTolerationSeconds(effect, seconds),
+		},
+	}, true, nil
+}
+
+// platformTolerationEntry is a single PLATFORM_TOLERATIONS JSON array entry.
+type platformTolerationEntry struct {
+	Platform string `json:"platform"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Operator string `json:"operator"`
+	Effect   string `json:"effect"`
+	// TolerationSeconds is only valid with the NoExecute effect.
+	TolerationSeconds *int64 `json:"tolerationSeconds"`
+	// NodeSelector is merged into the pod's nodeSelector when NODE_SELECTOR_ENABLED is set.
+	NodeSelector map[string]string `json:"nodeSelector"`
+}
+
+// tolerationEntry is the JSON form of FULLY_PORTABLE_TOLERATION.
+type tolerationEntry struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Operator string `json:"operator"`
+	Effect   string `json:"effect"`
+	// TolerationSeconds is only valid with the NoExecute effect.
+	TolerationSeconds *int64 `json:"tolerationSeconds"`
+}
+
+// parseFullyPortableToleration parses FULLY_PORTABLE_TOLERATION, a JSON object
+// with the same toleration fields as a PLATFORM_TOLERATIONS entry. With strict,
+// an invalid operator or effect is an error.
+func parseFullyPortableToleration(value string, strict bool) (*corev1.Toleration, error) {
+	var entry tolerationEntry
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entry); err != nil {
+		return nil, fmt.Errorf("invalid FULLY_PORTABLE_TOLERATION JSON: %w", err)
+	}
+	if entry.Key == "" {
+		return nil, errors.New(`invalid FULLY_PORTABLE_TOLERATION: missing required field "key"`)
+	}
+	operator, effect, err := tolerationOperatorAndEffect(entry.Operator, entry.Effect, strict)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FULLY_PORTABLE_TOLERATION: %w", err)
+	}
+	return &corev1.Toleration{
+		Key:               entry.Key,
+		Value:             entry.Value,
+		Operator:          operator,
+		Effect:            effect,
+		TolerationSeconds: validateTolerationSeconds(effect, entry.TolerationSeconds),
+	}, nil
+}
+
+// parsePlatformTolerationsJSON parses the PLATFORM_TOLERATIONS JSON array.
+// Entries are decoded individually with unknown fields disallowed; an invalid
+// entry, including one with an invalid operator or effect when strict is set,
+// is logged with its index and skipped. A syntax error in the array, or an
+// array in which no entry is valid, is returned as an error.
+func parsePlatformTolerationsJSON(jsonConfig string, strict bool) ([]PlatformTolerationMapping, error) {
+	var rawEntries []json.RawMessage
+	if err := json.Unmarshal([]byte(jsonConfig), &rawEntries); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, fmt.Errorf("invalid PLATFORM_TOLERATIONS JSON at offset %d: %w", syntaxErr.Offset, err)
+		}
+		return nil, fmt.Errorf("invalid PLATFORM_TOLERATIONS JSON: %w", err)
+	}
+
+	mappings := []PlatformTolerationMapping{}
+	for i, raw := range rawEntries {
+		m, err := parsePlatformTolerationEntry(raw, strict)
+		if err != nil {
+			slog.Error("skipping invalid PLATFORM_TOLERATIONS entry", "index", i, "error", err)
+			configFallbacks.WithLabelValues(configFallbackInvalidEntry).Inc()
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+
+	if len(rawEntries) > 0 && len(mappings) == 0 {
+		return nil, errors.New("invalid PLATFORM_TOLERATIONS: no valid entries")
+	}
+	return mappings, nil
+}
+
+// parsePlatformTolerationEntry decodes and validates a single PLATFORM_TOLERATIONS entry.
+func parsePlatformTolerationEntry(raw json.RawMessage, strict bool) (PlatformTolerationMapping, error) {
+	var entry platformTolerationEntry
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entry); err != nil {
+		return PlatformTolerationMapping{}, err
+	}
+	if entry.Platform == "" {
+		return PlatformTolerationMapping{}, errors.New(`missing required field "platform"`)
+	}
+	if entry.Key == "" {
+		return PlatformTolerationMapping{}, errors.New(`missing required field "key"`)
+	}
+	operator, effect, err := tolerationOperatorAndEffect(entry.Operator, entry.Effect, strict)
+	if err != nil {
+		return PlatformTolerationMapping{}, err
+	}
+	return PlatformTolerationMapping{
+		Platform: entry.Platform,
+		Toleration: corev1.Toleration{
+			Key:               entry.Key,
+			Value:             entry.Value,
+			Operator:          operator,
+			Effect:            effect,
+			TolerationSeconds: validateTolerationSeconds(effect, entry.TolerationSeconds),
+		},
+		NodeSelector: entry.NodeSelector,
+	}, nil
+}
+
 // GetPlatforms returns all configured platforms
 func (c *PlatformTolerationConfig) GetPlatforms() []string {
 	platforms := make([]string, len(c.Mappings))
@@ -158,8 +860,28 @@ func (c *PlatformTolerationConfig) GetPlatforms() []string {
 	return platforms
 }
 
-// GetTolerationsForPlatforms returns all tolerations for platforms that are supported
-func (c *PlatformTolerationConfig) GetTolerationsForPlatforms(supportedPlatforms []string) []corev1.Toleration {
+// RestrictToPlatforms returns a copy of the config containing only the mappings
+// whose platform matches one in allowed, as compared by platformsMatch, so
+// "linux/arm64/v8" allows a "linux/arm64" mapping. The receiver is not
+// modified.
+func (c *PlatformTolerationConfig) RestrictToPlatforms(allowed []string) *PlatformTolerationConfig {
+	restricted := *c
+	restricted.Mappings = []PlatformTolerationMapping{}
+	for _, m := range c.Mappings {
+		if slices.ContainsFunc(allowed, func(p string) bool { return platformsMatch(m.Platform, p) }) {
+			restricted.Mappings = append(restricted.Mappings, m)
+		}
+	}
+	return &restricted
+}
+
+// GetTolerationsForPlatforms returns all tolerations for platforms that are
+// supported. With MatchExistingTaints, only tolerations matching a taint on
+// some node are returned.
+func (c *PlatformTolerationConfig) GetTolerationsForPlatforms(
+	ctx context.Context,
+	supportedPlatforms []string,
+) []corev1.Toleration {
 	tolerations := []corev1.Toleration{}
 	for _, mapping := range c.Mappings {
 		for _, platform := range supportedPlatforms {
@@ -170,17 +892,48 @@ func (c *PlatformTolerationConfig) GetTolerationsForPlatforms(supportedPlatforms
 			}
 		}
 	}
+	if c.MatchExistingTaints {
+		return filterTolerationsByClusterTaints(ctx, tolerations)
+	}
 	return tolerations
 }
 
+// GetNodeSelectorForPlatforms returns the node selector labels of the mappings
+// for supported platforms. When mappings set the same key, the earlier mapping
+// wins.
+func (c *PlatformTolerationConfig) GetNodeSelectorForPlatforms(supportedPlatforms []string) map[string]string {
+	nodeSelector := map[string]string{}
+	for _, mapping := range c.Mappings {
+		if !slices.Contains(supportedPlatforms, mapping.Platform) {
+			continue
+		}
+		for key, value := range mapping.NodeSelector {
+			if _, ok := nodeSelector[key]; !ok {
+				nodeSelector[key] = value
+			}
+		}
+	}
+	return nodeSelector
+}
+
 // NamespaceFilterConfig holds the configuration for namespace filtering
 type NamespaceFilterConfig struct {
 	// NamespaceSelector is a label selector to filter namespaces to watch
 	NamespaceSelector labels.Selector
 	// NamespacesToIgnore is a list of namespace names to skip
 	NamespacesToIgnore map[string]bool
+	// NamespacesToIgnoreRegex lists patterns matched against the whole
+	// namespace name to skip, such as team-.*
+	NamespacesToIgnoreRegex []*regexp.Regexp
+	// PodSelector is a label selector that pods (or pod templates) must match
+	// to be mutated
+	PodSelector labels.Selector
 }
 
+// defaultNamespacesToIgnore are the system namespaces skipped in addition to
+// NAMESPACES_TO_IGNORE unless DISABLE_DEFAULT_IGNORE is set.
+var defaultNamespacesToIgnore = []string{"kube-system", "kube-public", "kube-node-lease"}
+
 // LoadNamespaceFilterConfig loads namespace filtering configuration from
 // environment variables. An invalid NAMESPACE_SELECTOR is rejected with an error
 // so a bad selector fails fast at startup instead of silently disabling
@@ -200,6 +953,16 @@ func LoadNamespaceFilterConfig() (*NamespaceFilterConfig, error) {
 		slog.Info("loaded namespace selector", "selector", selectorStr)
 	}
 
+	// Parse POD_LABEL_SELECTOR
+	if selectorStr := os.Getenv("POD_LABEL_SELECTOR"); selectorStr != "" {
+		selector, err := labels.Parse(selectorStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid POD_LABEL_SELECTOR %q: %w", selectorStr, err)
+		}
+		config.PodSelector = selector
+		slog.Info("loaded pod label selector", "selector", selectorStr)
+	}
+
 	// Parse NAMESPACES_TO_IGNORE
 	if ignoreStr := os.Getenv("NAMESPACES_TO_IGNORE"); ignoreStr != "" {
 		namespaces := strings.Split(ignoreStr, ",")
@@ -213,10 +976,54 @@ func LoadNamespaceFilterConfig() (*NamespaceFilterConfig, error) {
 			slog.Info("loaded namespaces to ignore", "count", len(config.NamespacesToIgnore), "namespaces", ignoreStr)
 		}
 	}
+	if os.Getenv("DISABLE_DEFAULT_IGNORE") != "true" {
+		for _, ns := range defaultNamespacesToIgnore {
+			config.NamespacesToIgnore[ns] = true
+		}
+		slog.Info("ignoring system namespaces by default", "namespaces", defaultNamespacesToIgnore)
+	}
+
+	// Parse NAMESPACES_TO_IGNORE_REGEX
+	if ignoreStr := os.Getenv("NAMESPACES_TO_IGNORE_REGEX"); ignoreStr != "" {
+		config.NamespacesToIgnoreRegex = parseNamespaceRegexes(ignoreStr)
+		slog.Info("loaded namespace patterns to ignore", "count", len(config.NamespacesToIgnoreRegex),
+			"patterns", ignoreStr)
+	}
 
 	return config, nil
 }
 
+// parseNamespaceRegexes compiles the comma-separated patterns of
+// NAMESPACES_TO_IGNORE_REGEX, anchored so each must match the whole namespace
+// name. Invalid patterns are logged and skipped.
+func parseNamespaceRegexes(value string) []*regexp.Regexp {
+	patterns := []*regexp.Regexp{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			slog.Error("skipping invalid NAMESPACES_TO_IGNORE_REGEX pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns
+}
+
+// IsNamespaceIgnored reports whether the namespace is in NamespacesToIgnore or
+// matches one of NamespacesToIgnoreRegex.
+func (c *NamespaceFilterConfig) IsNamespaceIgnored(name string) bool {
+	if c.NamespacesToIgnore[name] {
+		return true
+	}
+	return slices.ContainsFunc(c.NamespacesToIgnoreRegex, func(re *regexp.Regexp) bool {
+		return re.MatchString(name)
+	})
+}
+
 // ShouldSkipNamespace checks if a namespace should be skipped based on the filter config
 // Returns true if the namespace should be skipped, false if it should be processed
 func (c *NamespaceFilterConfig) ShouldSkipNamespace(ns *corev1.Namespace) bool {
@@ -225,7 +1032,7 @@ func (c *NamespaceFilterConfig) ShouldSkipNamespace(ns *corev1.Namespace) bool {
 	}
 
 	// Check if namespace is in the ignore list
-	if c.NamespacesToIgnore[ns.Name] {
+	if c.IsNamespaceIgnored(ns.Name) {
 		slog.Debug("skipping namespace due to ignore list", "namespace", ns.Name)
 		return true
 	}
@@ -240,3 +1047,13 @@ func (c *NamespaceFilterConfig) ShouldSkipNamespace(ns *corev1.Namespace) bool {
 
 	return false
 }
+
+// ShouldSkipPodLabels checks if a pod should be skipped because its labels do
+// not match the configured pod label selector. Returns false when no selector
+// is configured.
+func (c *NamespaceFilterConfig) ShouldSkipPodLabels(podLabels map[string]string) bool {
+	if c == nil || c.PodSelector == nil || c.PodSelector.Empty() {
+		return false
+	}
+	return !c.PodSelector.Matches(labels.Set(podLabels))
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"maps"
 	"os"
 	"slices"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
 )
 
 const linuxArm64 = "linux/arm64"
@@ -68,6 +72,112 @@ func TestLoadPlatformTolerationConfig_SimpleEnvVars(t *testing.T) {
 	}
 }
 
+func TestLoadPlatformTolerationConfig_IndexedSimpleEnvVars(t *testing.T) {
+	t.Setenv("PLATFORM_TOLERATIONS", "")
+	t.Setenv("TOLERATION_KEY", "")
+	t.Setenv("TOLERATION_KEY_1", "arch")
+	t.Setenv("TOLERATION_VALUE_1", "arm64")
+	t.Setenv("TOLERATION_KEY_2", "arch")
+	t.Setenv("TOLERATION_VALUE_2", "amd64")
+	t.Setenv("TOLERATION_PLATFORM_2", "linux/amd64")
+	t.Setenv("TOLERATION_EFFECT_2", "PreferNoSchedule")
+	// A gap in the sequence stops parsing, and index 0 is never read; both are
+	// reported as ignored.
+	t.Setenv("TOLERATION_KEY_4", "ignored")
+	t.Setenv("TOLERATION_VALUE_0", "ignored")
+	ignored := configFallbacks.WithLabelValues(configFallbackIgnoredIndex)
+	before := testutil.ToFloat64(ignored)
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if got := testutil.ToFloat64(ignored) - before; got != 1 {
+		t.Errorf("ignored_index fallbacks = %v, want 1", got)
+	}
+
+	expected := []PlatformTolerationMapping{
+		{
+			Platform: linuxArm64,
+			Toleration: corev1.Toleration{
+				Key:      "arch",
+				Value:    "arm64",
+				Operator: corev1.TolerationOpEqual,
+				Effect:   corev1.TaintEffectNoSchedule,
+			},
+		},
+		{
+			Platform: "linux/amd64",
+			Toleration: corev1.Toleration{
+				Key:      "arch",
+				Value:    "amd64",
+				Operator: corev1.TolerationOpEqual,
+				Effect:   corev1.TaintEffectPreferNoSchedule,
+			},
+		},
+	}
+	if !slices.EqualFunc(config.Mappings, expected, func(a, b PlatformTolerationMapping) bool {
+		return a.Platform == b.Platform && a.Toleration == b.Toleration
+	}) {
+		t.Errorf("Mappings = %+v, want %+v", config.Mappings, expected)
+	}
+}
+
+func TestLoadPlatformTolerationConfig_PlatformEffects(t *testing.T) {
+	t.Setenv("PLATFORM_TOLERATIONS", "")
+	t.Setenv("TOLERATION_KEY", "arch")
+	t.Setenv("TOLERATION_VALUE", "arm64")
+	t.Setenv("TOLERATION_KEY_1", "arch")
+	t.Setenv("TOLERATION_VALUE_1", "amd64")
+	t.Setenv("TOLERATION_PLATFORM_1", "linux/amd64")
+	t.Setenv("TOLERATION_KEY_2", "arch")
+	t.Setenv("TOLERATION_VALUE_2", "ppc64le")
+	t.Setenv("TOLERATION_PLATFORM_2", "linux/ppc64le")
+	t.Setenv("TOLERATION_EFFECT_2", "NoExecute")
+	t.Setenv("TOLERATION_EFFECTS", "linux/arm64=NoSchedule, linux/amd64=PreferNoSchedule,linux/ppc64le=NoSchedule")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	want := map[string]corev1.TaintEffect{
+		linuxArm64:      corev1.TaintEffectNoSchedule,
+		"linux/amd64":   corev1.TaintEffectPreferNoSchedule,
+		"linux/ppc64le": corev1.TaintEffectNoExecute, // TOLERATION_EFFECT_2 wins
+	}
+	if len(config.Mappings) != len(want) {
+		t.Fatalf("Mappings = %+v, want %d mappings", config.Mappings, len(want))
+	}
+	for _, m := range config.Mappings {
+		if m.Toleration.Effect != want[m.Platform] {
+			t.Errorf("%s effect = %q, want %q", m.Platform, m.Toleration.Effect, want[m.Platform])
+		}
+	}
+
+	for _, value := range []string{"linux/arm64", "linux/arm64=Sometimes", "=NoSchedule"} {
+		t.Setenv("TOLERATION_EFFECTS", value)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for TOLERATION_EFFECTS=%q", value)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_UnindexedAndIndexedSimpleEnvVars(t *testing.T) {
+	t.Setenv("PLATFORM_TOLERATIONS", "")
+	t.Setenv("TOLERATION_KEY", "custom-key")
+	t.Setenv("TOLERATION_KEY_1", "other-key")
+	t.Setenv("TOLERATION_PLATFORM_1", "linux/amd64")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	if got := config.GetPlatforms(); !slices.Equal(got, []string{linuxArm64, "linux/amd64"}) {
+		t.Errorf("GetPlatforms() = %v, want [linux/arm64 linux/amd64]", got)
+	}
+}
+
 func TestLoadPlatformTolerationConfig_JSON(t *testing.T) {
 	jsonConfig := fmt.Sprintf(`[
 		{
@@ -138,6 +248,70 @@ func TestLoadPlatformTolerationConfig_JSON_InvalidOperatorAndEffect(t *testing.T
 	}
 }
 
+func TestLoadPlatformTolerationConfig_StrictTolerationValidation(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		t.Setenv("STRICT_TOLERATION_VALIDATION", "true")
+		t.Setenv("PLATFORM_TOLERATIONS", fmt.Sprintf(`[
+			{"platform": %q, "key": "arch", "value": "arm64", "operator": "Equals"},
+			{"platform": "linux/amd64", "key": "arch", "value": "amd64", "effect": "NoExecute"}
+		]`, linuxArm64))
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if len(config.Mappings) != 1 || config.Mappings[0].Platform != "linux/amd64" {
+			t.Errorf("mappings = %+v, want only the valid amd64 entry", config.Mappings)
+		}
+
+		t.Setenv("PLATFORM_TOLERATIONS", fmt.Sprintf(
+			`[{"platform": %q, "key": "arch", "value": "arm64", "effect": "NoScheduel"}]`, linuxArm64))
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Error("expected an error when the only entry is skipped")
+		}
+	})
+
+	indexed := func(t *testing.T) {
+		t.Setenv("TOLERATION_KEY_1", "arch")
+		t.Setenv("TOLERATION_VALUE_1", "arm64")
+		t.Setenv("TOLERATION_KEY_2", "arch")
+		t.Setenv("TOLERATION_VALUE_2", "amd64")
+		t.Setenv("TOLERATION_PLATFORM_2", "linux/amd64")
+		t.Setenv("TOLERATION_OPERATOR_2", "exists")
+		t.Setenv("TOLERATION_KEY_3", "arch")
+		t.Setenv("TOLERATION_VALUE_3", "s390x")
+		t.Setenv("TOLERATION_PLATFORM_3", "linux/s390x")
+	}
+	t.Run("indexed env vars", func(t *testing.T) {
+		t.Setenv("STRICT_TOLERATION_VALIDATION", "true")
+		indexed(t)
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if got := config.GetPlatforms(); !slices.Equal(got, []string{linuxArm64, "linux/s390x"}) {
+			t.Errorf("platforms = %v, want the invalid second mapping skipped", got)
+		}
+	})
+	t.Run("lenient", func(t *testing.T) {
+		indexed(t)
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if len(config.Mappings) != 3 || config.Mappings[1].Toleration.Operator != corev1.TolerationOpEqual {
+			t.Errorf("mappings = %+v, want the invalid operator defaulted to Equal", config.Mappings)
+		}
+	})
+
+	t.Run("fully portable toleration", func(t *testing.T) {
+		t.Setenv("STRICT_TOLERATION_VALIDATION", "true")
+		t.Setenv("FULLY_PORTABLE_TOLERATION", `{"key": "portable", "effect": "Never"}`)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Error("expected an error for an invalid FULLY_PORTABLE_TOLERATION effect")
+		}
+	})
+}
+
 func TestLoadPlatformTolerationConfig_MalformedJSON(t *testing.T) {
 	t.Setenv("PLATFORM_TOLERATIONS", `[{"platform": "linux/arm64", "key": }`)
 
@@ -150,6 +324,623 @@ func TestLoadPlatformTolerationConfig_MalformedJSON(t *testing.T) {
 	}
 }
 
+func TestLoadPlatformTolerationConfig_JSONValidation(t *testing.T) {
+	tests := []struct {
+		name          string
+		json          string
+		wantErr       bool
+		wantPlatforms []string
+	}{
+		{
+			name:    "trailing comma is a syntax error",
+			json:    `[{"platform": "linux/arm64", "key": "arch"},]`,
+			wantErr: true,
+		},
+		{
+			name:    "not an array",
+			json:    `{"platform": "linux/arm64", "key": "arch"}`,
+			wantErr: true,
+		},
+		{
+			name: "unknown field skips only that entry",
+			json: `[
+				{"platform": "linux/arm64", "key": "arch"},
+				{"platfrom": "linux/amd64", "key": "arch"}
+			]`,
+			wantPlatforms: []string{linuxArm64},
+		},
+		{
+			name: "missing platform skips only that entry",
+			json: `[
+				{"key": "arch"},
+				{"platform": "linux/amd64", "key": "arch"}
+			]`,
+			wantPlatforms: []string{"linux/amd64"},
+		},
+		{
+			name: "missing key skips only that entry",
+			json: `[
+				{"platform": "linux/arm64"},
+				{"platform": "linux/amd64", "key": "arch"}
+			]`,
+			wantPlatforms: []string{"linux/amd64"},
+		},
+		{
+			name: "wrong field type skips only that entry",
+			json: `[
+				{"platform": "linux/arm64", "key": 42},
+				{"platform": "linux/amd64", "key": "arch"}
+			]`,
+			wantPlatforms: []string{"linux/amd64"},
+		},
+		{
+			name:    "no valid entries is an error",
+			json:    `[{"platform": "linux/arm64"}, {"key": "arch"}]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PLATFORM_TOLERATIONS", tt.json)
+
+			config, err := LoadPlatformTolerationConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got config %+v", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error loading config: %v", err)
+			}
+			if got := config.GetPlatforms(); !slices.Equal(got, tt.wantPlatforms) {
+				t.Errorf("GetPlatforms() = %v, want %v", got, tt.wantPlatforms)
+			}
+		})
+	}
+}
+
+func TestLoadPlatformTolerationConfig_FallbackMetric(t *testing.T) {
+	skipped := configFallbacks.WithLabelValues(configFallbackInvalidEntry)
+	invalidField := configFallbacks.WithLabelValues(configFallbackInvalidField)
+	beforeSkipped, beforeInvalidField := testutil.ToFloat64(skipped), testutil.ToFloat64(invalidField)
+
+	t.Setenv("PLATFORM_TOLERATIONS", `[
+		{"platform": "linux/arm64", "key": "arch", "effect": "Sometimes"},
+		{"platfrom": "linux/amd64", "key": "arch"}
+	]`)
+	if _, err := LoadPlatformTolerationConfig(); err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	if got := testutil.ToFloat64(skipped) - beforeSkipped; got != 1 {
+		t.Errorf("invalid_entry fallbacks = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(invalidField) - beforeInvalidField; got != 1 {
+		t.Errorf("invalid_field fallbacks = %v, want 1", got)
+	}
+}
+
+func TestLoadPlatformTolerationConfig_RequireExplicitConfig(t *testing.T) {
+	t.Run("default without config env is ready", func(t *testing.T) {
+		t.Setenv("REQUIRE_EXPLICIT_CONFIG", "true")
+		t.Setenv("PLATFORM_TOLERATIONS", "")
+		t.Setenv("TOLERATION_KEY", "")
+
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if err := config.CheckReady(); err != nil {
+			t.Errorf("CheckReady() = %v, want nil", err)
+		}
+	})
+
+	t.Run("default despite config env is not ready", func(t *testing.T) {
+		t.Setenv("REQUIRE_EXPLICIT_CONFIG", "true")
+		t.Setenv("PLATFORM_TOLERATIONS", "[]")
+		t.Setenv("TOLERATION_KEY", "")
+
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if !config.UnexpectedDefault {
+			t.Error("expected UnexpectedDefault to be set")
+		}
+		if err := config.CheckReady(); err == nil {
+			t.Error("CheckReady() = nil, want an error")
+		}
+	})
+
+	t.Run("unexpected default is ready unless required", func(t *testing.T) {
+		t.Setenv("REQUIRE_EXPLICIT_CONFIG", "")
+		t.Setenv("PLATFORM_TOLERATIONS", "")
+		t.Setenv("TOLERATION_KEY", "")
+		t.Setenv("TOLERATION_VALUE", "arm64")
+
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if !config.UnexpectedDefault {
+			t.Error("expected UnexpectedDefault to be set")
+		}
+		if err := config.CheckReady(); err != nil {
+			t.Errorf("CheckReady() = %v, want nil", err)
+		}
+	})
+}
+
+func TestLoadPlatformTolerationConfig_MaxLookupsPerAdmission(t *testing.T) {
+	t.Setenv("MAX_LOOKUPS_PER_ADMISSION", "5")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.MaxLookupsPerAdmission != 5 {
+		t.Errorf("Expected MaxLookupsPerAdmission to be 5, got %d", config.MaxLookupsPerAdmission)
+	}
+
+	for _, invalid := range []string{"abc", "-1"} {
+		t.Setenv("MAX_LOOKUPS_PER_ADMISSION", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for MAX_LOOKUPS_PER_ADMISSION=%q", invalid)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_LookupParallelism(t *testing.T) {
+	t.Setenv("IMAGE_LOOKUP_PARALLELISM", "8")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.LookupParallelism != 8 {
+		t.Errorf("Expected LookupParallelism to be 8, got %d", config.LookupParallelism)
+	}
+
+	for _, invalid := range []string{"many", "0", "-2"} {
+		t.Setenv("IMAGE_LOOKUP_PARALLELISM", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for IMAGE_LOOKUP_PARALLELISM=%q", invalid)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_PatchWarnBytes(t *testing.T) {
+	t.Setenv("PATCH_WARN_BYTES", "4096")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.PatchWarnBytes != 4096 {
+		t.Errorf("Expected PatchWarnBytes to be 4096, got %d", config.PatchWarnBytes)
+	}
+
+	for _, invalid := range []string{"4k", "-1"} {
+		t.Setenv("PATCH_WARN_BYTES", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for PATCH_WARN_BYTES=%q", invalid)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_InitContainerPolicy(t *testing.T) {
+	t.Setenv("INIT_CONTAINER_POLICY", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.InitContainerPolicy != InitContainerPolicyInclude {
+		t.Errorf("Expected default InitContainerPolicy %q, got %q", InitContainerPolicyInclude, config.InitContainerPolicy)
+	}
+
+	for _, policy := range []string{InitContainerPolicyExclude, InitContainerPolicyWarnOnly} {
+		t.Setenv("INIT_CONTAINER_POLICY", policy)
+		config, err = LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if config.InitContainerPolicy != policy {
+			t.Errorf("Expected InitContainerPolicy %q, got %q", policy, config.InitContainerPolicy)
+		}
+	}
+
+	t.Setenv("INIT_CONTAINER_POLICY", "ignore")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid INIT_CONTAINER_POLICY")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_OnAuthError(t *testing.T) {
+	t.Setenv("ON_AUTH_ERROR", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.OnAuthError != OnAuthErrorStrip {
+		t.Errorf("Expected default OnAuthError %q, got %q", OnAuthErrorStrip, config.OnAuthError)
+	}
+
+	for _, policy := range []string{OnAuthErrorSkipImage, OnAuthErrorAssumeSupported} {
+		t.Setenv("ON_AUTH_ERROR", policy)
+		config, err = LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if config.OnAuthError != policy {
+			t.Errorf("Expected OnAuthError %q, got %q", policy, config.OnAuthError)
+		}
+	}
+
+	t.Setenv("ON_AUTH_ERROR", "ignore")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid ON_AUTH_ERROR")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_FullyPortableToleration(t *testing.T) {
+	t.Setenv("FULLY_PORTABLE_TOLERATION", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.FullyPortableToleration != nil {
+		t.Errorf("Expected no fully portable toleration by default, got %+v", config.FullyPortableToleration)
+	}
+
+	t.Setenv("FULLY_PORTABLE_TOLERATION", `{"key": "portable", "operator": "Exists", "effect": "PreferNoSchedule"}`)
+	config, err = LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	want := corev1.Toleration{
+		Key:      "portable",
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectPreferNoSchedule,
+	}
+	if config.FullyPortableToleration == nil || *config.FullyPortableToleration != want {
+		t.Errorf("Expected fully portable toleration %+v, got %+v", want, config.FullyPortableToleration)
+	}
+
+	for _, invalid := range []string{`not json`, `{"value": "x"}`, `{"key": "portable", "platform": "linux/arm64"}`} {
+		t.Setenv("FULLY_PORTABLE_TOLERATION", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for FULLY_PORTABLE_TOLERATION=%s", invalid)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_LocalImagePolicy(t *testing.T) {
+	t.Setenv("LOCAL_IMAGE_POLICY", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.LocalImagePolicy != LocalImagePolicyInspect {
+		t.Errorf("Expected default LocalImagePolicy %q, got %q", LocalImagePolicyInspect, config.LocalImagePolicy)
+	}
+
+	for _, policy := range []string{LocalImagePolicySkip, LocalImagePolicyAssumeSupported} {
+		t.Setenv("LOCAL_IMAGE_POLICY", policy)
+		config, err = LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if config.LocalImagePolicy != policy {
+			t.Errorf("Expected LocalImagePolicy %q, got %q", policy, config.LocalImagePolicy)
+		}
+	}
+
+	t.Setenv("LOCAL_IMAGE_POLICY", "ignore")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid LOCAL_IMAGE_POLICY")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_DaemonSetPolicy(t *testing.T) {
+	t.Setenv("DAEMONSET_POLICY", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.DaemonSetPolicy != DaemonSetPolicyAll {
+		t.Errorf("Expected default DaemonSetPolicy %q, got %q", DaemonSetPolicyAll, config.DaemonSetPolicy)
+	}
+
+	t.Setenv("DAEMONSET_POLICY", DaemonSetPolicyAny)
+	config, err = LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.DaemonSetPolicy != DaemonSetPolicyAny {
+		t.Errorf("Expected DaemonSetPolicy %q, got %q", DaemonSetPolicyAny, config.DaemonSetPolicy)
+	}
+
+	t.Setenv("DAEMONSET_POLICY", "always")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid DAEMONSET_POLICY")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_InvalidImagePolicy(t *testing.T) {
+	t.Setenv("INVALID_IMAGE_POLICY", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.InvalidImagePolicy != InvalidImagePolicyWarn {
+		t.Errorf("Expected default InvalidImagePolicy %q, got %q", InvalidImagePolicyWarn, config.InvalidImagePolicy)
+	}
+
+	t.Setenv("INVALID_IMAGE_POLICY", InvalidImagePolicyReject)
+	config, err = LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.InvalidImagePolicy != InvalidImagePolicyReject {
+		t.Errorf("Expected InvalidImagePolicy %q, got %q", InvalidImagePolicyReject, config.InvalidImagePolicy)
+	}
+
+	t.Setenv("INVALID_IMAGE_POLICY", "ignore")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid INVALID_IMAGE_POLICY")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_PatchStrategy(t *testing.T) {
+	t.Setenv("PATCH_STRATEGY", "")
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.PatchStrategy != PatchStrategyDiff {
+		t.Errorf("Expected default PatchStrategy %q, got %q", PatchStrategyDiff, config.PatchStrategy)
+	}
+
+	t.Setenv("PATCH_STRATEGY", PatchStrategyAppend)
+	config, err = LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.PatchStrategy != PatchStrategyAppend {
+		t.Errorf("Expected PatchStrategy %q, got %q", PatchStrategyAppend, config.PatchStrategy)
+	}
+
+	t.Setenv("PATCH_STRATEGY", "strategic")
+	if _, err := LoadPlatformTolerationConfig(); err == nil {
+		t.Error("expected an error for an invalid PATCH_STRATEGY")
+	}
+}
+
+func TestLoadPlatformTolerationConfig_DisableDefaultMapping(t *testing.T) {
+	t.Setenv("PLATFORM_TOLERATIONS", "")
+	t.Setenv("TOLERATION_KEY", "")
+	t.Setenv("DISABLE_DEFAULT_MAPPING", "true")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if len(config.Mappings) != 0 {
+		t.Errorf("Expected no mappings with the default disabled, got %+v", config.Mappings)
+	}
+	if platforms := config.GetPlatforms(); len(platforms) != 0 {
+		t.Errorf("Expected no platforms, got %v", platforms)
+	}
+
+	t.Setenv("TOLERATION_KEY", "custom")
+	config, err = LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if len(config.Mappings) != 1 || config.Mappings[0].Toleration.Key != "custom" {
+		t.Errorf("Expected the explicit mapping to still load, got %+v", config.Mappings)
+	}
+}
+
+func TestLoadPlatformTolerationConfig_NodeSelector(t *testing.T) {
+	t.Setenv("NODE_SELECTOR_ENABLED", "true")
+	t.Setenv("PLATFORM_TOLERATIONS", `[
+		{"platform": "linux/arm64", "key": "arch", "value": "arm64", "nodeSelector": {"kubernetes.io/arch": "arm64"}},
+		{"platform": "linux/amd64", "key": "arch", "value": "amd64"}
+	]`)
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if !config.NodeSelectorEnabled {
+		t.Error("Expected NodeSelectorEnabled to be true")
+	}
+	if len(config.Mappings) != 2 {
+		t.Fatalf("Expected 2 mappings, got %d", len(config.Mappings))
+	}
+	if got := config.Mappings[0].NodeSelector; !maps.Equal(got, map[string]string{"kubernetes.io/arch": "arm64"}) {
+		t.Errorf("Expected arm64 node selector, got %v", got)
+	}
+	if got := config.Mappings[1].NodeSelector; got != nil {
+		t.Errorf("Expected no node selector for amd64, got %v", got)
+	}
+}
+
+func TestLoadPlatformTolerationConfig_NoExecuteSeconds(t *testing.T) {
+	t.Setenv("TOLERATION_KEY", "")
+	t.Setenv("DEFAULT_NOEXECUTE_SECONDS", "300")
+	t.Setenv("PLATFORM_TOLERATIONS", `[
+		{"platform": "linux/arm64", "key": "spot", "effect": "NoExecute"},
+		{"platform": "linux/amd64", "key": "explicit", "effect": "NoExecute", "tolerationSeconds": 60},
+		{"platform": "linux/arm/v7", "key": "schedule", "effect": "NoSchedule", "tolerationSeconds": 60}
+	]`)
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	want := map[string]*int64{"spot": ptr.To[int64](300), "explicit": ptr.To[int64](60), "schedule": nil}
+	for _, m := range config.Mappings {
+		got, expected := m.Toleration.TolerationSeconds, want[m.Toleration.Key]
+		if (got == nil) != (expected == nil) || (got != nil && *got != *expected) {
+			t.Errorf("mapping %q: TolerationSeconds = %v, want %v", m.Toleration.Key, got, expected)
+		}
+	}
+
+	t.Run("simple env vars", func(t *testing.T) {
+		t.Setenv("PLATFORM_TOLERATIONS", "")
+		t.Setenv("TOLERATION_KEY", "spot")
+		t.Setenv("TOLERATION_EFFECT", "NoExecute")
+		t.Setenv("TOLERATION_SECONDS", "")
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if s := config.Mappings[0].Toleration.TolerationSeconds; s == nil || *s != 300 {
+			t.Errorf("Expected the default 300 seconds, got %v", s)
+		}
+
+		t.Setenv("TOLERATION_SECONDS", "30")
+		config, err = LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if s := config.Mappings[0].Toleration.TolerationSeconds; s == nil || *s != 30 {
+			t.Errorf("Expected the explicit 30 seconds, got %v", s)
+		}
+	})
+
+	t.Run("no default leaves seconds unset", func(t *testing.T) {
+		t.Setenv("DEFAULT_NOEXECUTE_SECONDS", "")
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if s := config.Mappings[0].Toleration.TolerationSeconds; s != nil {
+			t.Errorf("Expected no TolerationSeconds, got %d", *s)
+		}
+	})
+
+	for _, invalid := range []string{"soon", "-5"} {
+		t.Setenv("DEFAULT_NOEXECUTE_SECONDS", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for DEFAULT_NOEXECUTE_SECONDS=%q", invalid)
+		}
+	}
+}
+
+func TestLoadPlatformTolerationConfig_SecondsOnlyOnNoExecute(t *testing.T) {
+	// Kubernetes rejects tolerationSeconds on any effect but NoExecute, so no
+	// configuration source may carry it onto a NoSchedule or PreferNoSchedule
+	// toleration, not even with DEFAULT_NOEXECUTE_SECONDS set.
+	t.Setenv("DEFAULT_NOEXECUTE_SECONDS", "300")
+	t.Setenv("FULLY_PORTABLE_TOLERATION",
+		`{"key": "portable", "effect": "PreferNoSchedule", "tolerationSeconds": 60}`)
+	t.Setenv("TOLERATION_KEY", "")
+
+	assertNoSeconds := func(t *testing.T, config *PlatformTolerationConfig) {
+		t.Helper()
+		if len(config.Mappings) == 0 {
+			t.Fatal("expected at least one mapping")
+		}
+		for _, m := range config.Mappings {
+			if m.Toleration.Effect == corev1.TaintEffectNoExecute {
+				t.Fatalf("mapping %q unexpectedly has the NoExecute effect", m.Toleration.Key)
+			}
+			if s := m.Toleration.TolerationSeconds; s != nil {
+				t.Errorf("mapping %q (%s): TolerationSeconds = %d, want nil", m.Toleration.Key, m.Toleration.Effect, *s)
+			}
+		}
+		if s := config.FullyPortableToleration.TolerationSeconds; s != nil {
+			t.Errorf("FullyPortableToleration.TolerationSeconds = %d, want nil", *s)
+		}
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		t.Setenv("PLATFORM_TOLERATIONS", `[
+			{"platform": "linux/arm64", "key": "schedule", "effect": "NoSchedule", "tolerationSeconds": 60},
+			{"platform": "linux/amd64", "key": "prefer", "effect": "PreferNoSchedule", "tolerationSeconds": 60},
+			{"platform": "linux/arm/v7", "key": "implicit", "tolerationSeconds": 60}
+		]`)
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		assertNoSeconds(t, config)
+	})
+
+	t.Run("simple and indexed env vars", func(t *testing.T) {
+		t.Setenv("PLATFORM_TOLERATIONS", "")
+		t.Setenv("TOLERATION_KEY", "schedule")
+		t.Setenv("TOLERATION_EFFECT", "NoSchedule")
+		t.Setenv("TOLERATION_SECONDS", "60")
+		t.Setenv("TOLERATION_KEY_1", "prefer")
+		t.Setenv("TOLERATION_PLATFORM_1", "linux/amd64")
+		t.Setenv("TOLERATION_EFFECT_1", "PreferNoSchedule")
+		t.Setenv("TOLERATION_SECONDS_1", "60")
+		config, err := LoadPlatformTolerationConfig()
+		if err != nil {
+			t.Fatalf("unexpected error loading config: %v", err)
+		}
+		if len(config.Mappings) != 2 {
+			t.Fatalf("Expected 2 mappings, got %d", len(config.Mappings))
+		}
+		assertNoSeconds(t, config)
+	})
+}
+
+func TestLoadPlatformTolerationConfig_IgnoreContainerNames(t *testing.T) {
+	t.Setenv("IGNORE_CONTAINER_NAMES", " istio-proxy , linkerd-proxy,,")
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	want := map[string]bool{"istio-proxy": true, "linkerd-proxy": true}
+	if !maps.Equal(config.IgnoreContainerNames, want) {
+		t.Errorf("IgnoreContainerNames = %v, want %v", config.IgnoreContainerNames, want)
+	}
+}
+
+func TestLoadPlatformTolerationConfig_DenyPlatformImages(t *testing.T) {
+	t.Setenv("DENY_PLATFORM_IMAGES", `{
+		"legacy.example.com/*/*": ["linux/arm64"],
+		"docker.io/library/old-*": ["linux/arm64", "linux/arm/v7"]
+	}`)
+
+	config, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{image: "legacy.example.com/team/app:v1", want: []string{linuxArm64}},
+		{image: "old-tool:1.0", want: []string{linuxArm64, "linux/arm/v7"}},
+		{image: "legacy.example.com/app:v1", want: []string{}},
+		{image: "nginx:latest", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := config.DeniedPlatforms(tt.image); !slices.Equal(got, tt.want) {
+				t.Errorf("DeniedPlatforms(%q) = %v, want %v", tt.image, got, tt.want)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`["linux/arm64"]`, `{"legacy[": ["linux/arm64"]}`} {
+		t.Setenv("DENY_PLATFORM_IMAGES", invalid)
+		if _, err := LoadPlatformTolerationConfig(); err == nil {
+			t.Errorf("expected an error for DENY_PLATFORM_IMAGES=%s", invalid)
+		}
+	}
+}
+
 func TestGetPlatforms(t *testing.T) {
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -167,6 +958,31 @@ func TestGetPlatforms(t *testing.T) {
 	}
 }
 
+func TestRestrictToPlatforms(t *testing.T) {
+	config := &PlatformTolerationConfig{
+		Mappings: []PlatformTolerationMapping{
+			{Platform: linuxArm64},
+			{Platform: "linux/amd64"},
+			{Platform: "linux/arm/v7"},
+		},
+	}
+
+	restricted := config.RestrictToPlatforms([]string{"linux/amd64", "linux/s390x"})
+
+	if got := restricted.GetPlatforms(); !slices.Equal(got, []string{"linux/amd64"}) {
+		t.Errorf("RestrictToPlatforms() platforms = %v, want [linux/amd64]", got)
+	}
+	if len(config.Mappings) != 3 {
+		t.Errorf("RestrictToPlatforms() modified the receiver, got %d mappings", len(config.Mappings))
+	}
+
+	// Equivalent spellings match, as they do for image platforms.
+	restricted = config.RestrictToPlatforms([]string{"linux/arm64/v8"})
+	if got := restricted.GetPlatforms(); !slices.Equal(got, []string{linuxArm64}) {
+		t.Errorf("RestrictToPlatforms(linux/arm64/v8) platforms = %v, want [%s]", got, linuxArm64)
+	}
+}
+
 func TestGetTolerationsForPlatforms(t *testing.T) {
 	config := &PlatformTolerationConfig{
 		Mappings: []PlatformTolerationMapping{
@@ -201,7 +1017,7 @@ func TestGetTolerationsForPlatforms(t *testing.T) {
 	}
 
 	supportedPlatforms := []string{linuxArm64, "linux/amd64"}
-	tolerations := config.GetTolerationsForPlatforms(supportedPlatforms)
+	tolerations := config.GetTolerationsForPlatforms(context.Background(), supportedPlatforms)
 
 	if len(tolerations) != 2 {
 		t.Errorf("Expected 2 tolerations, got %d", len(tolerations))
@@ -277,6 +1093,7 @@ func TestLoadNamespaceFilterConfig(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Set environment variables
+			t.Setenv("DISABLE_DEFAULT_IGNORE", "true")
 			if tt.selectorEnv != "" {
 				t.Setenv("NAMESPACE_SELECTOR", tt.selectorEnv)
 			}
@@ -306,6 +1123,81 @@ func TestLoadNamespaceFilterConfig(t *testing.T) {
 	}
 }
 
+func TestLoadNamespaceFilterConfig_DefaultIgnore(t *testing.T) {
+	t.Setenv("NAMESPACES_TO_IGNORE", "monitoring")
+
+	config, err := LoadNamespaceFilterConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	want := map[string]bool{"kube-system": true, "kube-public": true, "kube-node-lease": true, "monitoring": true}
+	if !maps.Equal(config.NamespacesToIgnore, want) {
+		t.Errorf("NamespacesToIgnore = %v, want the defaults merged with %v", config.NamespacesToIgnore, want)
+	}
+
+	t.Setenv("DISABLE_DEFAULT_IGNORE", "true")
+	config, err = LoadNamespaceFilterConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if want := map[string]bool{"monitoring": true}; !maps.Equal(config.NamespacesToIgnore, want) {
+		t.Errorf("NamespacesToIgnore with DISABLE_DEFAULT_IGNORE = %v, want %v", config.NamespacesToIgnore, want)
+	}
+}
+
+func TestLoadNamespaceFilterConfig_PodLabelSelector(t *testing.T) {
+	t.Setenv("POD_LABEL_SELECTOR", "k8smultiarcher=enabled")
+
+	config, err := LoadNamespaceFilterConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if config.ShouldSkipPodLabels(map[string]string{"k8smultiarcher": "enabled"}) {
+		t.Error("Expected a matching pod not to be skipped")
+	}
+	if !config.ShouldSkipPodLabels(map[string]string{"app": "web"}) {
+		t.Error("Expected a non-matching pod to be skipped")
+	}
+
+	t.Setenv("POD_LABEL_SELECTOR", "!@#invalid")
+	if _, err := LoadNamespaceFilterConfig(); err == nil {
+		t.Error("expected an error for an invalid POD_LABEL_SELECTOR")
+	}
+}
+
+func TestLoadNamespaceFilterConfig_IgnoreRegex(t *testing.T) {
+	t.Setenv("NAMESPACES_TO_IGNORE", "legacy")
+	t.Setenv("NAMESPACES_TO_IGNORE_REGEX", "team-.*, ([invalid, kube-(system|public)")
+
+	config, err := LoadNamespaceFilterConfig()
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %v", err)
+	}
+	if len(config.NamespacesToIgnoreRegex) != 2 {
+		t.Errorf("Expected the invalid pattern to be skipped, got %v", config.NamespacesToIgnoreRegex)
+	}
+
+	for ns, want := range map[string]bool{
+		"team-a":       true,
+		"team-billing": true,
+		"kube-system":  true,
+		"kube-public":  true,
+		"legacy":       true,
+		"myteam-a":     false,
+		"team":         false,
+		"kube-dns":     false,
+		"default":      false,
+	} {
+		if got := config.IsNamespaceIgnored(ns); got != want {
+			t.Errorf("IsNamespaceIgnored(%q) = %v, want %v", ns, got, want)
+		}
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}
+		if got := config.ShouldSkipNamespace(namespace); got != want {
+			t.Errorf("ShouldSkipNamespace(%q) = %v, want %v", ns, got, want)
+		}
+	}
+}
+
 func TestLoadNamespaceFilterConfig_InvalidSelector(t *testing.T) {
 	t.Setenv("NAMESPACE_SELECTOR", "environment=prod,!@#invalid")
 
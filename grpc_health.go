@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// grpcHealthWatchInterval is how often a Watch stream re-evaluates readiness
+// to detect status changes.
+const grpcHealthWatchInterval = 5 * time.Second
+
+// healthService implements grpc.health.v1.Health for the webhook as a whole,
+// the empty service name, reporting the same readiness as /readyz.
+type healthService struct {
+	healthpb.UnimplementedHealthServer
+}
+
+// servingStatus maps checkReady to a health status.
+func servingStatus() healthpb.HealthCheckResponse_ServingStatus {
+	if err := checkReady(); err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func (healthService) Check(
+	_ context.Context, req *healthpb.HealthCheckRequest,
+) (*healthpb.HealthCheckResponse, error) {
+	if req.GetService() != "" {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &healthpb.HealthCheckResponse{Status: servingStatus()}, nil
+}
+
+// Watch sends the current status, then a new message whenever it changes. An
+// unknown service reports SERVICE_UNKNOWN once, as the protocol requires.
+func (healthService) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if req.GetService() != "" {
+		return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN})
+	}
+	ticker := time.NewTicker(grpcHealthWatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if current := servingStatus(); current != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// newGRPCHealthServer returns a gRPC server with only the health service
+// registered.
+func newGRPCHealthServer() *grpc.Server {
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, healthService{})
+	return s
+}
+
+// startGRPCHealthServer serves the gRPC health service on GRPC_HEALTH_PORT, on
+// the same HOST as the webhook, in the background. It does nothing when
+// GRPC_HEALTH_PORT is unset.
+func startGRPCHealthServer() {
+	port := os.Getenv("GRPC_HEALTH_PORT")
+	if port == "" {
+		return
+	}
+	addr := fmt.Sprintf("%s:%s", os.Getenv("HOST"), port)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("failed to listen for gRPC health", "addr", addr, "error", err)
+		os.Exit(1)
+	}
+	s := newGRPCHealthServer()
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			slog.Error("gRPC health server stopped", "error", err)
+		}
+	}()
+	slog.Info("serving gRPC health", "addr", addr)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// newHealthClient serves the gRPC health service on a loopback port for the
+// duration of the test and returns a client for it.
+func newHealthClient(t *testing.T) healthpb.HealthClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGRPCHealthServer()
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestGRPCHealth_Check(t *testing.T) {
+	prevConfig, prevErr := platformConfig, startupRegistryCheckError()
+	t.Cleanup(func() {
+		platformConfig = prevConfig
+		setStartupRegistryCheckError(prevErr)
+	})
+	platformConfig = nil
+	client := newHealthClient(t)
+	ctx := context.Background()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check() = %v, %v; want SERVING", resp.GetStatus(), err)
+	}
+
+	setStartupRegistryCheckError(errors.New("failed to inspect canary image"))
+	resp, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check() = %v, %v; want NOT_SERVING when /readyz is not ready", resp.GetStatus(), err)
+	}
+
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "other"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Check(other) error = %v, want NotFound", err)
+	}
+}
+
+func TestGRPCHealth_Watch(t *testing.T) {
+	prevConfig, prevErr := platformConfig, startupRegistryCheckError()
+	t.Cleanup(func() {
+		platformConfig = prevConfig
+		setStartupRegistryCheckError(prevErr)
+	})
+	platformConfig = nil
+	setStartupRegistryCheckError(nil)
+	client := newHealthClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Watch() first = %v, %v; want SERVING", resp.GetStatus(), err)
+	}
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.GetStatus() != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		t.Errorf("Watch(other) = %v, %v; want SERVICE_UNKNOWN", resp.GetStatus(), err)
+	}
+}
@@ -2,63 +2,457 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/scheme/reg"
+	"github.com/regclient/regclient/types/descriptor"
+	"github.com/regclient/regclient/types/errs"
 	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/mediatype"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/platform"
 	"github.com/regclient/regclient/types/ref"
 )
 
 const (
 	registryRequestTimeout = 10 * time.Second
 	cacheSuccessTTL        = 24 * time.Hour
-	cacheFailureTTL        = 5 * time.Minute
-	cacheNegativeTTL       = 6 * time.Hour
+	// cacheFailureTTLDefault, cacheParseErrorTTLDefault,
+	// cacheNegativeTTLDefault, and cacheNoRunnableTTLDefault are the defaults
+	// of the corresponding TTLs.
+	cacheFailureTTLDefault    = 5 * time.Minute
+	cacheParseErrorTTLDefault = 5 * time.Minute
+	cacheNegativeTTLDefault   = 6 * time.Hour
+	cacheNoRunnableTTLDefault = time.Hour
+	cacheTTLJitterDefault     = 0.1
+
+	registryMaxConcurrencyDefault = 8
+	maxIndexEntriesDefault        = 1000
+
+	// defaultImageTag is the tag assumed for image references without one.
+	defaultImageTag = "latest"
+
+	// dockerReferenceTypeAnnotation and dockerReferenceTypeAttestation mark the
+	// attestation entries buildx adds to image indexes.
+	dockerReferenceTypeAnnotation  = "vnd.docker.reference.type"
+	dockerReferenceTypeAttestation = "attestation-manifest"
 )
 
+// errNotRunnableImage is returned for references to OCI artifacts, such as Helm
+// charts or SBOMs, that no container runtime can run.
+var errNotRunnableImage = errors.New("reference is an OCI artifact, not a runnable image")
+
+// errSingleManifest is returned by GetManifest for images with a single
+// manifest rather than an index, whose platform is read from the image config.
+var errSingleManifest = errors.New("image has no manifest list")
+
+// errUnreadablePlatforms is returned when a fetched manifest or image config
+// does not yield a platform list, as opposed to a failed fetch.
+var errUnreadablePlatforms = errors.New("image platforms could not be read")
+
+// errNoRunnablePlatforms is returned for image indexes that list no runnable
+// platform, e.g. ones holding only buildx attestation manifests.
+var errNoRunnablePlatforms = errors.New("image index has no runnable platforms")
+
+// errIndexTooLarge is returned for image indexes listing more than
+// maxIndexEntries manifests.
+var errIndexTooLarge = errors.New("image index exceeds MAX_INDEX_ENTRIES")
+
+// maxIndexEntries is the largest number of manifests an image index may list
+// before it is rejected unprocessed, guarding against hostile registries. Zero
+// disables the limit. It is set at startup from MAX_INDEX_ENTRIES.
+var maxIndexEntries = maxIndexEntriesDefault
+
+// Unsupported results are cached for a TTL depending on why the platform was
+// not found. They are set at startup from CACHE_FAILURE_TTL,
+// CACHE_PARSE_ERROR_TTL, CACHE_NEGATIVE_TTL, and CACHE_NO_RUNNABLE_TTL.
+var (
+	// cacheFailureTTL applies to lookups that failed, e.g. on a network error,
+	// and are likely to succeed when retried.
+	cacheFailureTTL = cacheFailureTTLDefault
+	// cacheParseErrorTTL applies to manifests and image configs that were
+	// fetched but whose platforms could not be read.
+	cacheParseErrorTTL = cacheParseErrorTTLDefault
+	// cacheNegativeTTL applies to images that definitely lack the platform.
+	cacheNegativeTTL = cacheNegativeTTLDefault
+	// cacheNoRunnableTTL applies to image indexes with no runnable platform,
+	// under either NO_RUNNABLE_PLATFORMS policy.
+	cacheNoRunnableTTL = cacheNoRunnableTTLDefault
+)
+
+const (
+	// noRunnablePlatformsStrip treats an image index with no runnable platform
+	// as supporting none, so the pod loses every platform toleration.
+	noRunnablePlatformsStrip = "strip"
+	// noRunnablePlatformsFailOpen treats such an index as supporting every
+	// platform, leaving the decision to the other images in the pod.
+	noRunnablePlatformsFailOpen = "fail-open"
+)
+
+// noRunnablePlatformsPolicy is how lookups answer for image indexes with no
+// runnable platform. It is set at startup from NO_RUNNABLE_PLATFORMS.
+var noRunnablePlatformsPolicy = noRunnablePlatformsStrip
+
+// cacheStaleWindow is how long a supported result is still served after
+// cacheSuccessTTL while it is refreshed in the background. Zero disables
+// stale-while-revalidate. It is set at startup from CACHE_STALE_WHILE_REVALIDATE.
+var cacheStaleWindow time.Duration
+
+// cacheTTLJitter is the fraction by which success and negative cache TTLs are
+// randomly lengthened or shortened, so entries created together do not all
+// expire together. It is set at startup from CACHE_TTL_JITTER.
+var cacheTTLJitter = cacheTTLJitterDefault
+
+// mutableTagTTL caps the success and negative cache TTLs for references not
+// pinned by digest, whose tag may be repushed with different platforms. Zero
+// disables the cap. It is set at startup from MUTABLE_TAG_TTL.
+var mutableTagTTL time.Duration
+
+// cacheKeyPrefix is prepended to every cache key, so changing it starts a
+// fresh keyspace in a shared cache. It is set at startup from CACHE_KEY_PREFIX
+// and CACHE_VERSION.
+var cacheKeyPrefix string
+
+// cacheRevalidations holds the cache keys with a background refresh in flight.
+var cacheRevalidations sync.Map
+
+// trustedMultiarchRegistries holds registry hosts whose images are assumed to
+// support every configured platform. Entries are exact hosts or `*.`-prefixed
+// domain suffixes. It is set at startup from TRUSTED_MULTIARCH_REGISTRIES.
+var trustedMultiarchRegistries []string
+
+// imagePlatformOverrides pins the supported platforms of images matching a glob
+// pattern, in place of a registry lookup. It is set at startup from
+// IMAGE_PLATFORM_OVERRIDES.
+var imagePlatformOverrides []imagePlatformOverride
+
+// imagePlatformOverride lists the platforms assumed for images matching Pattern,
+// a path.Match glob compared against both the image as written and its
+// normalized reference.
+type imagePlatformOverride struct {
+	Pattern   string
+	Platforms []string
+}
+
+// indexPlatformsAnnotation is the image index annotation key whose
+// comma-separated value, when present, lists the image's platforms in place of
+// its index entries. Empty disables the lookup. It is set at startup from
+// INDEX_PLATFORMS_ANNOTATION.
+var indexPlatformsAnnotation string
+
+// defaultRegistry is the registry that image names without one resolve to in
+// place of Docker Hub, e.g. a mirror in an air-gapped cluster. Empty keeps
+// Docker Hub. It is set at startup from DEFAULT_REGISTRY.
+var defaultRegistry string
+
+// registrySlots bounds the number of manifest fetches in flight across all
+// admission requests handled by this process. It is replaced at startup from
+// REGISTRY_MAX_CONCURRENCY.
+var registrySlots = make(chan struct{}, registryMaxConcurrencyDefault)
+
+// acquireRegistrySlot blocks until a registry concurrency slot is free or ctx is
+// done. The returned function releases the slot.
+func acquireRegistrySlot(ctx context.Context) (func(), error) {
+	slots := registrySlots
+	select {
+	case slots <- struct{}{}:
+		registryRequestsInFlight.Inc()
+		return func() {
+			<-slots
+			registryRequestsInFlight.Dec()
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// version is the build version, set with -ldflags "-X main.version=...".
+var version = "dev"
+
+// registryUserAgent is the User-Agent sent on registry requests so registry
+// operators can identify webhook traffic. It is set at startup from
+// REGISTRY_USER_AGENT.
+var registryUserAgent = defaultRegistryUserAgent()
+
+// defaultRegistryUserAgent returns the User-Agent used when REGISTRY_USER_AGENT
+// is unset.
+func defaultRegistryUserAgent() string {
+	return "k8smultiarcher/" + version
+}
+
 func newRegClient(hosts []config.Host) *regclient.RegClient {
-	if len(hosts) == 0 {
-		return regclient.New()
+	opts := []regclient.Opt{regclient.WithUserAgent(registryUserAgent)}
+	if len(hosts) > 0 {
+		opts = append(opts, regclient.WithConfigHost(hosts...))
 	}
-	return regclient.New(regclient.WithConfigHost(hosts...))
+	if registryTransport != nil {
+		// regclient adjusts the TLS settings of the transport it is given, so
+		// each client gets its own copy.
+		opts = append(opts, regclient.WithRegOpts(reg.WithTransport(registryTransport.Clone())))
+	}
+	return regclient.New(opts...)
 }
 
-func GetManifest(ctx context.Context, name string, hosts []config.Host) (manifest.Manifest, error) {
+// GetManifest fetches the manifest list for the image reference r. A
+// single-platform manifest is returned along with errSingleManifest, for
+// GetImageConfigPlatform to read without resolving r again.
+func GetManifest(ctx context.Context, r ref.Ref, hosts []config.Host) (manifest.Manifest, error) {
 	rc := newRegClient(hosts)
-	ref, err := ref.New(name)
+	name := r.CommonName()
+
+	var m manifest.Manifest
+	err := withRegistryAccess(ctx, r, func(ctx context.Context) error {
+		var err error
+		m, err = headThenGetManifest(ctx, rc, r)
+		if err != nil {
+			slog.Error("failed to get manifest", "image", name, "error", err)
+		}
+		return err
+	})
 	if err != nil {
-		slog.Error("failed to parse image name", "image", name, "error", err)
 		return nil, err
 	}
 
+	if artifactType := manifestArtifactType(m); artifactType != "" {
+		slog.Warn("image reference is an OCI artifact, not a runnable image",
+			"image", name,
+			"artifactType", artifactType,
+		)
+		return nil, fmt.Errorf("%w: %s", errNotRunnableImage, artifactType)
+	}
+	if !m.IsList() {
+		slog.Debug("image has no manifest list", "image", name)
+		return m, errSingleManifest
+	}
+	if indexer, ok := m.(manifest.Indexer); ok && maxIndexEntries > 0 {
+		if entries, err := indexer.GetManifestList(); err == nil && len(entries) > maxIndexEntries {
+			slog.Error("rejecting oversized image index", "image", name, "entries", len(entries), "max", maxIndexEntries)
+			return nil, fmt.Errorf("%w: %d entries, limit %d", errIndexTooLarge, len(entries), maxIndexEntries)
+		}
+	}
+	slog.Info("got manifest", "image", name)
+	return m, nil
+}
+
+// GetImageConfigPlatform returns the platform recorded in the image config
+// blob of the single-platform image r, whose manifest m was returned by
+// GetManifest. The manifest descriptor of a single image often carries no
+// platform, but its config always names the OS and architecture. When m came
+// from a HEAD request its body is fetched by digest, so a tag moved since is
+// not followed.
+func GetImageConfigPlatform(
+	ctx context.Context, r ref.Ref, m manifest.Manifest, hosts []config.Host,
+) (platform.Platform, error) {
+	rc := newRegClient(hosts)
+	var p platform.Platform
+	err := withRegistryAccess(ctx, r, func(ctx context.Context) error {
+		if !m.IsSet() {
+			var err error
+			m, err = rc.ManifestGet(ctx, r.SetDigest(m.GetDescriptor().Digest.String()))
+			if err != nil {
+				return err
+			}
+		}
+		imager, ok := m.(manifest.Imager)
+		if !ok {
+			return fmt.Errorf("%w: unsupported manifest type: %s", errUnreadablePlatforms, m.GetDescriptor().MediaType)
+		}
+		configDesc, err := imager.GetConfig()
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUnreadablePlatforms, err)
+		}
+		cfg, err := rc.BlobGetOCIConfig(ctx, r, configDesc)
+		if err != nil {
+			return err
+		}
+		p = cfg.GetConfig().Platform
+		return nil
+	})
+	if err != nil {
+		return platform.Platform{}, err
+	}
+	if p.OS == "" || p.Architecture == "" {
+		return platform.Platform{}, fmt.Errorf("%w: image config names no platform", errUnreadablePlatforms)
+	}
+	slog.Info("got image config platform", "image", r.CommonName(), "platform", p.String())
+	return p, nil
+}
+
+// withRegistryAccess runs fn against r's registry once its circuit breaker,
+// rate limit, and a concurrency slot allow it, bounding fn with
+// registryRequestTimeout when ctx has no deadline. The outcome of fn feeds the
+// circuit breaker.
+func withRegistryAccess(ctx context.Context, r ref.Ref, fn func(context.Context) error) error {
+	name := r.CommonName()
+	if !registryBreaker.Allow(r.Registry) {
+		slog.Warn("skipping manifest lookup, registry circuit breaker is open",
+			"image", name,
+			"registry", r.Registry,
+		)
+		return errRegistryCircuitOpen
+	}
+
 	// Only add timeout if the context doesn't already have a deadline
 	if _, ok := ctx.Deadline(); !ok {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, registryRequestTimeout)
 		defer cancel()
 	}
-	m, err := rc.ManifestGet(ctx, ref)
+
+	// Wait for the rate limiter before taking a concurrency slot, so lookups
+	// against a throttled registry do not starve those against other registries.
+	if err := waitForRegistryRateLimit(ctx, r.Registry); err != nil {
+		slog.Error("timed out waiting for the registry rate limit", "image", name, "registry", r.Registry, "error", err)
+		return err
+	}
+
+	release, err := acquireRegistrySlot(ctx)
 	if err != nil {
-		slog.Error("failed to get manifest", "image", name, "error", err)
-		return nil, err
+		slog.Error("timed out waiting for a registry concurrency slot", "image", name, "error", err)
+		return err
 	}
+	defer release()
 
-	if !m.IsList() {
-		err := fmt.Errorf("provided image name has no manifest list")
-		slog.Error("image has no manifest list", "image", name, "error", err)
-		return nil, err
+	err = fn(ctx)
+	recordRegistryResult(r.Registry, err)
+	return err
+}
+
+// headThenGetManifest resolves r with a HEAD request and only downloads the
+// manifest body when the HEAD shows it is an index, fetching it by digest. A
+// single-platform manifest is returned body-less, since its media type is
+// enough to know it has no platform list. Registries that reject HEAD with an
+// error status, or omit the media type or digest, fall back to a plain GET.
+func headThenGetManifest(ctx context.Context, rc *regclient.RegClient, r ref.Ref) (manifest.Manifest, error) {
+	head, err := rc.ManifestHead(ctx, r)
+	if err != nil {
+		// Only an unexpected HTTP error status suggests the registry rejects HEAD;
+		// network errors, not-found, auth, and rate limits would fail a GET too.
+		if !errors.Is(err, errs.ErrHTTPStatus) || errors.Is(err, errs.ErrNotFound) ||
+			errors.Is(err, errs.ErrHTTPUnauthorized) || errors.Is(err, errs.ErrHTTPRateLimit) {
+			return nil, err
+		}
+		slog.Debug("manifest HEAD failed, falling back to GET", "image", r.CommonName(), "error", err)
+		return rc.ManifestGet(ctx, r)
 	}
-	slog.Info("got manifest", "image", name)
-	return m, nil
+
+	desc := head.GetDescriptor()
+	if desc.MediaType == "" || desc.Digest == "" {
+		return rc.ManifestGet(ctx, r)
+	}
+	// An OCI image manifest may describe an artifact such as a Helm chart,
+	// which only its body reveals. Other single manifests are returned as-is.
+	if !head.IsList() && desc.MediaType != mediatype.OCI1Manifest {
+		return head, nil
+	}
+	return rc.ManifestGet(ctx, r.SetDigest(desc.Digest.String()))
+}
+
+// manifestArtifactType returns the artifact type of a manifest that describes
+// an OCI artifact, such as a Helm chart or SBOM, rather than a runnable image.
+// It returns "" for images and for manifests fetched without a body.
+func manifestArtifactType(m manifest.Manifest) string {
+	if m.GetDescriptor().MediaType == mediatype.OCI1Artifact {
+		return mediatype.OCI1Artifact
+	}
+	imager, ok := m.(manifest.Imager)
+	if !ok {
+		return ""
+	}
+	cfg, err := imager.GetConfig()
+	if err != nil {
+		return ""
+	}
+	switch cfg.MediaType {
+	case mediatype.OCI1ImageConfig, mediatype.Docker2ImageConfig:
+		return ""
+	}
+	if orig, ok := m.GetOrig().(v1.Manifest); ok && orig.ArtifactType != "" {
+		return orig.ArtifactType
+	}
+	return cfg.MediaType
+}
+
+// recordRegistryResult feeds a manifest fetch outcome into the circuit breaker.
+// Not-found and unauthorized responses, and content whose platforms could not
+// be read, show the registry is reachable, so they count as successes.
+func recordRegistryResult(registry string, err error) {
+	if err == nil || errors.Is(err, errs.ErrNotFound) || errors.Is(err, errs.ErrHTTPUnauthorized) ||
+		errors.Is(err, errUnreadablePlatforms) {
+		registryBreaker.RecordSuccess(registry)
+		return
+	}
+	registryBreaker.RecordFailure(registry)
 }
 
 func DoesImageSupportArm64(ctx context.Context, cache Cache, name string, hosts []config.Host) bool {
 	return DoesImageSupportPlatform(ctx, cache, name, "linux/arm64", hosts)
 }
 
+// imageCacheKey returns the cache key for an image/platform support result.
+// The image name is normalized first, so equivalent references such as
+// `nginx:latest` and `docker.io/library/nginx:latest` share an entry. Names
+// that fail to parse are used as-is.
+func imageCacheKey(name, platform string) string {
+	r, err := parseImageRef(name)
+	if err != nil {
+		return cacheKeyPrefix + name + ":" + platform
+	}
+	return refCacheKey(r, platform)
+}
+
+// parseImageRef parses an image name into a reference. An image with neither a
+// tag nor a digest is given the `latest` tag, matching what the container
+// runtime pulls, so `nginx` and `nginx:latest` resolve to the same reference.
+// Names without a registry resolve against defaultRegistry when it is set.
+func parseImageRef(name string) (ref.Ref, error) {
+	r, err := ref.New(withDefaultRegistry(name))
+	if err != nil {
+		return r, err
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r = r.SetTag(defaultImageTag)
+	}
+	return r, nil
+}
+
+// withDefaultRegistry prefixes name with defaultRegistry when the name does not
+// name a registry and would otherwise resolve to Docker Hub, adding the
+// `library/` namespace for official images: with a default registry of
+// `mirror.example.com`, `nginx` becomes `mirror.example.com/library/nginx`.
+// A registry is named, as in the Docker reference grammar, when the first path
+// component contains a `.` or `:` or is `localhost`.
+func withDefaultRegistry(name string) string {
+	if defaultRegistry == "" {
+		return name
+	}
+	first, _, found := strings.Cut(name, "/")
+	if !found {
+		return defaultRegistry + "/library/" + name
+	}
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return name
+	}
+	return defaultRegistry + "/" + name
+}
+
+// refCacheKey returns the cache key for a parsed image reference and platform.
+func refCacheKey(r ref.Ref, platform string) string {
+	return cacheKeyPrefix + r.CommonName() + ":" + platform
+}
+
 // DoesImageSupportPlatform checks if an image supports a specific platform
 func DoesImageSupportPlatform(
 	ctx context.Context,
@@ -67,31 +461,448 @@ func DoesImageSupportPlatform(
 	platform string,
 	hosts []config.Host,
 ) bool {
-	cacheKey := name + ":" + platform
+	r, err := parseImageRef(name)
+	if err != nil {
+		slog.Error("failed to parse image name", "image", name, "error", err)
+		return false
+	}
+	if platforms, ok := overriddenImagePlatforms(name, r); ok {
+		slog.Debug("using platform override for image", "image", name, "platform", platform, "platforms", platforms)
+		return slices.ContainsFunc(platforms, func(p string) bool { return platformsMatch(p, platform) })
+	}
+	return DoesImageRefSupportPlatform(ctx, cache, r, platform, hosts)
+}
+
+// DoesImageRefSupportPlatform checks if the parsed image reference r supports a
+// specific platform, caching the result under the normalized reference. Cached
+// results are ignored for contexts returned by withCacheBypass.
+func DoesImageRefSupportPlatform(
+	ctx context.Context,
+	cache Cache,
+	r ref.Ref,
+	platform string,
+	hosts []config.Host,
+) bool {
+	if isTrustedMultiarchRegistry(r.Registry) {
+		slog.Debug("assuming platform support for trusted registry", "image", r.CommonName(), "platform", platform)
+		return true
+	}
+
+	cacheKey := refCacheKey(r, platform)
+	if cacheBypassed(ctx) {
+		slog.Debug("bypassing cache for image lookup", "image", r.CommonName(), "platform", platform)
+		return lookupImagePlatform(ctx, cache, r, platform, hosts)
+	}
 	if val, ok := cache.Get(cacheKey); ok {
+		if val && cacheStaleWindow > 0 {
+			if _, fresh := cache.Get(freshCacheKey(cacheKey)); !fresh {
+				revalidateImagePlatform(ctx, cache, r, platform, hosts)
+			}
+		}
 		return val
 	}
 
-	m, err := GetManifest(ctx, name, hosts)
+	return lookupImagePlatform(ctx, cache, r, platform, hosts)
+}
+
+// cacheBypassKey is the context key marking lookups that must skip cached
+// results.
+type cacheBypassKey struct{}
+
+// withCacheBypass returns a context in which DoesImageRefSupportPlatform ignores
+// cached results and fetches the manifest, still caching the fresh result.
+func withCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+// cacheBypassed reports whether ctx was returned by withCacheBypass.
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+// lookupImagePlatform fetches the image manifest, caches whether it supports
+// platform, and returns the result. Supported results are cached for
+// cacheSuccessTTL; unsupported ones for cacheFailureTTL when the lookup failed,
+// cacheParseErrorTTL when the platforms could not be read, and
+// cacheNegativeTTL when the image definitely lacks the platform. Indexes with
+// no runnable platform are cached for cacheNoRunnableTTL, as supported or not
+// according to noRunnablePlatformsPolicy.
+func lookupImagePlatform(
+	ctx context.Context,
+	cache Cache,
+	r ref.Ref,
+	platform string,
+	hosts []config.Host,
+) bool {
+	cacheKey := refCacheKey(r, platform)
+	name := r.CommonName()
+	supported, err := imageSupportsPlatform(ctx, r, platform, hosts)
+	if errors.Is(err, errRegistryCircuitOpen) {
+		// Not cached, so the image is looked up again once the registry recovers.
+		return false
+	}
+	if errors.Is(err, errNotRunnableImage) {
+		// Not cached as a platform mismatch, since no platform could run it.
+		return false
+	}
+	if errors.Is(err, errNoRunnablePlatforms) {
+		// Logged apart from unreadable platforms: the index parsed, but every
+		// entry is an attestation or lacks a platform.
+		failOpen := noRunnablePlatformsPolicy == noRunnablePlatformsFailOpen
+		slog.Warn("image index has no runnable platforms",
+			"image", name, "platform", platform, "policy", noRunnablePlatformsPolicy)
+		cache.Set(cacheKey, failOpen, cacheNoRunnableTTL)
+		return failOpen
+	}
+	if errors.Is(err, errUnreadablePlatforms) {
+		// The registry answered, but retrying soon only helps if the image is
+		// repushed, so this is cached apart from transient failures.
+		slog.Error("failed to read platforms for image", "image", name, "error", err)
+		cache.Set(cacheKey, false, cacheParseErrorTTL)
+		return false
+	}
 	if err != nil {
-		slog.Error("failed to get manifest", "image", name, "error", err)
+		slog.Error("failed to get platforms for image", "image", name, "error", err)
 		cache.Set(cacheKey, false, cacheFailureTTL)
+		if errors.Is(err, errs.ErrHTTPUnauthorized) {
+			// Recorded separately so ON_AUTH_ERROR can tell a lookup that was
+			// refused apart from an image that lacks the platform.
+			cache.Set(authFailedCacheKey(cacheKey), true, cacheFailureTTL)
+		}
 		return false
 	}
 
-	platforms, err := manifest.GetPlatformList(m)
+	cacheDefinitiveResult(cache, r, platform, supported)
+	return supported
+}
+
+// cacheDefinitiveResult caches a lookup that completed, as a success for
+// cacheSuccessTTL or a negative for cacheNegativeTTL.
+func cacheDefinitiveResult(cache Cache, r ref.Ref, platform string, supported bool) {
+	cacheKey := refCacheKey(r, platform)
+	if supported {
+		setCachedSuccess(cache, cacheKey, cacheTTLForRef(r, cacheSuccessTTL))
+		return
+	}
+	cache.Set(cacheKey, false, cacheTTLForRef(r, cacheNegativeTTL))
+}
+
+// imageSupportsPlatform reports whether the image r supports want, reading the
+// platform of a single-manifest image from its config blob.
+func imageSupportsPlatform(ctx context.Context, r ref.Ref, want string, hosts []config.Host) (bool, error) {
+	m, err := GetManifest(ctx, r, hosts)
+	if errors.Is(err, errSingleManifest) {
+		p, err := GetImageConfigPlatform(ctx, r, m, hosts)
+		if err != nil {
+			return false, err
+		}
+		return platformSatisfies(p, want), nil
+	}
 	if err != nil {
-		slog.Error("failed to get platforms for manifest", "image", name, "error", err)
-		cache.Set(cacheKey, false, cacheFailureTTL)
-		return false
+		return false, err
+	}
+	supported, err := manifestSupportsPlatform(m, want)
+	if errors.Is(err, errNoRunnablePlatforms) {
+		return false, err
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", errUnreadablePlatforms, err)
+	}
+	return supported, nil
+}
+
+// cacheTTLForRef returns the TTL for caching a result for r: ttl, capped at
+// mutableTagTTL when r is not pinned by digest, with jitter applied.
+func cacheTTLForRef(r ref.Ref, ttl time.Duration) time.Duration {
+	if mutableTagTTL > 0 && r.Digest == "" && ttl > mutableTagTTL {
+		ttl = mutableTagTTL
+	}
+	return jitterTTL(ttl, cacheTTLJitter)
+}
+
+// setCachedSuccess caches a supported result for ttl. With
+// stale-while-revalidate enabled the value is kept for an extra
+// cacheStaleWindow, and a separate marker key records when it goes stale.
+func setCachedSuccess(cache Cache, cacheKey string, ttl time.Duration) {
+	if cacheStaleWindow <= 0 {
+		cache.Set(cacheKey, true, ttl)
+		return
+	}
+	cache.Set(cacheKey, true, ttl+cacheStaleWindow)
+	cache.Set(freshCacheKey(cacheKey), true, ttl)
+}
+
+// jitterTTL returns ttl randomly adjusted by up to ±jitter of its length. A
+// jitter of zero returns ttl unchanged.
+func jitterTTL(ttl time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(float64(ttl)*jitter*(2*rand.Float64()-1))
+}
+
+// freshCacheKey returns the key of the marker recording that the success entry
+// at cacheKey has not yet gone stale.
+func freshCacheKey(cacheKey string) string {
+	return markerCacheKey("fresh:", cacheKey)
+}
+
+// authFailedCacheKey returns the key of the marker recording that the failure
+// cached at cacheKey was an authentication error.
+func authFailedCacheKey(cacheKey string) string {
+	return markerCacheKey("authfailed:", cacheKey)
+}
+
+// markerCacheKey returns the key of a marker of kind for cacheKey, keeping
+// cacheKeyPrefix first so FlushAll deletes the marker with its entry.
+func markerCacheKey(kind, cacheKey string) string {
+	return cacheKeyPrefix + kind + strings.TrimPrefix(cacheKey, cacheKeyPrefix)
+}
+
+// imageLookupAuthFailed reports whether the last lookup of name for platform
+// failed because the registry rejected our credentials.
+func imageLookupAuthFailed(cache Cache, name, platform string) bool {
+	_, failed := cache.Get(authFailedCacheKey(imageCacheKey(name, platform)))
+	return failed
+}
+
+// revalidateImagePlatform refreshes a stale cache entry in the background,
+// starting at most one refresh per entry at a time. The refresh is detached
+// from the admission request so it outlives it. Only a definitive result
+// replaces the entry; a failed refresh leaves the stale success in place rather
+// than caching the image as unsupported.
+func revalidateImagePlatform(
+	ctx context.Context,
+	cache Cache,
+	r ref.Ref,
+	platform string,
+	hosts []config.Host,
+) {
+	cacheKey := refCacheKey(r, platform)
+	if _, running := cacheRevalidations.LoadOrStore(cacheKey, struct{}{}); running {
+		return
 	}
+	slog.Debug("serving stale cache entry while revalidating", "image", r.CommonName(), "platform", platform)
+	go func() {
+		defer cacheRevalidations.Delete(cacheKey)
+		supported, err := imageSupportsPlatform(context.WithoutCancel(ctx), r, platform, hosts)
+		if err != nil {
+			slog.Warn("failed to revalidate stale cache entry, keeping it",
+				"image", r.CommonName(), "platform", platform, "error", err)
+			return
+		}
+		cacheDefinitiveResult(cache, r, platform, supported)
+	}()
+}
 
-	for _, pl := range platforms {
-		if pl.String() == platform {
-			cache.Set(cacheKey, true, cacheSuccessTTL)
+// parseTrustedRegistries splits a comma-separated TRUSTED_MULTIARCH_REGISTRIES
+// value into lower-cased registry host patterns.
+func parseTrustedRegistries(value string) []string {
+	registries := []string{}
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			registries = append(registries, host)
+		}
+	}
+	return registries
+}
+
+// isTrustedMultiarchRegistry reports whether registry matches an entry in
+// trustedMultiarchRegistries, either exactly or by a `*.` domain suffix.
+func isTrustedMultiarchRegistry(registry string) bool {
+	registry = strings.ToLower(registry)
+	for _, trusted := range trustedMultiarchRegistries {
+		if suffix, ok := strings.CutPrefix(trusted, "*"); ok {
+			if strings.HasSuffix(registry, suffix) {
+				return true
+			}
+			continue
+		}
+		if registry == trusted {
 			return true
 		}
 	}
-	cache.Set(cacheKey, false, cacheNegativeTTL)
 	return false
 }
+
+// parseImagePlatformOverrides parses IMAGE_PLATFORM_OVERRIDES, a JSON object
+// mapping image glob patterns to the platforms those images support. Entries
+// are returned sorted by pattern.
+func parseImagePlatformOverrides(value string) ([]imagePlatformOverride, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid IMAGE_PLATFORM_OVERRIDES JSON: %w", err)
+	}
+	overrides := []imagePlatformOverride{}
+	for _, pattern := range slices.Sorted(maps.Keys(raw)) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid IMAGE_PLATFORM_OVERRIDES pattern %q: %w", pattern, err)
+		}
+		for _, p := range raw[pattern] {
+			if _, err := parsePlatform(p); err != nil {
+				return nil, fmt.Errorf("invalid IMAGE_PLATFORM_OVERRIDES platform %q for %q: %w", p, pattern, err)
+			}
+		}
+		overrides = append(overrides, imagePlatformOverride{Pattern: pattern, Platforms: raw[pattern]})
+	}
+	return overrides, nil
+}
+
+// overriddenImagePlatforms returns the platforms imagePlatformOverrides pins for
+// the image name, whose parsed reference is r. A pattern equal to the image
+// wins over globs; among globs the longest matching pattern wins.
+func overriddenImagePlatforms(name string, r ref.Ref) ([]string, bool) {
+	if len(imagePlatformOverrides) == 0 {
+		return nil, false
+	}
+	names := []string{name, r.CommonName()}
+	var best *imagePlatformOverride
+	for i, o := range imagePlatformOverrides {
+		if slices.Contains(names, o.Pattern) {
+			return o.Platforms, true
+		}
+		if best != nil && len(o.Pattern) <= len(best.Pattern) {
+			continue
+		}
+		if slices.ContainsFunc(names, func(n string) bool {
+			matched, _ := path.Match(o.Pattern, n)
+			return matched
+		}) {
+			best = &imagePlatformOverrides[i]
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best.Platforms, true
+}
+
+// manifestSupportsPlatform reports whether the manifest list contains an entry
+// for the given platform. When indexPlatformsAnnotation is set and the index
+// carries that annotation, its platform list is used instead of the entries.
+func manifestSupportsPlatform(m manifest.Manifest, want string) (bool, error) {
+	if annotated, ok := annotatedPlatforms(m); ok {
+		return slices.ContainsFunc(annotated, func(p string) bool { return platformsMatch(p, want) }), nil
+	}
+
+	indexer, ok := m.(manifest.Indexer)
+	if !ok {
+		return false, fmt.Errorf("unsupported manifest type: %s", m.GetDescriptor().MediaType)
+	}
+	descriptors, err := indexer.GetManifestList()
+	if err != nil {
+		return false, fmt.Errorf("failed to get manifest list: %w", err)
+	}
+	runnable := false
+	for _, d := range descriptors {
+		if d.Platform == nil || isAttestationDescriptor(d) {
+			continue
+		}
+		runnable = true
+		if platformSatisfies(*d.Platform, want) {
+			return true, nil
+		}
+	}
+	if !runnable {
+		return false, errNoRunnablePlatforms
+	}
+	return false, nil
+}
+
+// isAttestationDescriptor reports whether an index entry is a buildx
+// provenance or SBOM attestation rather than a runnable image. Buildx marks
+// these with the vnd.docker.reference.type annotation and an unknown/unknown
+// platform.
+func isAttestationDescriptor(d descriptor.Descriptor) bool {
+	if d.Annotations[dockerReferenceTypeAnnotation] == dockerReferenceTypeAttestation {
+		return true
+	}
+	return d.Platform != nil && d.Platform.OS == "unknown" && d.Platform.Architecture == "unknown"
+}
+
+// annotatedPlatforms returns the comma-separated platforms listed in the
+// index's indexPlatformsAnnotation annotation. It returns false when the option
+// is off or the annotation is absent or empty.
+func annotatedPlatforms(m manifest.Manifest) ([]string, bool) {
+	if indexPlatformsAnnotation == "" {
+		return nil, false
+	}
+	annotator, ok := m.(manifest.Annotator)
+	if !ok {
+		return nil, false
+	}
+	annotations, err := annotator.GetAnnotations()
+	if err != nil {
+		return nil, false
+	}
+	platforms := parsePlatformList(annotations[indexPlatformsAnnotation])
+	return platforms, len(platforms) > 0
+}
+
+// platformsMatch reports whether the platform have satisfies want. Both are
+// OCI platform strings, optionally followed by "+feature" suffixes such as
+// "linux/amd64/v3+avx512f", and are compared after normalization so that
+// equivalent spellings such as "linux/arm64/v8" and "linux/arm64" match.
+func platformsMatch(have, want string) bool {
+	h, err := parsePlatform(have)
+	if err != nil {
+		return normalizePlatform(have) == normalizePlatform(want)
+	}
+	return platformSatisfies(h, want)
+}
+
+// platformSatisfies reports whether have satisfies the platform string want.
+// The OS and architecture must match. A variant or features are only checked
+// when want specifies them, so "linux/amd64" matches any amd64 entry while
+// "linux/amd64/v3+avx512f" requires the v3 variant and the avx512f feature.
+func platformSatisfies(have platform.Platform, want string) bool {
+	w, err := parsePlatform(want)
+	if err != nil {
+		return have.String() == want
+	}
+	if n, err := platform.Parse(have.String()); err == nil {
+		n.Features = have.Features
+		have = n
+	}
+	if have.OS != w.OS || have.Architecture != w.Architecture {
+		return false
+	}
+	if w.Variant != "" && have.Variant != w.Variant {
+		return false
+	}
+	for _, f := range w.Features {
+		if !slices.Contains(have.Features, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePlatform parses an OCI platform string with optional "+feature"
+// suffixes into a normalized platform.
+func parsePlatform(s string) (platform.Platform, error) {
+	base, features, _ := strings.Cut(s, "+")
+	p, err := platform.Parse(base)
+	if err != nil {
+		return platform.Platform{}, err
+	}
+	if features != "" {
+		p.Features = strings.Split(features, "+")
+	}
+	return p, nil
+}
+
+// normalizePlatform returns the canonical form of an OCI platform string. Values
+// that fail to parse are returned unchanged so they can still match exactly.
+func normalizePlatform(s string) string {
+	p, err := platform.Parse(s)
+	if err != nil {
+		return s
+	}
+	return p.String()
+}
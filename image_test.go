@@ -2,13 +2,30 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types/errs"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/ref"
 )
 
 func TestDoesImageSupportArm64(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
-	cache.Set("image_with_arm_support:linux/arm64", true, 0)
-	cache.Set("image_without_arm_support:linux/arm64", false, 0)
+	cache.Set(imageCacheKey("image_with_arm_support", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("image_without_arm_support", "linux/arm64"), false, 0)
 
 	type args struct {
 		cache Cache
@@ -47,10 +64,10 @@ func TestDoesImageSupportArm64(t *testing.T) {
 
 func TestDoesImageSupportPlatform(t *testing.T) {
 	cache := NewInMemoryCache(cacheSizeDefault)
-	cache.Set("multi_arch_image:linux/arm64", true, 0)
-	cache.Set("multi_arch_image:linux/amd64", true, 0)
-	cache.Set("arm_only_image:linux/arm64", true, 0)
-	cache.Set("arm_only_image:linux/amd64", false, 0)
+	cache.Set(imageCacheKey("multi_arch_image", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("multi_arch_image", "linux/amd64"), true, 0)
+	cache.Set(imageCacheKey("arm_only_image", "linux/arm64"), true, 0)
+	cache.Set(imageCacheKey("arm_only_image", "linux/amd64"), false, 0)
 
 	type args struct {
 		cache    Cache
@@ -114,3 +131,1158 @@ func TestDoesImageSupportPlatform(t *testing.T) {
 		})
 	}
 }
+
+// testIndex is an OCI image index whose arm64 entry carries the "v8" variant.
+const testIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+      "size": 100,
+      "platform": {"os": "linux", "architecture": "amd64"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+      "size": 100,
+      "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}
+    }
+  ]
+}`
+
+// testFeaturedIndex is an OCI image index whose only entry is an amd64 image
+// built for the v3 microarchitecture level with the avx512f CPU feature.
+const testFeaturedIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:5555555555555555555555555555555555555555555555555555555555555555",
+      "size": 100,
+      "platform": {"os": "linux", "architecture": "amd64", "variant": "v3", "features": ["avx512f"]}
+    }
+  ]
+}`
+
+// testBuildxIndex is an image index as pushed by docker buildx with provenance
+// enabled: one entry per platform plus an attestation manifest for each.
+const testBuildxIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+      "size": 1234,
+      "platform": {"architecture": "amd64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+      "size": 1234,
+      "platform": {"architecture": "arm64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+      "size": 566,
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+        "vnd.docker.reference.type": "attestation-manifest"
+      },
+      "platform": {"architecture": "unknown", "os": "unknown"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd",
+      "size": 566,
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+        "vnd.docker.reference.type": "attestation-manifest"
+      },
+      "platform": {"architecture": "unknown", "os": "unknown"}
+    }
+  ]
+}`
+
+// testAttestationOnlyIndex is an image index whose only entry is a buildx
+// attestation manifest, leaving no platform to run.
+const testAttestationOnlyIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc",
+      "size": 566,
+      "annotations": {
+        "vnd.docker.reference.digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+        "vnd.docker.reference.type": "attestation-manifest"
+      },
+      "platform": {"architecture": "unknown", "os": "unknown"}
+    }
+  ]
+}`
+
+// testHelmChartManifest is an OCI image manifest describing a Helm chart.
+const testHelmChartManifest = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {
+    "mediaType": "application/vnd.cncf.helm.config.v1+json",
+    "digest": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+    "size": 100
+  },
+  "layers": [
+    {
+      "mediaType": "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+      "digest": "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+      "size": 1000
+    }
+  ]
+}`
+
+func TestManifestSupportsPlatform(t *testing.T) {
+	m, err := manifest.New(manifest.WithRaw([]byte(testIndex)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+
+	tests := []struct {
+		platform string
+		want     bool
+	}{
+		{platform: "linux/arm64", want: true},
+		{platform: "linux/arm64/v8", want: true},
+		{platform: "linux/amd64", want: true},
+		{platform: "linux/arm/v7", want: false},
+		{platform: "linux/s390x", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			got, err := manifestSupportsPlatform(m, tt.platform)
+			if err != nil {
+				t.Fatalf("manifestSupportsPlatform() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("manifestSupportsPlatform(%q) = %v, want %v", tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireRegistrySlot(t *testing.T) {
+	prev := registrySlots
+	registrySlots = make(chan struct{}, 1)
+	t.Cleanup(func() { registrySlots = prev })
+
+	release, err := acquireRegistrySlot(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := acquireRegistrySlot(ctx); err == nil {
+		t.Fatal("expected acquire to fail while the only slot is held")
+	}
+
+	release()
+	release, err = acquireRegistrySlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+	release()
+}
+
+func TestDoesImageSupportPlatform_CircuitOpen(t *testing.T) {
+	prev := registryBreaker
+	registryBreaker = newCircuitBreaker(1, time.Minute, time.Hour)
+	t.Cleanup(func() { registryBreaker = prev })
+	registryBreaker.RecordFailure("registry.example.com")
+
+	cache := NewInMemoryCache(cacheSizeDefault)
+	const image = "registry.example.com/app:v1"
+	if DoesImageSupportPlatform(context.Background(), cache, image, "linux/arm64", nil) {
+		t.Fatal("expected an open circuit to report the platform as unsupported")
+	}
+	if _, ok := cache.Get(imageCacheKey(image, "linux/arm64")); ok {
+		t.Error("expected a short-circuited lookup not to be cached")
+	}
+}
+
+func TestRecordRegistryResult(t *testing.T) {
+	prev := registryBreaker
+	registryBreaker = newCircuitBreaker(1, time.Minute, time.Hour)
+	t.Cleanup(func() { registryBreaker = prev })
+
+	recordRegistryResult("notfound.example.com", fmt.Errorf("manifest: %w", errs.ErrNotFound))
+	recordRegistryResult("unauthorized.example.com", errs.ErrHTTPUnauthorized)
+	recordRegistryResult("down.example.com", context.DeadlineExceeded)
+
+	for registry, want := range map[string]bool{
+		"notfound.example.com":     true,
+		"unauthorized.example.com": true,
+		"down.example.com":         false,
+	} {
+		if got := registryBreaker.Allow(registry); got != want {
+			t.Errorf("Allow(%q) = %v, want %v", registry, got, want)
+		}
+	}
+}
+
+func TestDoesImageSupportPlatform_StaleWhileRevalidate(t *testing.T) {
+	const (
+		registry = "stale.example.com"
+		image    = registry + "/app:v1"
+		platform = "linux/arm64"
+	)
+
+	prevWindow, prevBreaker := cacheStaleWindow, registryBreaker
+	t.Cleanup(func() { cacheStaleWindow, registryBreaker = prevWindow, prevBreaker })
+	cacheStaleWindow = time.Hour
+	// An open circuit makes the background refresh return without a network call
+	// or cache write, and counts each attempt as a short-circuit.
+	registryBreaker = newCircuitBreaker(1, time.Minute, time.Hour)
+	registryBreaker.RecordFailure(registry)
+	shortCircuits := func() float64 {
+		return testutil.ToFloat64(registryCircuitShortCircuits.WithLabelValues(registry))
+	}
+
+	t.Run("fresh entry is not revalidated", func(t *testing.T) {
+		cache := NewInMemoryCache(cacheSizeDefault)
+		setCachedSuccess(cache, imageCacheKey(image, platform), cacheSuccessTTL)
+		before := shortCircuits()
+		if !DoesImageSupportPlatform(context.Background(), cache, image, platform, nil) {
+			t.Fatal("expected the cached success to be returned")
+		}
+		if shortCircuits() != before {
+			t.Error("expected no refresh for a fresh entry")
+		}
+	})
+
+	t.Run("stale entry is served and refreshed in the background", func(t *testing.T) {
+		cache := NewInMemoryCache(cacheSizeDefault)
+		cache.Set(imageCacheKey(image, platform), true, 0)
+		before := shortCircuits()
+		if !DoesImageSupportPlatform(context.Background(), cache, image, platform, nil) {
+			t.Fatal("expected the stale success to be served")
+		}
+		deadline := time.Now().Add(time.Second)
+		for shortCircuits() == before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if shortCircuits() != before+1 {
+			t.Error("expected a single background refresh of the stale entry")
+		}
+	})
+
+	t.Run("failed refresh keeps the stale entry", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			http.NotFound(w, r)
+		}))
+		defer server.Close()
+		registryBreaker = newCircuitBreaker(100, time.Minute, time.Hour)
+		failing := strings.TrimPrefix(server.URL, "http://")
+		host := config.HostNewName(failing)
+		host.TLS = config.TLSDisabled
+
+		cache := NewInMemoryCache(cacheSizeDefault)
+		image := failing + "/app:v1"
+		key := imageCacheKey(image, platform)
+		cache.Set(key, true, 0)
+		if !DoesImageSupportPlatform(context.Background(), cache, image, platform, []config.Host{*host}) {
+			t.Fatal("expected the stale success to be served")
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, running := cacheRevalidations.Load(key); !running && requests.Load() > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if requests.Load() == 0 {
+			t.Fatal("expected the refresh to reach the registry")
+		}
+		if val, ok := cache.Get(key); !ok || !val {
+			t.Errorf("cache = %v, %v; want the stale success kept after a failed refresh", val, ok)
+		}
+	})
+}
+
+func TestJitterTTL(t *testing.T) {
+	if got := jitterTTL(cacheSuccessTTL, 0); got != cacheSuccessTTL {
+		t.Errorf("jitterTTL with no jitter = %s, want %s", got, cacheSuccessTTL)
+	}
+
+	lower, upper := cacheSuccessTTL*9/10, cacheSuccessTTL*11/10
+	seen := map[time.Duration]bool{}
+	for range 1000 {
+		got := jitterTTL(cacheSuccessTTL, 0.1)
+		if got < lower || got > upper {
+			t.Fatalf("jitterTTL = %s, want within [%s, %s]", got, lower, upper)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected jittered TTLs to vary")
+	}
+}
+
+func TestCacheTTLForRef(t *testing.T) {
+	prevJitter, prevMutable := cacheTTLJitter, mutableTagTTL
+	t.Cleanup(func() { cacheTTLJitter, mutableTagTTL = prevJitter, prevMutable })
+	cacheTTLJitter = 0
+
+	const pinned = "nginx@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	tests := []struct {
+		name       string
+		image      string
+		mutableTTL time.Duration
+		ttl        time.Duration
+		want       time.Duration
+	}{
+		{name: "cap disabled", image: "nginx:latest", ttl: cacheSuccessTTL, want: cacheSuccessTTL},
+		{name: "tag is capped", image: "nginx:latest", mutableTTL: time.Hour, ttl: cacheSuccessTTL, want: time.Hour},
+		{name: "untagged is capped", image: "nginx", mutableTTL: time.Hour, ttl: cacheNegativeTTL, want: time.Hour},
+		{name: "digest keeps long TTL", image: pinned, mutableTTL: time.Hour, ttl: cacheSuccessTTL, want: cacheSuccessTTL},
+		{
+			name:       "tag and digest keeps long TTL",
+			image:      "nginx:1.27@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			mutableTTL: time.Hour,
+			ttl:        cacheSuccessTTL,
+			want:       cacheSuccessTTL,
+		},
+		{name: "shorter TTL is kept", image: "nginx:latest", mutableTTL: time.Hour, ttl: time.Minute, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutableTagTTL = tt.mutableTTL
+			r, err := parseImageRef(tt.image)
+			if err != nil {
+				t.Fatalf("parseImageRef(%q) error = %v", tt.image, err)
+			}
+			if got := cacheTTLForRef(r, tt.ttl); got != tt.want {
+				t.Errorf("cacheTTLForRef() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoesImageSupportPlatform_EquivalentReferences(t *testing.T) {
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey("library/nginx:latest", "linux/arm64"), true, 0)
+
+	for _, name := range []string{"nginx:latest", "docker.io/library/nginx:latest", "library/nginx:latest"} {
+		if imageCacheKey(name, "linux/arm64") != imageCacheKey("library/nginx:latest", "linux/arm64") {
+			t.Errorf("imageCacheKey(%q) does not match the cached entry", name)
+		}
+		if !DoesImageSupportPlatform(context.Background(), cache, name, "linux/arm64", nil) {
+			t.Errorf("expected %q to hit the shared cache entry", name)
+		}
+	}
+}
+
+func TestImageCacheKey_Version(t *testing.T) {
+	t.Cleanup(func() { cacheKeyPrefix = "" })
+
+	cacheKeyPrefix = "v1:"
+	v1 := imageCacheKey(goldenImage, "linux/arm64")
+	cacheKeyPrefix = "v2:"
+	v2 := imageCacheKey(goldenImage, "linux/arm64")
+
+	if v1 == v2 {
+		t.Fatalf("expected distinct keys across versions, both were %q", v1)
+	}
+	if !strings.HasPrefix(v2, "v2:") {
+		t.Errorf("imageCacheKey() = %q, want the v2: prefix", v2)
+	}
+
+	// A result cached under the old version is not visible under the new one.
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(v1, true, 0)
+	if _, ok := cache.Get(imageCacheKey(goldenImage, "linux/arm64")); ok {
+		t.Error("expected no cache entry under the new version")
+	}
+}
+
+func TestParseImageRef_DefaultTag(t *testing.T) {
+	if got, want := imageCacheKey("nginx", "linux/arm64"), imageCacheKey("nginx:latest", "linux/arm64"); got != want {
+		t.Errorf("imageCacheKey(nginx) = %q, want %q", got, want)
+	}
+
+	r, err := parseImageRef("nginx")
+	if err != nil {
+		t.Fatalf("parseImageRef() error = %v", err)
+	}
+	if r.Tag != defaultImageTag {
+		t.Errorf("Tag = %q, want %q", r.Tag, defaultImageTag)
+	}
+
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	r, err = parseImageRef("nginx@" + digest)
+	if err != nil {
+		t.Fatalf("parseImageRef() error = %v", err)
+	}
+	if r.Tag != "" || r.Digest != digest {
+		t.Errorf("digest reference parsed as tag %q digest %q, want no tag", r.Tag, r.Digest)
+	}
+}
+
+func TestDoesImageSupportPlatform_TrustedRegistry(t *testing.T) {
+	prevTrusted, prevBreaker := trustedMultiarchRegistries, registryBreaker
+	t.Cleanup(func() { trustedMultiarchRegistries, registryBreaker = prevTrusted, prevBreaker })
+	trustedMultiarchRegistries = parseTrustedRegistries(" Registry.Internal.example.com , *.mirror.example.com")
+
+	// With every circuit open, any registry call would fail and report the
+	// platform as unsupported.
+	registryBreaker = newCircuitBreaker(1, time.Minute, time.Hour)
+	for _, registry := range []string{"registry.internal.example.com", "eu.mirror.example.com", "docker.io"} {
+		registryBreaker.RecordFailure(registry)
+	}
+
+	cache := NewInMemoryCache(cacheSizeDefault)
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{image: "registry.internal.example.com/team/app:v1", want: true},
+		{image: "eu.mirror.example.com/app:v1", want: true},
+		{image: "nginx:latest", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := DoesImageSupportPlatform(context.Background(), cache, tt.image, "linux/arm64", nil); got != tt.want {
+				t.Errorf("DoesImageSupportPlatform() = %v, want %v", got, tt.want)
+			}
+			if _, ok := cache.Get(imageCacheKey(tt.image, "linux/arm64")); ok {
+				t.Error("expected no cache entry to be written")
+			}
+		})
+	}
+}
+
+func TestDoesImageSupportPlatform_PlatformOverrides(t *testing.T) {
+	prevOverrides, prevBreaker := imagePlatformOverrides, registryBreaker
+	t.Cleanup(func() { imagePlatformOverrides, registryBreaker = prevOverrides, prevBreaker })
+	overrides, err := parseImagePlatformOverrides(`{
+		"vendor.example.com/*": ["linux/amd64"],
+		"vendor.example.com/agent:*": ["linux/amd64", "linux/arm64"],
+		"docker.io/library/nginx:1.27": ["linux/arm64/v8"]
+	}`)
+	if err != nil {
+		t.Fatalf("parseImagePlatformOverrides() error = %v", err)
+	}
+	imagePlatformOverrides = overrides
+
+	// With every circuit open, any registry call would fail and report the
+	// platform as unsupported.
+	registryBreaker = newCircuitBreaker(1, time.Minute, time.Hour)
+	for _, registry := range []string{"vendor.example.com", "docker.io"} {
+		registryBreaker.RecordFailure(registry)
+	}
+
+	cache := NewInMemoryCache(cacheSizeDefault)
+	tests := []struct {
+		name     string
+		image    string
+		platform string
+		want     bool
+	}{
+		{name: "exact match on normalized name", image: "nginx:1.27", platform: "linux/arm64", want: true},
+		{name: "exact match lacks platform", image: "nginx:1.27", platform: "linux/amd64", want: false},
+		{name: "glob match", image: "vendor.example.com/collector:v2", platform: "linux/amd64", want: true},
+		{name: "glob match lacks platform", image: "vendor.example.com/collector:v2", platform: "linux/arm64"},
+		{name: "longest glob wins", image: "vendor.example.com/agent:v1", platform: "linux/arm64", want: true},
+		{name: "no override falls through", image: "nginx:1.26", platform: "linux/arm64", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DoesImageSupportPlatform(context.Background(), cache, tt.image, tt.platform, nil); got != tt.want {
+				t.Errorf("DoesImageSupportPlatform(%s, %s) = %v, want %v", tt.image, tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseImagePlatformOverrides(t *testing.T) {
+	if overrides, err := parseImagePlatformOverrides(""); err != nil || overrides != nil {
+		t.Errorf("expected nil for an empty value, got %v, %v", overrides, err)
+	}
+	for _, raw := range []string{
+		`not json`,
+		`{"[": ["linux/amd64"]}`,
+		`{"nginx:*": [""]}`,
+	} {
+		if _, err := parseImagePlatformOverrides(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
+
+func TestNewRegClient_UserAgent(t *testing.T) {
+	const userAgent = "k8smultiarcher-test/1.2.3"
+
+	prev := registryUserAgent
+	registryUserAgent = userAgent
+	t.Cleanup(func() { registryUserAgent = prev })
+
+	seen := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.UserAgent()
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	r, err := ref.New(registry + "/app:v1")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+
+	rc := newRegClient([]config.Host{*host})
+	if _, err := rc.ManifestHead(context.Background(), r); err == nil {
+		t.Fatal("expected the stub registry to return an error")
+	}
+	close(seen)
+	requests := 0
+	for ua := range seen {
+		requests++
+		if ua != userAgent {
+			t.Errorf("User-Agent = %q, want %q", ua, userAgent)
+		}
+	}
+	if requests == 0 {
+		t.Error("expected at least one request to the stub registry")
+	}
+}
+
+func TestGetManifest_HeadThenGet(t *testing.T) {
+	const imageManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	indexDigest := digest.FromString(testIndex)
+	singleDigest := digest.FromString("single")
+	chartDigest := digest.FromString(testHelmChartManifest)
+
+	var mu sync.Mutex
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/app/manifests/multi", "/v2/app/manifests/" + indexDigest.String():
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testIndex))
+			}
+		case "/v2/app/manifests/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			_, _ = w.Write([]byte(testIndex))
+		case "/v2/app/manifests/single":
+			if r.Method != http.MethodHead {
+				t.Errorf("unexpected %s for a single-platform manifest", r.Method)
+			}
+			w.Header().Set("Content-Type", imageManifestType)
+			w.Header().Set("Docker-Content-Digest", singleDigest.String())
+			w.Header().Set("Content-Length", "6")
+		case "/v2/app/manifests/chart", "/v2/app/manifests/" + chartDigest.String():
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", chartDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testHelmChartManifest)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testHelmChartManifest))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+
+	r, err := ref.New(registry + "/app:multi")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+	m, err := GetManifest(context.Background(), r, hosts)
+	if err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+	if supported, err := manifestSupportsPlatform(m, "linux/arm64"); err != nil || !supported {
+		t.Errorf("manifestSupportsPlatform() = %v, %v; want true", supported, err)
+	}
+	want := []string{"HEAD /v2/app/manifests/multi", "GET /v2/app/manifests/" + indexDigest.String()}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	requests = nil
+	r, err = ref.New(registry + "/app:single")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+	if _, err := GetManifest(context.Background(), r, hosts); err == nil {
+		t.Error("expected an error for a single-platform manifest")
+	}
+	if want := []string{"HEAD /v2/app/manifests/single"}; !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	requests = nil
+	r, err = ref.New(registry + "/app:nohead")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+	if _, err := GetManifest(context.Background(), r, hosts); err != nil {
+		t.Errorf("GetManifest() error = %v, want a GET fallback when HEAD is rejected", err)
+	}
+	if want := []string{"HEAD /v2/app/manifests/nohead", "GET /v2/app/manifests/nohead"}; !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	requests = nil
+	r, err = ref.New(registry + "/app:chart")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+	if _, err := GetManifest(context.Background(), r, hosts); !errors.Is(err, errNotRunnableImage) {
+		t.Errorf("GetManifest() error = %v, want errNotRunnableImage for a Helm chart", err)
+	}
+	want = []string{"HEAD /v2/app/manifests/chart", "GET /v2/app/manifests/" + chartDigest.String()}
+	if !slices.Equal(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	// The artifact is reported unsupported without caching a platform mismatch.
+	cache := NewInMemoryCache(cacheSizeDefault)
+	if DoesImageSupportPlatform(context.Background(), cache, registry+"/app:chart", "linux/arm64", hosts) {
+		t.Error("expected an artifact not to support any platform")
+	}
+	if _, ok := cache.Get(imageCacheKey(registry+"/app:chart", "linux/arm64")); ok {
+		t.Error("expected no cache entry for an artifact")
+	}
+}
+
+func TestDoesImageSupportPlatform_SingleManifestConfig(t *testing.T) {
+	const imageConfig = `{"architecture":"arm64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`
+	configDigest := digest.FromString(imageConfig)
+	// The manifest carries no platform; only the config blob names it.
+	singleManifest := `{"schemaVersion":2,` +
+		`"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json",` +
+		`"digest":"` + configDigest.String() + `","size":` + strconv.Itoa(len(imageConfig)) + `},` +
+		`"layers":[]}`
+	manifestDigest := digest.FromString(singleManifest)
+
+	var tagRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/arm64-only", "/v2/app/manifests/" + manifestDigest.String():
+			if strings.HasSuffix(r.URL.Path, "arm64-only") {
+				tagRequests.Add(1)
+			}
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(singleManifest)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(singleManifest))
+			}
+		case "/v2/app/blobs/" + configDigest.String():
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Docker-Content-Digest", configDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(imageConfig)))
+			_, _ = w.Write([]byte(imageConfig))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+	image := registry + "/app:arm64-only"
+
+	cache := NewInMemoryCache(cacheSizeDefault)
+	if !DoesImageSupportPlatform(context.Background(), cache, image, "linux/arm64", hosts) {
+		t.Error("expected the single-arch image to support the linux/arm64 platform named in its config")
+	}
+	// The tag is resolved once; the config lookup reuses the manifest digest.
+	if n := tagRequests.Load(); n != 1 {
+		t.Errorf("tag requests = %d, want 1", n)
+	}
+	if DoesImageSupportPlatform(context.Background(), cache, image, "linux/amd64", hosts) {
+		t.Error("expected the single-arch image not to support linux/amd64")
+	}
+	if val, ok := cache.Get(imageCacheKey(image, "linux/amd64")); !ok || val {
+		t.Errorf("cache = %v, %v; want a cached mismatch for linux/amd64", val, ok)
+	}
+}
+
+func TestDoesImageSupportPlatform_UnsupportedTTLs(t *testing.T) {
+	prevFailure, prevParse, prevNegative := cacheFailureTTL, cacheParseErrorTTL, cacheNegativeTTL
+	prevJitter := cacheTTLJitter
+	t.Cleanup(func() {
+		cacheFailureTTL, cacheParseErrorTTL, cacheNegativeTTL = prevFailure, prevParse, prevNegative
+		cacheTTLJitter = prevJitter
+	})
+	cacheFailureTTL, cacheParseErrorTTL, cacheNegativeTTL, cacheTTLJitter = time.Minute, 2*time.Minute, 3*time.Minute, 0
+
+	configs := map[string]string{
+		"arm64-only":  `{"architecture":"arm64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`,
+		"no-platform": `{"rootfs":{"type":"layers","diff_ids":[]}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for tag, imageConfig := range configs {
+			configDigest := digest.FromString(imageConfig)
+			manifest := `{"schemaVersion":2,` +
+				`"mediaType":"application/vnd.docker.distribution.manifest.v2+json",` +
+				`"config":{"mediaType":"application/vnd.docker.container.image.v1+json",` +
+				`"digest":"` + configDigest.String() + `","size":` + strconv.Itoa(len(imageConfig)) + `},` +
+				`"layers":[]}`
+			manifestDigest := digest.FromString(manifest)
+			switch r.URL.Path {
+			case "/v2/app/manifests/" + tag, "/v2/app/manifests/" + manifestDigest.String():
+				w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+				w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+				w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+				if r.Method == http.MethodGet {
+					_, _ = w.Write([]byte(manifest))
+				}
+				return
+			case "/v2/app/blobs/" + configDigest.String():
+				w.Header().Set("Content-Length", strconv.Itoa(len(imageConfig)))
+				_, _ = w.Write([]byte(imageConfig))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+
+	tests := []struct {
+		name  string
+		image string
+		want  time.Duration
+	}{
+		{name: "lookup failure", image: registry + "/app:missing", want: time.Minute},
+		{name: "unreadable platforms", image: registry + "/app:no-platform", want: 2 * time.Minute},
+		{name: "definitive negative", image: registry + "/app:arm64-only", want: 3 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newRecordingCache()
+			if DoesImageSupportPlatform(context.Background(), cache, tt.image, "linux/amd64", hosts) {
+				t.Fatal("expected linux/amd64 to be unsupported")
+			}
+			key := imageCacheKey(tt.image, "linux/amd64")
+			if val, ok := cache.values[key]; !ok || val {
+				t.Fatalf("cache = %v, %v; want a cached unsupported result", val, ok)
+			}
+			if got := cache.ttls[key]; got != tt.want {
+				t.Errorf("TTL = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoesImageSupportPlatform_CacheBypass(t *testing.T) {
+	indexDigest := digest.FromString(testIndex)
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/multi", "/v2/app/manifests/" + indexDigest.String():
+			if r.Method == http.MethodHead {
+				lookups++
+			}
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testIndex))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+	image := registry + "/app:multi"
+
+	// A stale negative result that a fresh inspection overturns.
+	cache := NewInMemoryCache(cacheSizeDefault)
+	cache.Set(imageCacheKey(image, "linux/arm64"), false, 0)
+
+	if DoesImageSupportPlatform(context.Background(), cache, image, "linux/arm64", hosts) {
+		t.Fatal("expected the cached result without a bypass")
+	}
+	if lookups != 0 {
+		t.Fatalf("expected no registry lookup without a bypass, got %d", lookups)
+	}
+
+	if !DoesImageSupportPlatform(withCacheBypass(context.Background()), cache, image, "linux/arm64", hosts) {
+		t.Fatal("expected a fresh lookup to find linux/arm64")
+	}
+	if lookups != 1 {
+		t.Errorf("expected one registry lookup with a bypass, got %d", lookups)
+	}
+	if val, ok := cache.Get(imageCacheKey(image, "linux/arm64")); !ok || !val {
+		t.Errorf("cache = %v, %v; want the fresh result written back", val, ok)
+	}
+}
+
+func TestGetManifest_OversizedIndex(t *testing.T) {
+	prev := maxIndexEntries
+	t.Cleanup(func() { maxIndexEntries = prev })
+	maxIndexEntries = 1
+
+	// testIndex lists two manifests, one more than the limit.
+	indexDigest := digest.FromString(testIndex)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/huge", "/v2/app/manifests/" + indexDigest.String():
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testIndex))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+
+	r, err := ref.New(registry + "/app:huge")
+	if err != nil {
+		t.Fatalf("ref.New() error = %v", err)
+	}
+	if _, err := GetManifest(context.Background(), r, hosts); !errors.Is(err, errIndexTooLarge) {
+		t.Errorf("GetManifest() error = %v, want %v", err, errIndexTooLarge)
+	}
+	cache := NewInMemoryCache(cacheSizeDefault)
+	if DoesImageSupportPlatform(context.Background(), cache, registry+"/app:huge", "linux/arm64", hosts) {
+		t.Error("expected no support for an oversized index")
+	}
+
+	maxIndexEntries = 0
+	if _, err := GetManifest(context.Background(), r, hosts); err != nil {
+		t.Errorf("GetManifest() error = %v, want none with the limit disabled", err)
+	}
+}
+
+func TestManifestArtifactType(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "image index", raw: testIndex, want: ""},
+		{name: "helm chart", raw: testHelmChartManifest, want: "application/vnd.cncf.helm.config.v1+json"},
+		{
+			name: "sbom with artifactType",
+			raw: `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "artifactType": "application/spdx+json",
+  "config": {"mediaType": "application/vnd.oci.empty.v1+json", "size": 2,
+    "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},
+  "layers": []}`,
+			want: "application/spdx+json",
+		},
+		{
+			name: "runnable image",
+			raw: `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "size": 2,
+    "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},
+  "layers": []}`,
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := manifest.New(manifest.WithRaw([]byte(tt.raw)))
+			if err != nil {
+				t.Fatalf("failed to build test manifest: %v", err)
+			}
+			if got := manifestArtifactType(m); got != tt.want {
+				t.Errorf("manifestArtifactType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestSupportsPlatform_IndexAnnotation(t *testing.T) {
+	const annotationKey = "org.opencontainers.image.platforms"
+
+	prev := indexPlatformsAnnotation
+	indexPlatformsAnnotation = annotationKey
+	t.Cleanup(func() { indexPlatformsAnnotation = prev })
+
+	annotated := strings.Replace(testIndex, `"manifests"`,
+		`"annotations": {"`+annotationKey+`": "linux/amd64, linux/s390x"},
+  "manifests"`, 1)
+	m, err := manifest.New(manifest.WithRaw([]byte(annotated)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+	plain, err := manifest.New(manifest.WithRaw([]byte(testIndex)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		m        manifest.Manifest
+		platform string
+		want     bool
+	}{
+		{name: "annotation lists platform", m: m, platform: "linux/s390x", want: true},
+		{name: "annotation overrides entries", m: m, platform: "linux/arm64", want: false},
+		{name: "no annotation falls back to entries", m: plain, platform: "linux/arm64", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := manifestSupportsPlatform(tt.m, tt.platform)
+			if err != nil {
+				t.Fatalf("manifestSupportsPlatform() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("manifestSupportsPlatform(%q) = %v, want %v", tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestSupportsPlatform_Features(t *testing.T) {
+	m, err := manifest.New(manifest.WithRaw([]byte(testFeaturedIndex)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+
+	tests := []struct {
+		platform string
+		want     bool
+	}{
+		{platform: "linux/amd64", want: true},
+		{platform: "linux/amd64/v3", want: true},
+		{platform: "linux/amd64/v2", want: false},
+		{platform: "linux/amd64+avx512f", want: true},
+		{platform: "linux/amd64/v3+avx512f", want: true},
+		{platform: "linux/amd64+sse9", want: false},
+		{platform: "linux/arm64", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			got, err := manifestSupportsPlatform(m, tt.platform)
+			if err != nil {
+				t.Fatalf("manifestSupportsPlatform() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("manifestSupportsPlatform(%q) = %v, want %v", tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoesImageSupportPlatform_NoRunnablePlatforms(t *testing.T) {
+	prevPolicy, prevTTL, prevJitter := noRunnablePlatformsPolicy, cacheNoRunnableTTL, cacheTTLJitter
+	t.Cleanup(func() {
+		noRunnablePlatformsPolicy, cacheNoRunnableTTL, cacheTTLJitter = prevPolicy, prevTTL, prevJitter
+	})
+	cacheNoRunnableTTL, cacheTTLJitter = 7*time.Minute, 0
+
+	m, err := manifest.New(manifest.WithRaw([]byte(testAttestationOnlyIndex)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+	if _, err := manifestSupportsPlatform(m, "linux/amd64"); !errors.Is(err, errNoRunnablePlatforms) {
+		t.Fatalf("manifestSupportsPlatform() error = %v, want errNoRunnablePlatforms", err)
+	}
+
+	indexDigest := digest.FromString(testAttestationOnlyIndex)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/attest", "/v2/app/manifests/" + indexDigest.String():
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testAttestationOnlyIndex)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testAttestationOnlyIndex))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+	image := registry + "/app:attest"
+
+	for _, tt := range []struct {
+		policy string
+		want   bool
+	}{
+		{policy: noRunnablePlatformsStrip, want: false},
+		{policy: noRunnablePlatformsFailOpen, want: true},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			noRunnablePlatformsPolicy = tt.policy
+			cache := newRecordingCache()
+			if got := DoesImageSupportPlatform(context.Background(), cache, image, "linux/amd64", hosts); got != tt.want {
+				t.Errorf("DoesImageSupportPlatform() = %v, want %v", got, tt.want)
+			}
+			key := imageCacheKey(image, "linux/amd64")
+			if val, ok := cache.values[key]; !ok || val != tt.want {
+				t.Errorf("cache = %v, %v; want %v", val, ok, tt.want)
+			}
+			if got := cache.ttls[key]; got != 7*time.Minute {
+				t.Errorf("TTL = %s, want 7m", got)
+			}
+		})
+	}
+}
+
+func TestPlatformsMatch(t *testing.T) {
+	tests := []struct {
+		have string
+		want string
+		ok   bool
+	}{
+		{have: "linux/arm64/v8", want: "linux/arm64", ok: true},
+		{have: "linux/amd64+avx512f", want: "linux/amd64", ok: true},
+		{have: "linux/amd64", want: "linux/amd64+avx512f", ok: false},
+		{have: "linux/amd64/v3", want: "linux/amd64/v2", ok: false},
+		{have: "not a platform", want: "not a platform", ok: true},
+	}
+	for _, tt := range tests {
+		if got := platformsMatch(tt.have, tt.want); got != tt.ok {
+			t.Errorf("platformsMatch(%q, %q) = %v, want %v", tt.have, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestParseImageRef_DefaultRegistry(t *testing.T) {
+	prev := defaultRegistry
+	defaultRegistry = "mirror.example.com"
+	t.Cleanup(func() { defaultRegistry = prev })
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx", want: "mirror.example.com/library/nginx:latest"},
+		{image: "busybox:1.36", want: "mirror.example.com/library/busybox:1.36"},
+		{image: "myorg/app:1", want: "mirror.example.com/myorg/app:1"},
+		{image: "docker.io/library/nginx:latest", want: "docker.io/library/nginx:latest"},
+		{image: "ghcr.io/org/app:1", want: "ghcr.io/org/app:1"},
+		{image: "localhost:5000/app:1", want: "localhost:5000/app:1"},
+		{image: "localhost/app:1", want: "localhost/app:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			r, err := parseImageRef(tt.image)
+			if err != nil {
+				t.Fatalf("parseImageRef(%q) error = %v", tt.image, err)
+			}
+			if got := r.CommonName(); got != tt.want {
+				t.Errorf("parseImageRef(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestSupportsPlatform_BuildxAttestations(t *testing.T) {
+	m, err := manifest.New(manifest.WithRaw([]byte(testBuildxIndex)))
+	if err != nil {
+		t.Fatalf("failed to build test manifest: %v", err)
+	}
+
+	tests := []struct {
+		platform string
+		want     bool
+	}{
+		{platform: "linux/amd64", want: true},
+		{platform: "linux/arm64", want: true},
+		{platform: "unknown/unknown", want: false},
+		{platform: "linux/s390x", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			got, err := manifestSupportsPlatform(m, tt.platform)
+			if err != nil {
+				t.Fatalf("manifestSupportsPlatform() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("manifestSupportsPlatform(%q) = %v, want %v", tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoesImageSupportPlatform_AuthFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/private/") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	hosts := []config.Host{*host}
+	cache := NewInMemoryCache(cacheSizeDefault)
+
+	private := registry + "/private/app:v1"
+	if DoesImageSupportPlatform(context.Background(), cache, private, "linux/arm64", hosts) {
+		t.Fatal("expected no support when the registry rejects the lookup")
+	}
+	if !imageLookupAuthFailed(cache, private, "linux/arm64") {
+		t.Error("expected the unauthorized lookup to be recorded as an auth failure")
+	}
+
+	missing := registry + "/public/app:v1"
+	if DoesImageSupportPlatform(context.Background(), cache, missing, "linux/arm64", hosts) {
+		t.Fatal("expected no support for a missing image")
+	}
+	if imageLookupAuthFailed(cache, missing, "linux/arm64") {
+		t.Error("expected a not-found lookup not to be recorded as an auth failure")
+	}
+}
@@ -2,23 +2,59 @@ package main
 
 import (
 	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/regclient/regclient/config"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/time/rate"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
 	cache              Cache
 	platformConfig     *PlatformTolerationConfig
 	namespaceFilterCfg *NamespaceFilterConfig
+	// routePrefix is prepended to every route, e.g. "/k8smultiarcher". It is set
+	// at startup from ROUTE_PREFIX and is empty by default.
+	routePrefix string
+	// debugEndpoints registers the /config endpoint. It is set at startup from
+	// DEBUG_ENDPOINTS.
+	debugEndpoints bool
 )
 
 func main() {
+	if err := LoadConfig(); err != nil {
+		slog.Error("failed to load structured config", "error", err)
+		os.Exit(1)
+	}
 	configureCache()
+	configureRegistryConcurrency()
+	configureRegistryProxy()
+	configureRegistryCircuitBreaker()
+	configureRegistryRateLimits()
+	configureAuditLog()
 
 	var err error
 	platformConfig, err = LoadPlatformTolerationConfig()
@@ -31,7 +67,80 @@ func main() {
 		slog.Error("failed to load namespace filter config", "error", err)
 		os.Exit(1)
 	}
+	staticRegistryHosts, err = LoadStaticRegistryHosts()
+	if err != nil {
+		slog.Error("failed to load static registry credentials", "error", err)
+		os.Exit(1)
+	}
+	kubeAPIMaxRetries, err = kubeAPIMaxRetriesFromEnv()
+	if err != nil {
+		slog.Error("failed to load Kubernetes API retry config", "error", err)
+		os.Exit(1)
+	}
+	webhookNamespace, globalPullSecrets, err = loadGlobalPullSecrets()
+	if err != nil {
+		slog.Error("failed to load global pull secrets", "error", err)
+		os.Exit(1)
+	}
+	if len(globalPullSecrets) > 0 {
+		slog.Info("using global pull secrets", "namespace", webhookNamespace, "secrets", globalPullSecrets)
+	}
+	ecrAuthEnabled = os.Getenv("ECR_AUTH") == "true"
+	gcpAuthEnabled = os.Getenv("GCP_AUTH") == "true"
+	tokenExchangeRegistries, err = parseTokenExchangeRegistries(os.Getenv("REGISTRY_TOKEN_EXCHANGE"))
+	if err != nil {
+		slog.Error("failed to load registry token exchange config", "error", err)
+		os.Exit(1)
+	}
+	if len(tokenExchangeRegistries) > 0 {
+		slog.Info("exchanging the service account token for registry credentials",
+			"registries", slices.Sorted(maps.Keys(tokenExchangeRegistries)))
+	}
+	serviceAccountTokenPath = cmp.Or(os.Getenv("SERVICE_ACCOUNT_TOKEN_PATH"), serviceAccountTokenPathDefault)
+	tokenExchangeUser = cmp.Or(os.Getenv("REGISTRY_TOKEN_EXCHANGE_USER"), tokenExchangeUserDefault)
+	maxIndexEntries, err = maxIndexEntriesFromEnv()
+	if err != nil {
+		slog.Error("failed to load max index entries", "error", err)
+		os.Exit(1)
+	}
+	imagePlatformOverrides, err = parseImagePlatformOverrides(os.Getenv("IMAGE_PLATFORM_OVERRIDES"))
+	if err != nil {
+		slog.Error("failed to load image platform overrides", "error", err)
+		os.Exit(1)
+	}
+	if len(imagePlatformOverrides) > 0 {
+		slog.Info("loaded image platform overrides", "count", len(imagePlatformOverrides))
+	}
+	indexPlatformsAnnotation = os.Getenv("INDEX_PLATFORMS_ANNOTATION")
+	defaultRegistry = strings.TrimSuffix(os.Getenv("DEFAULT_REGISTRY"), "/")
+	if defaultRegistry != "" {
+		slog.Info("resolving image names without a registry against the default registry", "registry", defaultRegistry)
+	}
+	metricsNamespaceLabel = os.Getenv("METRICS_NAMESPACE_LABEL") != "false"
+	slowAdmissionThreshold, err = slowAdmissionThresholdFromEnv()
+	if err != nil {
+		slog.Error("failed to load slow admission threshold", "error", err)
+		os.Exit(1)
+	}
+	registryUserAgent = cmp.Or(os.Getenv("REGISTRY_USER_AGENT"), defaultRegistryUserAgent())
+	routePrefix = normalizeRoutePrefix(os.Getenv("ROUTE_PREFIX"))
+	debugEndpoints = os.Getenv("DEBUG_ENDPOINTS") == "true"
+	trustedMultiarchRegistries = parseTrustedRegistries(os.Getenv("TRUSTED_MULTIARCH_REGISTRIES"))
+	if len(trustedMultiarchRegistries) > 0 {
+		slog.Info("loaded trusted multi-arch registries", "registries", trustedMultiarchRegistries)
+	}
+
+	watchNodes = os.Getenv("WATCH_NODES") == "true"
+	if watchNodes {
+		if err := startNodeWatcher(context.Background(), platformConfig.Mappings); err != nil {
+			slog.Error("failed to watch nodes", "error", err)
+			os.Exit(1)
+		}
+	}
 
+	runStartupRegistryCheck()
+
+	startGRPCHealthServer()
 	startServer(newRouter())
 }
 
@@ -41,29 +150,368 @@ func newRouter() *gin.Engine {
 	if err := r.SetTrustedProxies(nil); err != nil {
 		slog.Error("failed to disable trusted proxies", "error", err)
 	}
-	r.POST("/mutate", mutateHandler)
-	r.GET("/healthz", healthzHandler)
-	r.GET("/livez", livezHandler)
+	routes := r.Group(routePrefix)
+	routes.POST("/mutate", mutateHandler)
+	routes.GET("/healthz", healthzHandler)
+	routes.GET("/livez", livezHandler)
+	routes.GET("/readyz", readyzHandler)
+	routes.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	routes.GET("/platforms", platformsHandler)
+	if debugEndpoints {
+		routes.GET("/config", configHandler)
+		routes.POST("/inspect/batch", inspectBatchHandler)
+		routes.POST("/cache/flush", cacheFlushHandler)
+		routes.GET("/debug/pull-secrets", pullSecretsHandler)
+	}
 	return r
 }
 
+// normalizeRoutePrefix returns prefix with a single leading slash and no
+// trailing slash, or "" when prefix is empty or "/".
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// platformsHandler lists the configured platforms and the tolerations added for
+// each, for tooling that documents the cluster.
+func platformsHandler(c *gin.Context) {
+	platforms := []gin.H{}
+	if platformConfig != nil {
+		for _, m := range platformConfig.Mappings {
+			entry := gin.H{"platform": m.Platform, "toleration": m.Toleration}
+			if len(m.NodeSelector) > 0 {
+				entry["nodeSelector"] = m.NodeSelector
+			}
+			platforms = append(platforms, entry)
+		}
+	}
+	c.JSON(200, gin.H{"platforms": platforms})
+}
+
+// configHandler reports the effective configuration the webhook loaded, for
+// debugging env-var precedence. Registry credentials are never included.
+func configHandler(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"platformTolerations": platformConfig,
+		"namespaceFilter":     namespaceFilterDescription(namespaceFilterCfg),
+		"cache":               cacheDescription(cache),
+	})
+}
+
+// inspectBatchMaxImages bounds the number of images in one /inspect/batch
+// request, since each image may need a registry lookup per platform.
+const inspectBatchMaxImages = 100
+
+// inspectBatchRequest is the body of a POST /inspect/batch request. Namespace,
+// when set, selects the namespace whose default service account pull secrets
+// are used for registry credentials.
+type inspectBatchRequest struct {
+	Images    []string `json:"images"`
+	Namespace string   `json:"namespace"`
+}
+
+// inspectBatchHandler reports, for each requested image, the configured
+// platforms it supports and the tolerations the webhook would add for them, so
+// CI can pre-check images before deploying.
+func inspectBatchHandler(c *gin.Context) {
+	var req inspectBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request body"})
+		return
+	}
+	if len(req.Images) == 0 {
+		c.JSON(400, gin.H{"error": "images must not be empty"})
+		return
+	}
+	if len(req.Images) > inspectBatchMaxImages {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("too many images: at most %d per request", inspectBatchMaxImages)})
+		return
+	}
+	if platformConfig == nil {
+		c.JSON(503, gin.H{"error": "platform configuration not loaded"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	podSpec := &corev1.PodSpec{}
+	for _, image := range req.Images {
+		podSpec.Containers = append(podSpec.Containers, corev1.Container{Image: image})
+	}
+	registryHosts := GetRegistryHosts(ctx, req.Namespace, podSpec)
+
+	results := []gin.H{}
+	for _, image := range req.Images {
+		supported := []string{}
+		for _, platform := range platformConfig.GetPlatforms() {
+			if slices.ContainsFunc(platformConfig.DeniedPlatforms(image), func(p string) bool {
+				return platformsMatch(platform, p)
+			}) {
+				continue
+			}
+			if DoesImageSupportPlatform(ctx, cache, image, platform, registryHosts) {
+				supported = append(supported, platform)
+			}
+		}
+		results = append(results, gin.H{
+			"image":       image,
+			"platforms":   supported,
+			"tolerations": platformConfig.GetTolerationsForPlatforms(ctx, supported),
+		})
+	}
+	c.JSON(200, gin.H{"results": results})
+}
+
+// cacheFlushHandler removes every cache entry, so images are inspected afresh
+// after a detection fix.
+func cacheFlushHandler(c *gin.Context) {
+	if err := cache.FlushAll(); err != nil {
+		slog.Error("failed to flush cache", "error", err)
+		c.JSON(500, gin.H{"error": "failed to flush cache"})
+		return
+	}
+	slog.Info("flushed cache", "backend", cacheDescription(cache)["backend"])
+	c.JSON(200, gin.H{"status": "flushed"})
+}
+
+// pullSecretsHandler reports how registry credentials resolve for a namespace
+// and service account: the image pull secrets found and the registries each
+// provides, and the merged registry hosts lookups would use, so auth failures
+// can be diagnosed. Passwords and tokens are never included.
+func pullSecretsHandler(c *gin.Context) {
+	namespace := c.Query("namespace")
+	if namespace == "" {
+		c.JSON(400, gin.H{"error": "namespace is required"})
+		return
+	}
+	client, err := getKubeClient()
+	if err != nil {
+		slog.Error("kubernetes client unavailable for pull secret resolution", "error", err)
+		c.JSON(503, gin.H{"error": "kubernetes client unavailable"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	podSpec := &corev1.PodSpec{ServiceAccountName: c.Query("serviceaccount")}
+	secretNames := collectImagePullSecrets(ctx, client, namespace, podSpec)
+	slices.Sort(secretNames)
+	c.JSON(200, gin.H{
+		"namespace":         namespace,
+		"serviceAccounts":   podServiceAccountNames(podSpec),
+		"pullSecrets":       pullSecretDescriptions(ctx, client, namespace, secretNames),
+		"globalPullSecrets": pullSecretDescriptions(ctx, client, webhookNamespace, globalPullSecrets),
+		"registryHosts":     registryHostDescriptions(GetRegistryHosts(ctx, namespace, podSpec)),
+	})
+}
+
+// pullSecretDescriptions lists the registries each named secret in namespace
+// provides credentials for, or why it could not be used.
+func pullSecretDescriptions(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string,
+	secretNames []string,
+) []gin.H {
+	secrets := []gin.H{}
+	for _, name := range secretNames {
+		entry := gin.H{"name": name, "namespace": namespace}
+		hosts, err := loadSecretHosts(ctx, client, namespace, name)
+		if err != nil {
+			entry["error"] = err.Error()
+		} else {
+			registries := []string{}
+			for _, h := range hosts {
+				registries = append(registries, h.Name)
+			}
+			slices.Sort(registries)
+			entry["registries"] = registries
+		}
+		secrets = append(secrets, entry)
+	}
+	return secrets
+}
+
+// registryHostDescriptions renders hosts without their secrets, recording only
+// whether a password or token is set.
+func registryHostDescriptions(hosts []config.Host) []gin.H {
+	described := []gin.H{}
+	for _, h := range hosts {
+		described = append(described, gin.H{
+			"registry": h.Name,
+			"user":     h.User,
+			"password": h.Pass != "",
+			"token":    h.Token != "",
+		})
+	}
+	return described
+}
+
+// namespaceFilterDescription renders cfg with its selectors as strings.
+func namespaceFilterDescription(cfg *NamespaceFilterConfig) gin.H {
+	if cfg == nil {
+		return nil
+	}
+	selectorString := func(s labels.Selector) string {
+		if s == nil {
+			return ""
+		}
+		return s.String()
+	}
+	ignored := slices.Sorted(maps.Keys(cfg.NamespacesToIgnore))
+	ignoredPatterns := []string{}
+	for _, re := range cfg.NamespacesToIgnoreRegex {
+		ignoredPatterns = append(ignoredPatterns, re.String())
+	}
+	return gin.H{
+		"namespaceSelector":       selectorString(cfg.NamespaceSelector),
+		"namespacesToIgnore":      ignored,
+		"namespacesToIgnoreRegex": ignoredPatterns,
+		"podSelector":             selectorString(cfg.PodSelector),
+	}
+}
+
+// cacheDescription reports the cache backend and the TTLs applied to entries.
+func cacheDescription(c Cache) gin.H {
+	desc := gin.H{
+		"successTTL":           cacheSuccessTTL.String(),
+		"failureTTL":           cacheFailureTTL.String(),
+		"parseErrorTTL":        cacheParseErrorTTL.String(),
+		"negativeTTL":          cacheNegativeTTL.String(),
+		"noRunnableTTL":        cacheNoRunnableTTL.String(),
+		"noRunnablePlatforms":  noRunnablePlatformsPolicy,
+		"mutableTagTTL":        mutableTagTTL.String(),
+		"staleWhileRevalidate": cacheStaleWindow.String(),
+		"ttlJitter":            cacheTTLJitter,
+		"keyPrefix":            cacheKeyPrefix,
+	}
+	switch c := c.(type) {
+	case *InMemoryCache:
+		desc["backend"] = "inmemory"
+		desc["size"] = c.size
+		desc["policy"] = c.policy
+		desc["maxAge"] = c.maxAge.String()
+	case *RedisCache:
+		desc["backend"] = "redis"
+		desc["addr"] = c.client.Options().Addr
+	case *TieredCache:
+		desc["backend"] = "tiered"
+		desc["size"] = cacheDescription(c.l1)["size"]
+		desc["policy"] = cacheDescription(c.l1)["policy"]
+		desc["maxAge"] = cacheDescription(c.l1)["maxAge"]
+		desc["addr"] = cacheDescription(c.l2)["addr"]
+		desc["l1TTL"] = c.l1TTL.String()
+	}
+	return desc
+}
+
 func mutateHandler(c *gin.Context) {
-	body, err := io.ReadAll(c.Request.Body)
+	contentType := c.GetHeader("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		slog.Error("unsupported content type on admission request", "contentType", contentType)
+		c.JSON(415, gin.H{"error": "unsupported content type: expected application/json"})
+		return
+	}
+
+	body, err := readRequestBody(c.Writer, c.Request)
+	if errors.Is(err, errRequestBodyTooLarge) {
+		slog.Error("admission request body too large", "limit", maxRequestBodyBytes)
+		c.JSON(413, gin.H{"error": "request body too large"})
+		return
+	}
 	if err != nil {
 		slog.Error("failed to read request body", "error", err)
 		c.JSON(400, gin.H{"error": "invalid request body"})
 		return
 	}
 
+	start := time.Now()
 	review, err := ProcessAdmissionReview(c.Request.Context(), cache, platformConfig, namespaceFilterCfg, body)
+	kind := ""
+	if review != nil && review.Request != nil {
+		kind = review.Request.Kind.Kind
+	}
+	recordAdmissionDuration(kind, time.Since(start))
 	if err != nil {
+		writeAdmissionError(c, review, err)
+		return
+	}
+	c.JSON(200, review)
+}
+
+// writeAdmissionError responds to an admission request that failed with err. A
+// request the webhook could not decode gets a 400, and one it decoded is
+// denied with the reason, so the API server reports it instead of applying
+// the failurePolicy. Any other error is a 500 with no detail.
+func writeAdmissionError(c *gin.Context, review *admissionv1.AdmissionReview, err error) {
+	if !errors.Is(err, ErrBadRequest) {
 		slog.Error("failed to process admission review", "error", err)
 		c.JSON(500, gin.H{"error": "internal server error"})
 		return
 	}
+	slog.Warn("rejecting bad admission request", "error", err)
+	if review == nil || review.Request == nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	review.Response = &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: err.Error(),
+		},
+	}
 	c.JSON(200, review)
 }
 
+// maxRequestBodyBytes bounds an admission request body both as sent and after
+// decompression. It is above the API server's own 3MiB request limit, allowing
+// for an AdmissionReview carrying both object and oldObject.
+const maxRequestBodyBytes = 8 << 20
+
+// errRequestBodyTooLarge is returned by readRequestBody for bodies over
+// maxRequestBodyBytes.
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// readRequestBody reads the request body, transparently decompressing it when
+// Content-Encoding is gzip or deflate. Bodies over maxRequestBodyBytes, before or
+// after decompression, are rejected with errRequestBodyTooLarge, so a small
+// compressed body cannot inflate without bound.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	var reader io.Reader = r.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate body: %w", err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, maxRequestBodyBytes+1))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || len(body) > maxRequestBodyBytes {
+		return nil, errRequestBodyTooLarge
+	}
+	return body, err
+}
+
 func healthzHandler(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"status": "ok",
@@ -76,6 +524,41 @@ func livezHandler(c *gin.Context) {
 	})
 }
 
+// readyzHandler reports not-ready when checkReady fails.
+func readyzHandler(c *gin.Context) {
+	if err := checkReady(); err != nil {
+		c.JSON(503, gin.H{
+			"status": "not ready",
+			"error":  err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"status": "ok",
+	})
+}
+
+// checkReady returns an error when the startup registry check failed under
+// STARTUP_REGISTRY_CHECK=not-ready, the loaded platform config fails its
+// readiness check (see REQUIRE_EXPLICIT_CONFIG), or the cache backend is
+// unavailable. It backs both /readyz and the gRPC health service.
+func checkReady() error {
+	if err := startupRegistryCheckError(); err != nil {
+		return err
+	}
+	if platformConfig != nil {
+		if err := platformConfig.CheckReady(); err != nil {
+			return err
+		}
+	}
+	if hc, ok := cache.(healthChecker); ok {
+		if err := hc.CheckHealth(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func configureCache() {
 	c, err := newCacheFromEnv()
 	if err != nil {
@@ -83,11 +566,162 @@ func configureCache() {
 		os.Exit(1)
 	}
 	cache = c
+
+	window, err := cacheStaleWindowFromEnv()
+	if err != nil {
+		slog.Error("failed to configure cache", "error", err)
+		os.Exit(1)
+	}
+	if window > 0 {
+		slog.Info("serving stale cache entries while revalidating", "window", window)
+	}
+	cacheStaleWindow = window
+
+	mutableTTL, err := mutableTagTTLFromEnv()
+	if err != nil {
+		slog.Error("failed to configure cache", "error", err)
+		os.Exit(1)
+	}
+	if mutableTTL > 0 {
+		slog.Info("capping cache TTL for mutable tags", "ttl", mutableTTL)
+	}
+	mutableTagTTL = mutableTTL
+
+	for _, ttl := range []struct {
+		name string
+		def  time.Duration
+		dst  *time.Duration
+	}{
+		{"CACHE_FAILURE_TTL", cacheFailureTTLDefault, &cacheFailureTTL},
+		{"CACHE_PARSE_ERROR_TTL", cacheParseErrorTTLDefault, &cacheParseErrorTTL},
+		{"CACHE_NEGATIVE_TTL", cacheNegativeTTLDefault, &cacheNegativeTTL},
+		{"CACHE_NO_RUNNABLE_TTL", cacheNoRunnableTTLDefault, &cacheNoRunnableTTL},
+	} {
+		*ttl.dst, err = cacheTTLFromEnv(ttl.name, ttl.def)
+		if err != nil {
+			slog.Error("failed to configure cache", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	noRunnablePlatformsPolicy, err = noRunnablePlatformsPolicyFromEnv()
+	if err != nil {
+		slog.Error("failed to configure cache", "error", err)
+		os.Exit(1)
+	}
+
+	jitter, err := cacheTTLJitterFromEnv()
+	if err != nil {
+		slog.Error("failed to configure cache", "error", err)
+		os.Exit(1)
+	}
+	cacheTTLJitter = jitter
+
+	cacheKeyPrefix = cacheKeyPrefixFromEnv()
+	if cacheKeyPrefix != "" {
+		slog.Info("using cache key prefix", "prefix", cacheKeyPrefix)
+	}
+}
+
+// cacheKeyPrefixFromEnv builds the cache key prefix from CACHE_KEY_PREFIX and
+// CACHE_VERSION, e.g. "k8smultiarcher:v2:". It is empty when neither is set.
+func cacheKeyPrefixFromEnv() string {
+	prefix := ""
+	if p := os.Getenv("CACHE_KEY_PREFIX"); p != "" {
+		prefix += p + ":"
+	}
+	if v := os.Getenv("CACHE_VERSION"); v != "" {
+		prefix += "v" + v + ":"
+	}
+	return prefix
+}
+
+// mutableTagTTLFromEnv parses MUTABLE_TAG_TTL, the Go duration capping cache
+// TTLs for references not pinned by digest. Unset disables the cap.
+func mutableTagTTLFromEnv() (time.Duration, error) {
+	value := os.Getenv("MUTABLE_TAG_TTL")
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid mutable tag TTL %q: must be a non-negative duration", value)
+	}
+	return ttl, nil
+}
+
+// slowAdmissionThresholdFromEnv parses SLOW_ADMISSION_THRESHOLD, the Go
+// duration above which /mutate requests are counted as slow, applying the
+// default when unset. Zero disables the count.
+func slowAdmissionThresholdFromEnv() (time.Duration, error) {
+	value := cmp.Or(os.Getenv("SLOW_ADMISSION_THRESHOLD"), slowAdmissionThresholdDefault.String())
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold < 0 {
+		return 0, fmt.Errorf("invalid slow admission threshold %q: must be a non-negative duration", value)
+	}
+	return threshold, nil
+}
+
+// cacheTTLFromEnv parses the positive Go duration in the env var name,
+// returning def when unset.
+func cacheTTLFromEnv(name string, def time.Duration) (time.Duration, error) {
+	value := cmp.Or(os.Getenv(name), def.String())
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration", name, value)
+	}
+	return ttl, nil
+}
+
+// noRunnablePlatformsPolicyFromEnv parses NO_RUNNABLE_PLATFORMS, how lookups
+// answer for image indexes with no runnable platform, applying the default
+// when unset.
+func noRunnablePlatformsPolicyFromEnv() (string, error) {
+	policy := cmp.Or(os.Getenv("NO_RUNNABLE_PLATFORMS"), noRunnablePlatformsStrip)
+	switch policy {
+	case noRunnablePlatformsStrip, noRunnablePlatformsFailOpen:
+		return policy, nil
+	}
+	return "", fmt.Errorf(
+		"invalid NO_RUNNABLE_PLATFORMS %q: must be %q or %q",
+		policy, noRunnablePlatformsStrip, noRunnablePlatformsFailOpen,
+	)
+}
+
+// cacheTTLJitterFromEnv parses CACHE_TTL_JITTER, the fraction between 0 and 1
+// by which success and negative cache TTLs are randomized, applying the default
+// when unset.
+func cacheTTLJitterFromEnv() (float64, error) {
+	value := os.Getenv("CACHE_TTL_JITTER")
+	if value == "" {
+		return cacheTTLJitterDefault, nil
+	}
+	jitter, err := strconv.ParseFloat(value, 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		return 0, fmt.Errorf("invalid cache TTL jitter %q: must be a number between 0 and 1", value)
+	}
+	return jitter, nil
+}
+
+// cacheStaleWindowFromEnv parses CACHE_STALE_WHILE_REVALIDATE, the Go duration
+// for which expired success entries are still served while being refreshed.
+// Unset disables stale-while-revalidate.
+func cacheStaleWindowFromEnv() (time.Duration, error) {
+	value := os.Getenv("CACHE_STALE_WHILE_REVALIDATE")
+	if value == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid cache stale-while-revalidate window %q: must be a non-negative duration", value)
+	}
+	return window, nil
 }
 
-// newCacheFromEnv builds the cache backend from the CACHE, CACHE_SIZE, and
-// REDIS_ADDR environment variables. It returns an error instead of exiting so
-// the selection and parsing logic can be unit-tested.
+// newCacheFromEnv builds the cache backend from the CACHE, CACHE_SIZE,
+// CACHE_POLICY, CACHE_MAX_AGE, REDIS_ADDR, and CACHE_L1_TTL environment
+// variables. It returns an error instead of exiting so the selection and parsing
+// logic can be unit-tested.
 func newCacheFromEnv() (Cache, error) {
 	cacheSizeStr := cmp.Or(os.Getenv("CACHE_SIZE"), strconv.Itoa(cacheSizeDefault))
 	cacheSize, err := strconv.Atoi(cacheSizeStr)
@@ -95,20 +729,207 @@ func newCacheFromEnv() (Cache, error) {
 		return nil, fmt.Errorf("invalid cache size %q: %w", cacheSizeStr, err)
 	}
 
+	policy := cmp.Or(os.Getenv("CACHE_POLICY"), cachePolicyDefault)
+	if !slices.Contains(cachePolicies, policy) {
+		return nil, fmt.Errorf("invalid cache policy %q: must be one of %s", policy, strings.Join(cachePolicies, ", "))
+	}
+
+	var maxAge time.Duration
+	if value := os.Getenv("CACHE_MAX_AGE"); value != "" {
+		maxAge, err = time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("invalid cache max age %q: must be a non-negative duration", value)
+		}
+	}
+
 	cacheChoice := cmp.Or(os.Getenv("CACHE"), "inmemory")
 	switch cacheChoice {
 	case "inmemory":
-		slog.Info("using in-memory cache", "size", cacheSize)
-		return NewInMemoryCache(cacheSize), nil
+		slog.Info("using in-memory cache", "size", cacheSize, "policy", policy, "maxAge", maxAge)
+		inMemory := NewInMemoryCacheWithPolicy(cacheSize, policy)
+		inMemory.maxAge = maxAge
+		return inMemory, nil
 	case "redis":
 		redisAddr := cmp.Or(os.Getenv("REDIS_ADDR"), redisAddrDefault)
 		slog.Info("using redis cache", "addr", redisAddr)
 		return NewRedisCache(redisAddr), nil
+	case "tiered":
+		l1TTLStr := cmp.Or(os.Getenv("CACHE_L1_TTL"), cacheL1TTLDefault.String())
+		l1TTL, err := time.ParseDuration(l1TTLStr)
+		if err != nil || l1TTL <= 0 {
+			return nil, fmt.Errorf("invalid cache L1 TTL %q: must be a positive duration", l1TTLStr)
+		}
+		redisAddr := cmp.Or(os.Getenv("REDIS_ADDR"), redisAddrDefault)
+		slog.Info(
+			"using tiered in-memory and redis cache",
+			"size", cacheSize,
+			"policy", policy,
+			"maxAge", maxAge,
+			"l1TTL", l1TTL,
+			"addr", redisAddr,
+		)
+		l1 := NewInMemoryCacheWithPolicy(cacheSize, policy)
+		l1.maxAge = maxAge
+		return NewTieredCache(l1, NewRedisCache(redisAddr), l1TTL), nil
 	default:
 		return nil, fmt.Errorf("invalid cache choice %q", cacheChoice)
 	}
 }
 
+func configureRegistryConcurrency() {
+	n, err := registryMaxConcurrencyFromEnv()
+	if err != nil {
+		slog.Error("failed to configure registry concurrency", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("configured registry concurrency limit", "max", n)
+	registrySlots = make(chan struct{}, n)
+}
+
+// registryTransport is the transport for registry and token exchange requests
+// when REGISTRY_PROXY is set, and nil otherwise, leaving regclient to clone
+// http.DefaultTransport. It is set at startup by configureRegistryProxy.
+var registryTransport *http.Transport
+
+// configureRegistryProxy sends registry requests through REGISTRY_PROXY, using
+// a dedicated transport so the Kubernetes client and other users of
+// http.DefaultTransport are unaffected. Without REGISTRY_PROXY, the default
+// transport already honors HTTP_PROXY, HTTPS_PROXY, and NO_PROXY.
+func configureRegistryProxy() {
+	proxyURL, proxy, err := registryProxyFromEnv()
+	if err != nil {
+		slog.Error("failed to configure registry proxy", "error", err)
+		os.Exit(1)
+	}
+	if proxy == nil {
+		return
+	}
+	slog.Info("sending registry requests through the registry proxy", "proxy", proxyURL.Redacted())
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	registryTransport = transport
+	tokenExchangeClient.Transport = transport
+}
+
+// registryProxyFromEnv parses REGISTRY_PROXY, an http(s) proxy URL, and returns
+// a proxy function sending every request through it except those to hosts
+// matched by NO_PROXY. It returns a nil function when unset.
+func registryProxyFromEnv() (*url.URL, func(*http.Request) (*url.URL, error), error) {
+	value := os.Getenv("REGISTRY_PROXY")
+	if value == "" {
+		return nil, nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid REGISTRY_PROXY %q: must be an http(s) URL", value)
+	}
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  value,
+		HTTPSProxy: value,
+		NoProxy:    cmp.Or(os.Getenv("NO_PROXY"), os.Getenv("no_proxy")),
+	}).ProxyFunc()
+	return u, func(req *http.Request) (*url.URL, error) { return proxyFunc(req.URL) }, nil
+}
+
+// maxIndexEntriesFromEnv parses MAX_INDEX_ENTRIES, the largest number of
+// manifests an image index may list, applying the default when unset. Zero
+// disables the limit.
+func maxIndexEntriesFromEnv() (int, error) {
+	value := cmp.Or(os.Getenv("MAX_INDEX_ENTRIES"), strconv.Itoa(maxIndexEntriesDefault))
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max index entries %q: must be a non-negative integer", value)
+	}
+	return n, nil
+}
+
+// registryMaxConcurrencyFromEnv parses REGISTRY_MAX_CONCURRENCY, the maximum
+// number of concurrent manifest fetches, applying the default when unset.
+func registryMaxConcurrencyFromEnv() (int, error) {
+	maxStr := cmp.Or(os.Getenv("REGISTRY_MAX_CONCURRENCY"), strconv.Itoa(registryMaxConcurrencyDefault))
+	n, err := strconv.Atoi(maxStr)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid registry max concurrency %q: must be a positive integer", maxStr)
+	}
+	return n, nil
+}
+
+func configureRegistryCircuitBreaker() {
+	b, err := registryCircuitBreakerFromEnv()
+	if err != nil {
+		slog.Error("failed to configure registry circuit breaker", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("configured registry circuit breaker",
+		"threshold", b.threshold,
+		"window", b.window,
+		"cooldown", b.cooldown,
+	)
+	registryBreaker = b
+}
+
+// registryCircuitBreakerFromEnv builds the registry circuit breaker from
+// REGISTRY_CIRCUIT_BREAKER_THRESHOLD, REGISTRY_CIRCUIT_BREAKER_WINDOW, and
+// REGISTRY_CIRCUIT_BREAKER_COOLDOWN, applying the defaults when unset.
+func registryCircuitBreakerFromEnv() (*circuitBreaker, error) {
+	thresholdStr := cmp.Or(os.Getenv("REGISTRY_CIRCUIT_BREAKER_THRESHOLD"), strconv.Itoa(breakerThresholdDefault))
+	threshold, err := strconv.Atoi(thresholdStr)
+	if err != nil || threshold < 0 {
+		return nil, fmt.Errorf("invalid circuit breaker threshold %q: must be a non-negative integer", thresholdStr)
+	}
+	windowStr := cmp.Or(os.Getenv("REGISTRY_CIRCUIT_BREAKER_WINDOW"), breakerWindowDefault.String())
+	window, err := time.ParseDuration(windowStr)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid circuit breaker window %q: must be a positive duration", windowStr)
+	}
+	cooldownStr := cmp.Or(os.Getenv("REGISTRY_CIRCUIT_BREAKER_COOLDOWN"), breakerCooldownDefault.String())
+	cooldown, err := time.ParseDuration(cooldownStr)
+	if err != nil || cooldown <= 0 {
+		return nil, fmt.Errorf("invalid circuit breaker cooldown %q: must be a positive duration", cooldownStr)
+	}
+	return newCircuitBreaker(threshold, window, cooldown), nil
+}
+
+func configureRegistryRateLimits() {
+	limits, err := registryRateLimitsFromEnv()
+	if err != nil {
+		slog.Error("failed to configure registry rate limits", "error", err)
+		os.Exit(1)
+	}
+	for registry, limiter := range limits {
+		slog.Info("configured registry rate limit", "registry", registry, "lookupsPerSecond", float64(limiter.Limit()))
+	}
+	registryRateLimits = limits
+}
+
+// registryRateLimitsFromEnv parses REGISTRY_RATE_LIMIT, a comma-separated list
+// of registry=N/unit entries such as "docker.io=1/s,ghcr.io=100/m", where unit
+// is s, m, or h. Each registry gets a token bucket allowing N lookups per unit
+// with a burst of one; see registryRateLimits. Unset disables rate limiting.
+func registryRateLimitsFromEnv() (map[string]*rate.Limiter, error) {
+	value := os.Getenv("REGISTRY_RATE_LIMIT")
+	if value == "" {
+		return nil, nil
+	}
+	units := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	limits := map[string]*rate.Limiter{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		registry, limit, ok := strings.Cut(entry, "=")
+		count, unit, okRate := strings.Cut(limit, "/")
+		n, err := strconv.ParseFloat(count, 64)
+		per, okUnit := units[unit]
+		if !ok || !okRate || !okUnit || err != nil || n <= 0 || registry == "" {
+			return nil, fmt.Errorf("invalid registry rate limit %q: must be registry=N/unit with unit s, m, or h", entry)
+		}
+		limits[strings.ToLower(registry)] = rate.NewLimiter(rate.Limit(n/per.Seconds()), 1)
+	}
+	return limits, nil
+}
+
 // serverSettings holds the resolved listen address and TLS configuration.
 type serverSettings struct {
 	addr       string
@@ -142,8 +963,34 @@ func serverSettingsFromEnv() serverSettings {
 	return s
 }
 
+// validateTLS checks that the certificate and key files are readable and form a
+// valid keypair, so a missing or mismatched secret mount fails at startup with
+// a clear message instead of deep inside RunTLS. It does nothing when TLS is
+// disabled.
+func (s serverSettings) validateTLS() error {
+	if !s.tlsEnabled {
+		return nil
+	}
+	certPEM, err := os.ReadFile(s.certPath)
+	if err != nil {
+		return fmt.Errorf("TLS is enabled but CERT_PATH %s is not readable: %w", s.certPath, err)
+	}
+	keyPEM, err := os.ReadFile(s.keyPath)
+	if err != nil {
+		return fmt.Errorf("TLS is enabled but KEY_PATH %s is not readable: %w", s.keyPath, err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("TLS is enabled but %s and %s are not a valid keypair: %w", s.certPath, s.keyPath, err)
+	}
+	return nil
+}
+
 func startServer(r *gin.Engine) {
 	s := serverSettingsFromEnv()
+	if err := s.validateTLS(); err != nil {
+		slog.Error("invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
 	if s.tlsEnabled {
 		if err := r.RunTLS(s.addr, s.certPath, s.keyPath); err != nil {
 			slog.Error("failed to start TLS server", "error", err)
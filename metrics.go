@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// Admission outcomes recorded in k8smultiarcher_admission_requests_total.
+const (
+	admissionOutcomeMutated   = "mutated"
+	admissionOutcomeUnchanged = "unchanged"
+	admissionOutcomeRejected  = "rejected"
+	admissionOutcomeError     = "error"
+)
+
+// Reasons recorded in k8smultiarcher_config_fallback_total when configuration
+// is ignored in favour of a default.
+const (
+	// configFallbackInvalidEntry is a PLATFORM_TOLERATIONS entry that was skipped.
+	configFallbackInvalidEntry = "invalid_entry"
+	// configFallbackInvalidField is a toleration operator, effect, or seconds
+	// value that was replaced by its default or dropped.
+	configFallbackInvalidField = "invalid_field"
+	// configFallbackDefaultMapping is the default mapping used although
+	// platform-toleration env vars are set.
+	configFallbackDefaultMapping = "default_mapping"
+	// configFallbackIgnoredIndex is an indexed TOLERATION_*_<n> variable set
+	// past a gap in the sequence, or at index 0, and therefore not loaded.
+	configFallbackIgnoredIndex = "ignored_index"
+)
+
+// Reasons recorded in k8smultiarcher_namespace_skipped_total when a namespace
+// is excluded from mutation.
+const (
+	// namespaceSkipIgnoreList is a namespace in NAMESPACES_TO_IGNORE or matching
+	// NAMESPACES_TO_IGNORE_REGEX.
+	namespaceSkipIgnoreList = "ignore_list"
+	// namespaceSkipSelector is a namespace not matching NAMESPACE_SELECTOR.
+	namespaceSkipSelector = "selector"
+	// namespaceSkipDisabledAnnotation is a namespace carrying the disabled
+	// annotation.
+	namespaceSkipDisabledAnnotation = "disabled_annotation"
+)
+
+// slowAdmissionThresholdDefault is half the API server's default webhook
+// timeout of 10s.
+const slowAdmissionThresholdDefault = 5 * time.Second
+
+// slowAdmissionThreshold is the /mutate latency above which a request is
+// counted in k8smultiarcher_admission_slow_requests_total. It is set at startup
+// from SLOW_ADMISSION_THRESHOLD; zero disables the counter.
+var slowAdmissionThreshold = slowAdmissionThresholdDefault
+
+// metricsNamespaceLabel controls whether admission metrics carry the request
+// namespace. It is set at startup from METRICS_NAMESPACE_LABEL; when false the
+// namespace label is left empty to bound cardinality.
+var metricsNamespaceLabel = true
+
+// Metrics exported on /metrics via the default Prometheus registry.
+var (
+	registryRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "k8smultiarcher_registry_requests_in_flight",
+		Help: "Number of registry manifest requests currently holding a concurrency slot.",
+	})
+	registryCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "k8smultiarcher_registry_circuit_state",
+		Help: "Circuit breaker state per registry host: 0 closed, 1 open, 2 half-open.",
+	}, []string{"registry"})
+	registryCircuitShortCircuits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_registry_circuit_short_circuits_total",
+		Help: "Registry lookups skipped because the registry's circuit breaker was open.",
+	}, []string{"registry"})
+	registryRateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8smultiarcher_registry_rate_limit_wait_seconds",
+		Help:    "Time registry lookups waited for the registry's REGISTRY_RATE_LIMIT token bucket.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry"})
+	admissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_admission_requests_total",
+		Help: "Admission requests handled, by object kind, namespace, and outcome.",
+	}, []string{"kind", "namespace", "outcome"})
+	admissionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "k8smultiarcher_admission_duration_seconds",
+		Help: "End-to-end /mutate handler latency, by object kind.",
+		// Extends the default buckets to the API server's 30s maximum webhook timeout.
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 15, 30},
+	}, []string{"kind"})
+	admissionSlowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_admission_slow_requests_total",
+		Help: "Admission requests slower than SLOW_ADMISSION_THRESHOLD, by object kind.",
+	}, []string{"kind"})
+	configFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_config_fallback_total",
+		Help: "Configuration values ignored in favour of a default when loading the config, by reason.",
+	}, []string{"reason"})
+	nodePlatformTaintsAppeared = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_node_platform_taints_appeared_total",
+		Help: "Taints tolerated by a platform mapping that first appeared on a node after startup, by platform.",
+	}, []string{"platform"})
+	namespaceSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8smultiarcher_namespace_skipped_total",
+		Help: "Admission requests left unmutated because of namespace filtering, by reason.",
+	}, []string{"reason"})
+)
+
+// recordAdmissionOutcome counts an admission request outcome, omitting the
+// namespace when METRICS_NAMESPACE_LABEL is disabled.
+func recordAdmissionOutcome(kind, namespace, outcome string) {
+	if !metricsNamespaceLabel {
+		namespace = ""
+	}
+	admissionRequests.WithLabelValues(kind, namespace, outcome).Inc()
+}
+
+// recordAdmissionDuration observes the latency of an admission request and
+// counts it as slow when it exceeds slowAdmissionThreshold.
+func recordAdmissionDuration(kind string, elapsed time.Duration) {
+	admissionDuration.WithLabelValues(kind).Observe(elapsed.Seconds())
+	if slowAdmissionThreshold > 0 && elapsed > slowAdmissionThreshold {
+		admissionSlowRequests.WithLabelValues(kind).Inc()
+		slog.Warn("slow admission request", "kind", kind, "elapsed", elapsed, "threshold", slowAdmissionThreshold)
+	}
+}
+
+// admissionOutcome classifies the result of processing an admission review.
+func admissionOutcome(review *admissionv1.AdmissionReview, err error) string {
+	if err != nil || review == nil || review.Response == nil {
+		return admissionOutcomeError
+	}
+	if !review.Response.Allowed {
+		return admissionOutcomeRejected
+	}
+	patch := bytes.TrimSpace(review.Response.Patch)
+	if len(patch) == 0 || bytes.Equal(patch, []byte("[]")) || bytes.Equal(patch, []byte("null")) {
+		return admissionOutcomeUnchanged
+	}
+	return admissionOutcomeMutated
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/pager"
+)
+
+const (
+	// nodeTaintsTTL is how long the cluster's node taints are reused before
+	// the nodes are listed again.
+	nodeTaintsTTL = time.Minute
+	// nodeTaintsTimeout bounds listing the nodes through the API.
+	nodeTaintsTimeout = 5 * time.Second
+)
+
+// clusterTaints caches the taints present on the cluster's nodes for
+// MATCH_EXISTING_TAINTS.
+var clusterTaints = newNodeTaintCache()
+
+// nodeTaintCache holds the distinct taints of the cluster's nodes, listed at
+// most once per nodeTaintsTTL. Failed lists are not cached. Nodes are read
+// from the WATCH_NODES informer when it runs, and listed through the API
+// otherwise.
+type nodeTaintCache struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	lister    corev1listers.NodeLister
+	taints    []corev1.Taint
+	fetchedAt time.Time
+	// generation is bumped by Invalidate, so a list that started before an
+	// invalidation is not cached.
+	generation int
+}
+
+func newNodeTaintCache() *nodeTaintCache {
+	return &nodeTaintCache{now: time.Now}
+}
+
+// useLister makes the cache read nodes from lister instead of the API.
+func (c *nodeTaintCache) useLister(lister corev1listers.NodeLister) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lister = lister
+}
+
+// Taints returns the distinct taints across all nodes, listing the nodes when
+// the cached set is older than nodeTaintsTTL. The lock is not held while
+// listing, so concurrent callers may list at the same time.
+func (c *nodeTaintCache) Taints(ctx context.Context) ([]corev1.Taint, error) {
+	c.mu.Lock()
+	if !c.fetchedAt.IsZero() && c.now().Sub(c.fetchedAt) < nodeTaintsTTL {
+		defer c.mu.Unlock()
+		return c.taints, nil
+	}
+	lister, generation := c.lister, c.generation
+	c.mu.Unlock()
+
+	var nodes []*corev1.Node
+	var err error
+	if lister != nil {
+		nodes, err = lister.List(labels.Everything())
+	} else {
+		nodes, err = listNodes(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	taints := []corev1.Taint{}
+	for _, node := range nodes {
+		for _, taint := range node.Spec.Taints {
+			// TimeAdded differs per node and is irrelevant to toleration matching.
+			taint.TimeAdded = nil
+			if !slices.Contains(taints, taint) {
+				taints = append(taints, taint)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.taints, c.fetchedAt = taints, c.now()
+	}
+	return taints, nil
+}
+
+// listNodes lists the cluster's nodes through the API, a page at a time.
+func listNodes(ctx context.Context) ([]*corev1.Node, error) {
+	client, err := getKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, nodeTaintsTimeout)
+	defer cancel()
+	var nodes []*corev1.Node
+	p := pager.New(pager.SimplePageFunc(func(opts metav1.ListOptions) (runtime.Object, error) {
+		return client.CoreV1().Nodes().List(ctx, opts)
+	}))
+	err = p.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+		if node, ok := obj.(*corev1.Node); ok {
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	return nodes, err
+}
+
+// Invalidate discards the cached taints so the next call to Taints lists the
+// nodes again.
+func (c *nodeTaintCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.taints, c.fetchedAt = nil, time.Time{}
+	c.generation++
+}
+
+// filterTolerationsByClusterTaints returns the tolerations that tolerate at
+// least one taint present on the cluster's nodes. When the nodes cannot be
+// listed, tolerations are returned unfiltered.
+func filterTolerationsByClusterTaints(ctx context.Context, tolerations []corev1.Toleration) []corev1.Toleration {
+	if len(tolerations) == 0 {
+		return tolerations
+	}
+	taints, err := clusterTaints.Taints(ctx)
+	if err != nil {
+		slog.Warn("failed to list node taints; adding tolerations unfiltered", "error", err)
+		return tolerations
+	}
+	return slices.DeleteFunc(tolerations, func(toleration corev1.Toleration) bool {
+		if slices.ContainsFunc(taints, func(taint corev1.Taint) bool { return toleratesTaint(toleration, taint) }) {
+			return false
+		}
+		slog.Debug("dropping toleration matching no node taint", "key", toleration.Key, "value", toleration.Value)
+		return true
+	})
+}
+
+// toleratesTaint reports whether toleration tolerates taint, following the
+// scheduler's Equal and Exists operator semantics.
+func toleratesTaint(toleration corev1.Toleration, taint corev1.Taint) bool {
+	if toleration.Effect != "" && toleration.Effect != taint.Effect {
+		return false
+	}
+	if toleration.Key != "" && toleration.Key != taint.Key {
+		return false
+	}
+	switch toleration.Operator {
+	case corev1.TolerationOpExists:
+		return true
+	case "", corev1.TolerationOpEqual:
+		return toleration.Value == taint.Value
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// withClusterTaints resets the node taint cache for the duration of the test.
+func withClusterTaints(t *testing.T) *nodeTaintCache {
+	t.Helper()
+	prev := clusterTaints
+	clusterTaints = newNodeTaintCache()
+	t.Cleanup(func() { clusterTaints = prev })
+	return clusterTaints
+}
+
+func taintedNode(name string, taints ...corev1.Taint) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{Taints: taints},
+	}
+}
+
+func TestGetTolerationsForPlatforms_MatchExistingTaints(t *testing.T) {
+	withClusterTaints(t)
+	now := metav1.Now()
+	withKubeClient(t, fake.NewSimpleClientset(
+		taintedNode("arm-1", corev1.Taint{
+			Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule, TimeAdded: &now,
+		}),
+		taintedNode("arm-2", corev1.Taint{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule}),
+		taintedNode("amd-1"),
+	))
+
+	config := goldenConfig()
+	config.MatchExistingTaints = true
+	platforms := []string{"linux/arm64", "linux/amd64"}
+	tolerations := config.GetTolerationsForPlatforms(context.Background(), platforms)
+	if len(tolerations) != 1 || tolerations[0].Value != "arm64" {
+		t.Errorf("tolerations = %v, want only the arm64 toleration matching a node taint", tolerations)
+	}
+
+	config.MatchExistingTaints = false
+	if got := config.GetTolerationsForPlatforms(context.Background(), platforms); len(got) != 2 {
+		t.Errorf("tolerations = %v, want both without MATCH_EXISTING_TAINTS", got)
+	}
+}
+
+func TestGetTolerationsForPlatforms_MatchExistingTaintsListError(t *testing.T) {
+	withClusterTaints(t)
+	withKubeClientErr(t, errors.New("not in a cluster"))
+
+	config := goldenConfig()
+	config.MatchExistingTaints = true
+	platforms := []string{"linux/arm64", "linux/amd64"}
+	if got := config.GetTolerationsForPlatforms(context.Background(), platforms); len(got) != 2 {
+		t.Errorf("tolerations = %v, want both unfiltered when nodes cannot be listed", got)
+	}
+}
+
+func TestNodeTaintCache_TTL(t *testing.T) {
+	c := withClusterTaints(t)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	client := fake.NewSimpleClientset(taintedNode("arm-1", corev1.Taint{Key: "arch", Value: "arm64"}))
+	withKubeClient(t, client)
+	if taints, err := c.Taints(context.Background()); err != nil || len(taints) != 1 {
+		t.Fatalf("Taints() = %v, %v; want the arm64 taint", taints, err)
+	}
+
+	if err := client.CoreV1().Nodes().Delete(context.Background(), "arm-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if taints, _ := c.Taints(context.Background()); len(taints) != 1 {
+		t.Errorf("Taints() = %v, want the cached taint within the TTL", taints)
+	}
+
+	now = now.Add(nodeTaintsTTL)
+	if taints, _ := c.Taints(context.Background()); len(taints) != 0 {
+		t.Errorf("Taints() = %v, want the nodes listed again after the TTL", taints)
+	}
+}
+
+func TestToleratesTaint(t *testing.T) {
+	taint := corev1.Taint{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule}
+	tests := []struct {
+		name       string
+		toleration corev1.Toleration
+		want       bool
+	}{
+		{
+			name:       "equal",
+			toleration: corev1.Toleration{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule},
+			want:       true,
+		},
+		{
+			name:       "other value",
+			toleration: corev1.Toleration{Key: "arch", Value: "amd64", Operator: corev1.TolerationOpEqual},
+		},
+		{
+			name:       "other effect",
+			toleration: corev1.Toleration{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoExecute},
+		},
+		{
+			name:       "exists",
+			toleration: corev1.Toleration{Key: "arch", Operator: corev1.TolerationOpExists},
+			want:       true,
+		},
+		{
+			name:       "catch-all",
+			toleration: corev1.Toleration{Operator: corev1.TolerationOpExists},
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toleratesTaint(tt.toleration, taint); got != tt.want {
+				t.Errorf("toleratesTaint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeWatcher_Observe(t *testing.T) {
+	c := withClusterTaints(t)
+	c.fetchedAt = time.Now()
+	counter := nodePlatformTaintsAppeared.WithLabelValues(linuxArm64)
+	before := testutil.ToFloat64(counter)
+
+	w := newNodeWatcher(goldenConfig().Mappings)
+	amdTaint := corev1.Taint{Key: "arch", Value: "amd64", Effect: corev1.TaintEffectNoSchedule}
+	w.observe(taintedNode("amd-1", amdTaint), true)
+	w.observe(taintedNode("gpu-1", corev1.Taint{Key: "gpu", Value: "true"}), false)
+	w.observe(taintedNode("amd-2", amdTaint), false)
+	if c.fetchedAt.IsZero() {
+		t.Error("expected the node taint cache to be kept for initial, unrelated, or already seen taints")
+	}
+
+	armTaint := corev1.Taint{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule}
+	w.observe(taintedNode("arm-1", armTaint), false)
+	w.observe(taintedNode("arm-2", armTaint), false)
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("appeared = %v, want 1 for a new arm64 taint", got)
+	}
+	if !c.fetchedAt.IsZero() {
+		t.Error("expected the node taint cache to be invalidated")
+	}
+}
+
+func TestStartNodeWatcher(t *testing.T) {
+	withClusterTaints(t)
+	client := fake.NewSimpleClientset()
+	withKubeClient(t, client)
+	counter := nodePlatformTaintsAppeared.WithLabelValues(linuxArm64)
+	before := testutil.ToFloat64(counter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := startNodeWatcher(ctx, goldenConfig().Mappings); err != nil {
+		t.Fatalf("startNodeWatcher() = %v", err)
+	}
+	node := taintedNode("arm-1", corev1.Taint{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule})
+	if _, err := client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(counter)-before != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the new arm64 taint to be reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The node taint cache now reads the informer's nodes, not the API.
+	client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("node list should not be needed")
+	})
+	if taints, err := clusterTaints.Taints(ctx); err != nil || len(taints) != 1 || taints[0].Value != "arm64" {
+		t.Errorf("Taints() = %v, %v; want the arm64 taint from the informer", taints, err)
+	}
+}
+
+func TestStartNodeWatcher_ClientError(t *testing.T) {
+	withKubeClientErr(t, errors.New("not in a cluster"))
+	if err := startNodeWatcher(context.Background(), goldenConfig().Mappings); err == nil {
+		t.Error("expected an error when the kubernetes client is unavailable")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// nodeWatchSyncTimeout bounds the initial node list of the WATCH_NODES
+// informer, so missing RBAC fails startup instead of hanging it.
+const nodeWatchSyncTimeout = 30 * time.Second
+
+// watchNodes enables the node informer reporting platform taints that appear
+// after startup. It is set at startup from WATCH_NODES.
+var watchNodes bool
+
+// nodeWatcher tracks the taints tolerated by platform-toleration mappings on
+// the cluster's nodes. The webhook only acts at admission, so workloads
+// admitted before a platform's nodes joined carry no toleration for them;
+// the watcher makes such changes visible.
+type nodeWatcher struct {
+	mappings []PlatformTolerationMapping
+
+	mu   sync.Mutex
+	seen []corev1.Taint
+}
+
+func newNodeWatcher(mappings []PlatformTolerationMapping) *nodeWatcher {
+	return &nodeWatcher{mappings: mappings}
+}
+
+// platformFor returns the platform of the first mapping whose toleration
+// tolerates taint.
+func (w *nodeWatcher) platformFor(taint corev1.Taint) (string, bool) {
+	for _, m := range w.mappings {
+		if toleratesTaint(m.Toleration, taint) {
+			return m.Platform, true
+		}
+	}
+	return "", false
+}
+
+// observe records the platform taints of node. A taint seen for the first time
+// outside the informer's initial list is counted and logged, and the node taint
+// cache is invalidated so MATCH_EXISTING_TAINTS picks it up immediately.
+func (w *nodeWatcher) observe(node *corev1.Node, initial bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, taint := range node.Spec.Taints {
+		taint.TimeAdded = nil
+		platform, ok := w.platformFor(taint)
+		if !ok || slices.Contains(w.seen, taint) {
+			continue
+		}
+		w.seen = append(w.seen, taint)
+		if initial {
+			continue
+		}
+		nodePlatformTaintsAppeared.WithLabelValues(platform).Inc()
+		clusterTaints.Invalidate()
+		slog.Info("new platform taint on the cluster's nodes; workloads admitted earlier may need rescheduling to use it",
+			"node", node.Name, "platform", platform, "key", taint.Key, "value", taint.Value, "effect", taint.Effect)
+	}
+}
+
+// startNodeWatcher starts an informer on Nodes that feeds a nodeWatcher for
+// mappings until ctx is done, returning once the nodes have been listed. Once
+// synced, the node taint cache reads nodes from the informer instead of the
+// API. It requires list and watch permission on nodes.
+func startNodeWatcher(ctx context.Context, mappings []PlatformTolerationMapping) error {
+	client, err := getKubeClient()
+	if err != nil {
+		return err
+	}
+	w := newNodeWatcher(mappings)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	nodes := factory.Core().V1().Nodes()
+	_, err = nodes.Informer().AddEventHandler(toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj any, isInInitialList bool) {
+			if node, ok := obj.(*corev1.Node); ok {
+				w.observe(node, isInInitialList)
+			}
+		},
+		UpdateFunc: func(_, obj any) {
+			if node, ok := obj.(*corev1.Node); ok {
+				w.observe(node, false)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, nodeWatchSyncTimeout)
+	defer cancel()
+	for typ, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync %v informer", typ)
+		}
+	}
+	clusterTaints.useLister(nodes.Lister())
+	slog.Info("watching nodes for new platform taints")
+	return nil
+}
@@ -5,12 +5,21 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/regclient/regclient/config"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -33,7 +42,83 @@ var (
 	kubeClientErr  error
 )
 
-// GetRegistryHosts returns registry host configurations derived from Kubernetes
+// staticRegistryHosts holds credentials configured for all requests via
+// REGISTRY_AUTH and DOCKER_CONFIG. It is set at startup by
+// LoadStaticRegistryHosts.
+var staticRegistryHosts []config.Host
+
+// kubeAPIMaxRetriesDefault is the default of kubeAPIMaxRetries.
+const kubeAPIMaxRetriesDefault = 2
+
+// kubeAPIMaxRetries is how many times a ServiceAccount or Secret get that
+// failed transiently is retried while resolving registry credentials. It is
+// set at startup from K8S_API_MAX_RETRIES.
+var kubeAPIMaxRetries = kubeAPIMaxRetriesDefault
+
+// kubeAPIRetryBackoff is the delay before the first retry of a Kubernetes API
+// call, doubling for each further retry.
+var kubeAPIRetryBackoff = 100 * time.Millisecond
+
+// webhookNamespace is the namespace the webhook runs in, set at startup from
+// POD_NAMESPACE, which the Deployment fills in via the downward API.
+var webhookNamespace string
+
+// globalPullSecrets names image pull secrets in webhookNamespace whose
+// credentials are used for every request. It is set at startup from
+// GLOBAL_PULL_SECRETS.
+var globalPullSecrets []string
+
+// GetRegistryHosts returns the registry host configurations to use for the
+// given PodSpec: cloud provider tokens (when ECR_AUTH or GCP_AUTH is enabled)
+// and exchanged service account tokens (for REGISTRY_TOKEN_EXCHANGE registries),
+// the static REGISTRY_AUTH credentials, the GLOBAL_PULL_SECRETS in the
+// webhook's namespace, and credentials from the pod's image pull secrets. For
+// the same registry, pull secrets take precedence over global pull secrets,
+// then static credentials, then cloud provider tokens.
+func GetRegistryHosts(ctx context.Context, namespace string, podSpec *corev1.PodSpec) []config.Host {
+	cloudHosts := append(ecrRegistryHosts(ctx, podSpec), gcpRegistryHosts(ctx, podSpec)...)
+	cloudHosts = append(cloudHosts, tokenExchangeRegistryHosts(ctx, podSpec)...)
+	base := mergeRegistryHosts(cloudHosts, staticRegistryHosts)
+	base = mergeRegistryHosts(base, globalPullSecretHosts(ctx))
+	return mergeRegistryHosts(base, getPullSecretHosts(ctx, namespace, podSpec))
+}
+
+// loadGlobalPullSecrets parses GLOBAL_PULL_SECRETS, a comma-separated list of
+// secret names, and returns them with POD_NAMESPACE, where they are read from.
+//
+// Reading them only needs get on secrets in the webhook's own namespace, which
+// a namespaced Role grants; the ClusterRole that pod pull secrets require
+// already covers it.
+func loadGlobalPullSecrets() (namespace string, names []string, err error) {
+	namespace = os.Getenv("POD_NAMESPACE")
+	for _, name := range strings.Split(os.Getenv("GLOBAL_PULL_SECRETS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 && namespace == "" {
+		return "", nil, errors.New("GLOBAL_PULL_SECRETS requires POD_NAMESPACE to be set to the webhook's namespace")
+	}
+	return namespace, names, nil
+}
+
+// globalPullSecretHosts returns registry host configurations from the
+// GLOBAL_PULL_SECRETS in the webhook's namespace, regardless of the namespace
+// of the object being admitted. It returns nil when none are configured or the
+// Kubernetes client is unavailable.
+func globalPullSecretHosts(ctx context.Context) []config.Host {
+	if webhookNamespace == "" || len(globalPullSecrets) == 0 {
+		return nil
+	}
+	client, err := getKubeClient()
+	if err != nil {
+		slog.Debug("kubernetes client unavailable for global pull secrets", "error", err)
+		return nil
+	}
+	return secretRegistryHosts(ctx, client, webhookNamespace, globalPullSecrets)
+}
+
+// getPullSecretHosts returns registry host configurations derived from Kubernetes
 // image pull secrets referenced by the given PodSpec in the specified namespace.
 // It uses the in-cluster Kubernetes client to resolve imagePullSecrets and
 // fetch the associated Secret resources, converting them into []config.Host
@@ -41,7 +126,7 @@ var (
 // unavailable, it returns nil. When no applicable image pull secrets are found
 // or all lookups fail, it returns an empty slice. The provided context is used
 // for all Kubernetes API calls.
-func GetRegistryHosts(ctx context.Context, namespace string, podSpec *corev1.PodSpec) []config.Host {
+func getPullSecretHosts(ctx context.Context, namespace string, podSpec *corev1.PodSpec) []config.Host {
 	if namespace == "" || podSpec == nil {
 		return nil
 	}
@@ -56,17 +141,23 @@ func GetRegistryHosts(ctx context.Context, namespace string, podSpec *corev1.Pod
 	if len(secretNames) == 0 {
 		return nil
 	}
+	return secretRegistryHosts(ctx, client, namespace, secretNames)
+}
 
+// secretRegistryHosts loads the named image pull secrets from namespace and
+// returns their registry host configurations. Secrets that cannot be read or
+// parsed are logged and skipped.
+func secretRegistryHosts(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string,
+	secretNames []string,
+) []config.Host {
 	hosts := []config.Host{}
 	for _, secretName := range secretNames {
-		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
-		if err != nil {
-			slog.Warn("failed to load image pull secret", "secret", secretName, "namespace", namespace, "error", err)
-			continue
-		}
-		secretHosts, err := hostsFromSecret(secret)
+		secretHosts, err := loadSecretHosts(ctx, client, namespace, secretName)
 		if err != nil {
-			slog.Warn("failed to parse image pull secret", "secret", secretName, "namespace", namespace, "error", err)
+			slog.Warn("failed to use image pull secret", "secret", secretName, "namespace", namespace, "error", err)
 			continue
 		}
 		hosts = append(hosts, secretHosts...)
@@ -75,6 +166,131 @@ func GetRegistryHosts(ctx context.Context, namespace string, podSpec *corev1.Pod
 	return hosts
 }
 
+// loadSecretHosts reads the named image pull secret from namespace and returns
+// its registry host configurations.
+func loadSecretHosts(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string,
+	secretName string,
+) ([]config.Host, error) {
+	secret, err := withKubeAPIRetry(ctx, func(ctx context.Context) (*corev1.Secret, error) {
+		return client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load: %w", err)
+	}
+	hosts, err := hostsFromSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	return hosts, nil
+}
+
+// mergeRegistryHosts returns overrides followed by each base host whose
+// registry name is not already present in overrides. When base is empty,
+// overrides is returned unchanged.
+func mergeRegistryHosts(base, overrides []config.Host) []config.Host {
+	if len(base) == 0 {
+		return overrides
+	}
+	merged := make([]config.Host, 0, len(base)+len(overrides))
+	merged = append(merged, overrides...)
+	for _, host := range base {
+		if !slices.ContainsFunc(overrides, func(o config.Host) bool { return o.Name == host.Name }) {
+			merged = append(merged, host)
+		}
+	}
+	return merged
+}
+
+// LoadStaticRegistryHosts loads the registry host configurations applied to
+// every request from DOCKER_CONFIG and REGISTRY_AUTH. REGISTRY_AUTH entries take
+// precedence over DOCKER_CONFIG for the same registry.
+func LoadStaticRegistryHosts() ([]config.Host, error) {
+	dockerConfigHosts, err := loadDockerConfigHosts()
+	if err != nil {
+		return nil, err
+	}
+	registryAuthHosts, err := loadRegistryAuthHosts()
+	if err != nil {
+		return nil, err
+	}
+	return mergeRegistryHosts(dockerConfigHosts, registryAuthHosts), nil
+}
+
+// loadDockerConfigHosts reads the docker config file named by DOCKER_CONFIG,
+// which may be the path to a config.json or to the directory containing it, and
+// converts its auths into registry host configurations.
+func loadDockerConfigHosts() ([]config.Host, error) {
+	path := os.Getenv("DOCKER_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "config.json")
+	}
+
+	configJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DOCKER_CONFIG: %w", err)
+	}
+	var dockerConfig dockerConfigJSON
+	if err := json.Unmarshal(configJSON, &dockerConfig); err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_CONFIG %q: %w", path, err)
+	}
+	hosts := hostsFromAuths(dockerConfig.Auths)
+	slog.Info("loaded docker config registry credentials", "path", path, "count", len(hosts))
+	return hosts, nil
+}
+
+// loadRegistryAuthHosts parses REGISTRY_AUTH into registry host
+// configurations. The value is either a JSON object mapping registry to
+// "user:pass", or a comma-separated list of registry=user:pass entries. A
+// malformed value is rejected with an error.
+func loadRegistryAuthHosts() ([]config.Host, error) {
+	value := strings.TrimSpace(os.Getenv("REGISTRY_AUTH"))
+	if value == "" {
+		return nil, nil
+	}
+
+	credentials := map[string]string{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), &credentials); err != nil {
+			return nil, fmt.Errorf("invalid REGISTRY_AUTH JSON: %w", err)
+		}
+	} else {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			registry, userPass, ok := strings.Cut(entry, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid REGISTRY_AUTH entry %q: expected registry=user:pass", entry)
+			}
+			credentials[strings.TrimSpace(registry)] = userPass
+		}
+	}
+
+	hosts := []config.Host{}
+	for _, registry := range slices.Sorted(maps.Keys(credentials)) {
+		user, pass, ok := strings.Cut(credentials[registry], ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid REGISTRY_AUTH credentials for %q: expected user:pass", registry)
+		}
+		if !config.HostValidate(registry) {
+			return nil, fmt.Errorf("invalid REGISTRY_AUTH registry %q", registry)
+		}
+		host := config.HostNewName(registry)
+		host.User = user
+		host.Pass = pass
+		hosts = append(hosts, *host)
+	}
+	slog.Info("loaded static registry credentials", "count", len(hosts))
+	return hosts, nil
+}
+
 // kubeClientFactory resolves the Kubernetes client used to read Secrets,
 // ServiceAccounts, and Namespaces. It is a package var so tests can substitute a
 // fake client without manipulating the sync.Once-guarded singleton below.
@@ -112,32 +328,100 @@ func collectImagePullSecrets(
 		}
 	}
 
-	serviceAccountName := podSpec.ServiceAccountName
-	if serviceAccountName == "" {
-		serviceAccountName = "default"
-	}
-	serviceAccount, err := client.CoreV1().ServiceAccounts(namespace).Get(ctx, serviceAccountName, metav1.GetOptions{})
-	if err != nil {
-		slog.Debug(
-			"failed to load service account",
-			"serviceAccount",
-			serviceAccountName,
-			"namespace",
-			namespace,
-			"error",
-			err,
-		)
-		return mapKeys(secretNames)
-	}
-	for _, ref := range serviceAccount.ImagePullSecrets {
-		if ref.Name != "" {
-			secretNames[ref.Name] = struct{}{}
+	for _, serviceAccountName := range podServiceAccountNames(podSpec) {
+		serviceAccount, err := withKubeAPIRetry(ctx, func(ctx context.Context) (*corev1.ServiceAccount, error) {
+			return client.CoreV1().ServiceAccounts(namespace).Get(ctx, serviceAccountName, metav1.GetOptions{})
+		})
+		if err != nil {
+			slog.Debug(
+				"failed to load service account",
+				"serviceAccount",
+				serviceAccountName,
+				"namespace",
+				namespace,
+				"error",
+				err,
+			)
+			continue
+		}
+		for _, ref := range serviceAccount.ImagePullSecrets {
+			if ref.Name != "" {
+				secretNames[ref.Name] = struct{}{}
+			}
 		}
 	}
 
 	return mapKeys(secretNames)
 }
 
+// withKubeAPIRetry calls get, retrying up to kubeAPIMaxRetries times with
+// exponential backoff while it fails transiently, so an API server blip does
+// not leave a lookup without credentials.
+func withKubeAPIRetry[T any](ctx context.Context, get func(context.Context) (T, error)) (T, error) {
+	delay := kubeAPIRetryBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := get(ctx)
+		if err == nil || attempt >= kubeAPIMaxRetries || !isTransientKubeAPIError(err) {
+			return result, err
+		}
+		slog.Debug("retrying kubernetes API call", "attempt", attempt+1, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// isTransientKubeAPIError reports whether a failed Kubernetes API call may
+// succeed when retried: server errors, throttling, and errors reaching the API
+// server. NotFound and other client errors are definitive.
+func isTransientKubeAPIError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		code := status.Status().Code
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// kubeAPIMaxRetriesFromEnv parses K8S_API_MAX_RETRIES, applying the default
+// when unset. Zero disables retries.
+func kubeAPIMaxRetriesFromEnv() (int, error) {
+	value := os.Getenv("K8S_API_MAX_RETRIES")
+	if value == "" {
+		return kubeAPIMaxRetriesDefault, nil
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		return 0, fmt.Errorf("invalid K8S_API_MAX_RETRIES %q: must be a non-negative integer", value)
+	}
+	return retries, nil
+}
+
+// podServiceAccountNames returns the distinct service account names referenced
+// by the pod spec, consulting both ServiceAccountName and the deprecated
+// serviceAccount field older specs may carry. It falls back to "default" when
+// neither is set.
+func podServiceAccountNames(podSpec *corev1.PodSpec) []string {
+	var names []string
+	for _, name := range []string{podSpec.ServiceAccountName, podSpec.DeprecatedServiceAccount} {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []string{"default"}
+	}
+	return names
+}
+
 func mapKeys(values map[string]struct{}) []string {
 	keys := make([]string, 0, len(values))
 	for key := range values {
@@ -214,6 +498,42 @@ func decodeDockerAuth(encoded string) (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
+// namespaceMemoKey is the context key of the namespaceMemo installed by
+// withNamespaceMemo.
+type namespaceMemoKey struct{}
+
+// namespaceMemo holds the Namespace fetched during one admission, so the
+// namespace filters and the platforms override share a single GET.
+type namespaceMemo struct {
+	mu      sync.Mutex
+	fetched bool
+	name    string
+	ns      *corev1.Namespace
+	err     error
+}
+
+// withNamespaceMemo returns a context in which getNamespace fetches each
+// Namespace once.
+func withNamespaceMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, namespaceMemoKey{}, &namespaceMemo{})
+}
+
+// getNamespace gets namespace through client, reusing the result, or the
+// error, of an earlier call under the same withNamespaceMemo context.
+func getNamespace(ctx context.Context, client kubernetes.Interface, namespace string) (*corev1.Namespace, error) {
+	memo, ok := ctx.Value(namespaceMemoKey{}).(*namespaceMemo)
+	if !ok {
+		return client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	}
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	if !memo.fetched || memo.name != namespace {
+		memo.ns, memo.err = client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		memo.fetched, memo.name = true, namespace
+	}
+	return memo.ns, memo.err
+}
+
 // IsNamespaceDisabled checks if the namespace has the disabled annotation set to "true"
 func IsNamespaceDisabled(ctx context.Context, namespace string) bool {
 	if namespace == "" {
@@ -226,7 +546,7 @@ func IsNamespaceDisabled(ctx context.Context, namespace string) bool {
 		return false
 	}
 
-	ns, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	ns, err := getNamespace(ctx, client, namespace)
 	if err != nil {
 		slog.Warn("failed to get namespace", "namespace", namespace, "error", err)
 		return false
@@ -236,7 +556,47 @@ func IsNamespaceDisabled(ctx context.Context, namespace string) bool {
 		return false
 	}
 
-	return ns.Annotations[AnnotationNamespaceDisabled] == "true"
+	if ns.Annotations[AnnotationNamespaceDisabled] != "true" {
+		return false
+	}
+	namespaceSkipped.WithLabelValues(namespaceSkipDisabledAnnotation).Inc()
+	return true
+}
+
+// GetNamespacePlatforms returns the platforms listed in the namespace's
+// platforms annotation, or nil if the namespace has no override or cannot be
+// read. The annotation value is a comma-separated list of OCI platforms.
+func GetNamespacePlatforms(ctx context.Context, namespace string) []string {
+	if namespace == "" {
+		return nil
+	}
+
+	client, err := getKubeClient()
+	if err != nil {
+		slog.Debug("kubernetes client unavailable for namespace platforms", "namespace", namespace, "error", err)
+		return nil
+	}
+
+	ns, err := getNamespace(ctx, client, namespace)
+	if err != nil {
+		slog.Warn("failed to get namespace for platforms override", "namespace", namespace, "error", err)
+		return nil
+	}
+
+	return parsePlatformList(ns.Annotations[AnnotationNamespacePlatforms])
+}
+
+// parsePlatformList splits a comma-separated platform list, trimming whitespace
+// and dropping empty entries. It returns nil when no platforms remain.
+func parsePlatformList(value string) []string {
+	var platforms []string
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			platforms = append(platforms, p)
+		}
+	}
+	return platforms
 }
 
 // IsNamespaceFiltered checks if a namespace should be filtered based on the namespace filter config
@@ -247,8 +607,9 @@ func IsNamespaceFiltered(ctx context.Context, namespace string, filterConfig *Na
 	}
 
 	// Quick check for ignored namespaces (no API call needed)
-	if filterConfig.NamespacesToIgnore[namespace] {
+	if filterConfig.IsNamespaceIgnored(namespace) {
 		slog.Info("skipping mutation due to namespace in ignore list", "namespace", namespace)
+		namespaceSkipped.WithLabelValues(namespaceSkipIgnoreList).Inc()
 		return true
 	}
 
@@ -261,7 +622,7 @@ func IsNamespaceFiltered(ctx context.Context, namespace string, filterConfig *Na
 			return false
 		}
 
-		ns, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		ns, err := getNamespace(ctx, client, namespace)
 		if err != nil {
 			slog.Warn("failed to get namespace for selector check", "namespace", namespace, "error", err)
 			// If namespace lookup fails, don't filter (allow processing)
@@ -270,6 +631,7 @@ func IsNamespaceFiltered(ctx context.Context, namespace string, filterConfig *Na
 
 		if filterConfig.ShouldSkipNamespace(ns) {
 			slog.Info("skipping mutation due to namespace selector mismatch", "namespace", namespace)
+			namespaceSkipped.WithLabelValues(namespaceSkipSelector).Inc()
 			return true
 		}
 	}
@@ -4,13 +4,30 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/regclient/regclient/config"
+	"golang.org/x/oauth2"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 const credTestRegistry = "registry.example.com"
@@ -120,6 +137,25 @@ func TestHostsFromAuths(t *testing.T) {
 			auths:   map[string]dockerAuthEntry{credTestRegistry: {Auth: "!!!not-base64!!!"}},
 			wantLen: 0,
 		},
+		{
+			name:    "auth without a colon is skipped",
+			auths:   map[string]dockerAuthEntry{credTestRegistry: {Auth: b64("alicenopassword")}},
+			wantLen: 0,
+		},
+		{
+			name: "bad entries do not drop valid ones",
+			auths: map[string]dockerAuthEntry{
+				"bad-base64.example.com": {Auth: "!!!not-base64!!!"},
+				"no-colon.example.com":   {Auth: b64("alicenopassword")},
+				credTestRegistry:         {Auth: b64("carol:c:o:l:o:n")},
+			},
+			wantLen: 1,
+			check: func(t *testing.T, host config.Host) {
+				if host.Name != credTestRegistry || host.User != "carol" || host.Pass != "c:o:l:o:n" {
+					t.Errorf("got name=%q user=%q pass=%q", host.Name, host.User, host.Pass)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -142,6 +178,15 @@ func TestHostsFromSecret(t *testing.T) {
 	if err != nil {
 		t.Fatalf("marshal dockerconfigjson: %v", err)
 	}
+	mixedDockerConfigJSONData, err := json.Marshal(dockerConfigJSON{
+		Auths: map[string]dockerAuthEntry{
+			"bad.example.com": {Auth: "!!!not-base64!!!"},
+			credTestRegistry:  {Auth: b64("dave:s3cret")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal dockerconfigjson: %v", err)
+	}
 	legacyDockercfgData, err := json.Marshal(map[string]dockerAuthEntry{
 		credTestRegistry: {Username: "bob", Password: "hunter2"},
 	})
@@ -165,6 +210,15 @@ func TestHostsFromSecret(t *testing.T) {
 			wantLen:  1,
 			wantUser: "alice",
 		},
+		{
+			name: "dockerconfigjson secret with a malformed entry",
+			secret: &corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: mixedDockerConfigJSONData},
+			},
+			wantLen:  1,
+			wantUser: "dave",
+		},
 		{
 			name: "legacy dockercfg secret",
 			secret: &corev1.Secret{
@@ -281,6 +335,18 @@ func TestGetRegistryHosts(t *testing.T) {
 		}
 	})
 
+	t.Run("deprecated service account field is consulted", func(t *testing.T) {
+		sa := &corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "legacy-sa", Namespace: ns},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+		}
+		withKubeClient(t, fake.NewSimpleClientset(pullSecret, sa))
+		hosts := GetRegistryHosts(context.Background(), ns, &corev1.PodSpec{DeprecatedServiceAccount: "legacy-sa"})
+		if len(hosts) != 1 || hosts[0].User != "alice" {
+			t.Fatalf("unexpected hosts: %#v", hosts)
+		}
+	})
+
 	t.Run("missing referenced secret yields empty non-nil slice", func(t *testing.T) {
 		withKubeClient(t, fake.NewSimpleClientset())
 		podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "nope"}}}
@@ -290,3 +356,658 @@ func TestGetRegistryHosts(t *testing.T) {
 		}
 	})
 }
+
+func TestGetRegistryHosts_GlobalPullSecrets(t *testing.T) {
+	const webhookNS, podNS = "k8smultiarcher", "team-a"
+
+	prevNS, prevSecrets := webhookNamespace, globalPullSecrets
+	t.Cleanup(func() { webhookNamespace, globalPullSecrets = prevNS, prevSecrets })
+	webhookNamespace, globalPullSecrets = webhookNS, []string{"central"}
+
+	secret := func(namespace, name string, auths map[string]dockerAuthEntry) *corev1.Secret {
+		dockerCfg, err := json.Marshal(dockerConfigJSON{Auths: auths})
+		if err != nil {
+			t.Fatalf("marshal dockerconfigjson: %v", err)
+		}
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerCfg},
+		}
+	}
+	withKubeClient(t, fake.NewSimpleClientset(
+		secret(webhookNS, "central", map[string]dockerAuthEntry{
+			credTestRegistry:    {Username: "central", Password: "central-pass"},
+			"other.example.com": {Username: "central", Password: "central-pass"},
+		}),
+		// A secret of the same name in the pod's namespace must not be used.
+		secret(podNS, "central", map[string]dockerAuthEntry{
+			"other.example.com": {Username: "impostor", Password: "impostor-pass"},
+		}),
+		secret(podNS, "regcred", map[string]dockerAuthEntry{
+			credTestRegistry: {Username: "alice", Password: "s3cret"},
+		}),
+	))
+
+	users := func(hosts []config.Host) map[string]string {
+		users := map[string]string{}
+		for _, h := range hosts {
+			users[h.Name] = h.User
+		}
+		return users
+	}
+
+	got := users(GetRegistryHosts(context.Background(), podNS, &corev1.PodSpec{}))
+	want := map[string]string{credTestRegistry: "central", "other.example.com": "central"}
+	if !maps.Equal(got, want) {
+		t.Errorf("without pull secrets, users = %v, want %v", got, want)
+	}
+
+	podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}}}
+	got = users(GetRegistryHosts(context.Background(), podNS, podSpec))
+	want = map[string]string{credTestRegistry: "alice", "other.example.com": "central"}
+	if !maps.Equal(got, want) {
+		t.Errorf("with a pull secret, users = %v, want %v", got, want)
+	}
+}
+
+func TestGetPullSecretHosts_KubeAPIRetry(t *testing.T) {
+	prevRetries, prevBackoff := kubeAPIMaxRetries, kubeAPIRetryBackoff
+	t.Cleanup(func() { kubeAPIMaxRetries, kubeAPIRetryBackoff = prevRetries, prevBackoff })
+	kubeAPIMaxRetries, kubeAPIRetryBackoff = 2, time.Millisecond
+
+	dockerCfg, err := json.Marshal(dockerConfigJSON{Auths: map[string]dockerAuthEntry{
+		credTestRegistry: {Username: "alice", Password: "s3cret"},
+	}})
+	if err != nil {
+		t.Fatalf("marshal dockerconfigjson: %v", err)
+	}
+	objects := []runtime.Object{
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "team-a"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "regcred", Namespace: "team-a"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerCfg},
+		},
+	}
+
+	// failingClient fails the first failures gets of each resource with err,
+	// then serves objects, counting every get.
+	failingClient := func(failures int, err error) (*fake.Clientset, map[string]int) {
+		client := fake.NewSimpleClientset(objects...)
+		gets := map[string]int{}
+		client.PrependReactor("get", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			resource := action.GetResource().Resource
+			gets[resource]++
+			if gets[resource] <= failures {
+				return true, nil, err
+			}
+			return false, nil, nil
+		})
+		return client, gets
+	}
+	unavailable := apierrors.NewServiceUnavailable("etcd leader changed")
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		client, gets := failingClient(2, unavailable)
+		withKubeClient(t, client)
+		hosts := getPullSecretHosts(context.Background(), "team-a", &corev1.PodSpec{})
+		if len(hosts) != 1 || hosts[0].User != "alice" {
+			t.Errorf("hosts = %+v, want alice's credentials", hosts)
+		}
+		if gets["serviceaccounts"] != 3 || gets["secrets"] != 3 {
+			t.Errorf("gets = %v, want 3 of each", gets)
+		}
+	})
+
+	t.Run("not found is not retried", func(t *testing.T) {
+		notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "serviceaccounts"}, "default")
+		client, gets := failingClient(1, notFound)
+		withKubeClient(t, client)
+		if hosts := getPullSecretHosts(context.Background(), "team-a", &corev1.PodSpec{}); len(hosts) != 0 {
+			t.Errorf("hosts = %+v, want none", hosts)
+		}
+		if gets["serviceaccounts"] != 1 {
+			t.Errorf("service account gets = %d, want 1", gets["serviceaccounts"])
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		kubeAPIMaxRetries = 0
+		t.Cleanup(func() { kubeAPIMaxRetries = 2 })
+		client, gets := failingClient(1, unavailable)
+		withKubeClient(t, client)
+		if hosts := getPullSecretHosts(context.Background(), "team-a", &corev1.PodSpec{}); len(hosts) != 0 {
+			t.Errorf("hosts = %+v, want none", hosts)
+		}
+		if gets["serviceaccounts"] != 1 {
+			t.Errorf("service account gets = %d, want 1", gets["serviceaccounts"])
+		}
+	})
+}
+
+func TestKubeAPIMaxRetriesFromEnv(t *testing.T) {
+	t.Setenv("K8S_API_MAX_RETRIES", "")
+	if n, err := kubeAPIMaxRetriesFromEnv(); err != nil || n != kubeAPIMaxRetriesDefault {
+		t.Errorf("unset = %d, %v; want %d", n, err, kubeAPIMaxRetriesDefault)
+	}
+
+	t.Setenv("K8S_API_MAX_RETRIES", "0")
+	if n, err := kubeAPIMaxRetriesFromEnv(); err != nil || n != 0 {
+		t.Errorf("disabled = %d, %v; want 0", n, err)
+	}
+
+	for _, invalid := range []string{"many", "-1"} {
+		t.Setenv("K8S_API_MAX_RETRIES", invalid)
+		if _, err := kubeAPIMaxRetriesFromEnv(); err == nil {
+			t.Errorf("expected an error for K8S_API_MAX_RETRIES=%q", invalid)
+		}
+	}
+}
+
+func TestLoadGlobalPullSecrets(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "k8smultiarcher")
+	t.Setenv("GLOBAL_PULL_SECRETS", " central, ,mirror ")
+	namespace, names, err := loadGlobalPullSecrets()
+	if err != nil || namespace != "k8smultiarcher" || !slices.Equal(names, []string{"central", "mirror"}) {
+		t.Errorf("loadGlobalPullSecrets() = %q, %v, %v", namespace, names, err)
+	}
+
+	t.Setenv("POD_NAMESPACE", "")
+	if _, _, err := loadGlobalPullSecrets(); err == nil {
+		t.Error("expected an error for GLOBAL_PULL_SECRETS without POD_NAMESPACE")
+	}
+}
+
+func TestPodServiceAccountNames(t *testing.T) {
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want []string
+	}{
+		{name: "neither set defaults", spec: corev1.PodSpec{}, want: []string{"default"}},
+		{name: "current field", spec: corev1.PodSpec{ServiceAccountName: "sa"}, want: []string{"sa"}},
+		{name: "deprecated field", spec: corev1.PodSpec{DeprecatedServiceAccount: "old"}, want: []string{"old"}},
+		{
+			name: "both fields equal are de-duplicated",
+			spec: corev1.PodSpec{ServiceAccountName: "sa", DeprecatedServiceAccount: "sa"},
+			want: []string{"sa"},
+		},
+		{
+			name: "both fields differ",
+			spec: corev1.PodSpec{ServiceAccountName: "sa", DeprecatedServiceAccount: "old"},
+			want: []string{"sa", "old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podServiceAccountNames(&tt.spec); !slices.Equal(got, tt.want) {
+				t.Errorf("podServiceAccountNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStaticRegistryHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: map[string]string{}},
+		{
+			name:  "comma-separated",
+			value: "registry.internal=alice:s3cret, other.example.com=bob:pa:ss",
+			want:  map[string]string{"registry.internal": "alice:s3cret", "other.example.com": "bob:pa:ss"},
+		},
+		{
+			name:  "json map",
+			value: `{"registry.internal": "alice:s,cret"}`,
+			want:  map[string]string{"registry.internal": "alice:s,cret"},
+		},
+		{name: "missing equals", value: "registry.internal", wantErr: true},
+		{name: "missing password separator", value: "registry.internal=alice", wantErr: true},
+		{name: "malformed json", value: `{"registry.internal": }`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_CONFIG", "")
+			t.Setenv("REGISTRY_AUTH", tt.value)
+			hosts, err := LoadStaticRegistryHosts()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", hosts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := map[string]string{}
+			for _, h := range hosts {
+				got[h.Name] = h.User + ":" + h.Pass
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("LoadStaticRegistryHosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStaticRegistryHosts_DockerConfig(t *testing.T) {
+	dir := t.TempDir()
+	configJSON, err := json.Marshal(dockerConfigJSON{
+		Auths: map[string]dockerAuthEntry{
+			credTestRegistry:    {Auth: b64("alice:s3cret")},
+			"other.example.com": {Username: "bob", Password: "hunter2"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal docker config: %v", err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(configPath, configJSON, 0o600); err != nil {
+		t.Fatalf("write docker config: %v", err)
+	}
+
+	hostUsers := func(hosts []config.Host) map[string]string {
+		users := map[string]string{}
+		for _, h := range hosts {
+			users[h.Name] = h.User + ":" + h.Pass
+		}
+		return users
+	}
+	want := map[string]string{credTestRegistry: "alice:s3cret", "other.example.com": "bob:hunter2"}
+
+	for _, path := range []string{configPath, dir} {
+		t.Run(path, func(t *testing.T) {
+			t.Setenv("REGISTRY_AUTH", "")
+			t.Setenv("DOCKER_CONFIG", path)
+			hosts, err := LoadStaticRegistryHosts()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := hostUsers(hosts); !maps.Equal(got, want) {
+				t.Errorf("LoadStaticRegistryHosts() = %v, want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("REGISTRY_AUTH takes precedence", func(t *testing.T) {
+		t.Setenv("DOCKER_CONFIG", dir)
+		t.Setenv("REGISTRY_AUTH", credTestRegistry+"=carol:pw")
+		hosts, err := LoadStaticRegistryHosts()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := map[string]string{credTestRegistry: "carol:pw", "other.example.com": "bob:hunter2"}
+		if got := hostUsers(hosts); len(hosts) != 2 || !maps.Equal(got, want) {
+			t.Errorf("LoadStaticRegistryHosts() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("missing file is an error", func(t *testing.T) {
+		t.Setenv("REGISTRY_AUTH", "")
+		t.Setenv("DOCKER_CONFIG", filepath.Join(dir, "missing.json"))
+		if _, err := LoadStaticRegistryHosts(); err == nil {
+			t.Error("expected an error for a missing DOCKER_CONFIG file")
+		}
+	})
+}
+
+func TestGetRegistryHosts_StaticCredentials(t *testing.T) {
+	const ns = "team-a"
+
+	prev := staticRegistryHosts
+	t.Cleanup(func() { staticRegistryHosts = prev })
+	static := config.HostNewName(credTestRegistry)
+	static.User = "static"
+	static.Pass = "static-pass"
+	other := config.HostNewName("other.example.com")
+	other.User = "other"
+	staticRegistryHosts = []config.Host{*static, *other}
+
+	t.Run("static credentials apply without a namespace", func(t *testing.T) {
+		withKubeClient(t, fake.NewSimpleClientset())
+		hosts := GetRegistryHosts(context.Background(), "", nil)
+		if len(hosts) != 2 {
+			t.Fatalf("expected both static hosts, got %#v", hosts)
+		}
+	})
+
+	t.Run("pull secret overrides static credential for the same host", func(t *testing.T) {
+		dockerCfg, err := json.Marshal(dockerConfigJSON{
+			Auths: map[string]dockerAuthEntry{credTestRegistry: {Username: "alice", Password: "s3cret"}},
+		})
+		if err != nil {
+			t.Fatalf("marshal dockerconfigjson: %v", err)
+		}
+		withKubeClient(t, fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "regcred", Namespace: ns},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerCfg},
+		}))
+		podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}}}
+
+		hosts := GetRegistryHosts(context.Background(), ns, podSpec)
+		users := map[string]string{}
+		for _, h := range hosts {
+			users[h.Name] = h.User
+		}
+		want := map[string]string{credTestRegistry: "alice", "other.example.com": "other"}
+		if len(hosts) != 2 || !maps.Equal(users, want) {
+			t.Errorf("GetRegistryHosts() users = %v, want %v", users, want)
+		}
+	})
+}
+
+func TestECRRegistryHosts(t *testing.T) {
+	const ecrRegistry = "123456789012.dkr.ecr.us-west-2.amazonaws.com"
+
+	prevEnabled, prevFetcher := ecrAuthEnabled, ecrTokenFetcher
+	t.Cleanup(func() {
+		ecrAuthEnabled, ecrTokenFetcher = prevEnabled, prevFetcher
+		ecrTokens = map[string]ecrToken{}
+	})
+
+	fetches := map[string]int{}
+	ecrTokenFetcher = func(_ context.Context, region string) (ecrToken, error) {
+		fetches[region]++
+		return ecrToken{user: "AWS", pass: "token-" + region, expiresAt: time.Now().Add(12 * time.Hour)}, nil
+	}
+	podSpec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", Image: ecrRegistry + "/init:v1"}},
+		Containers: []corev1.Container{
+			{Name: "app", Image: ecrRegistry + "/app:v1"},
+			{Name: "sidecar", Image: credTestRegistry + "/sidecar:v1"},
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		ecrAuthEnabled = false
+		if hosts := ecrRegistryHosts(context.Background(), podSpec); hosts != nil {
+			t.Errorf("expected no hosts when ECR_AUTH is disabled, got %#v", hosts)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		ecrAuthEnabled = true
+		for range 2 {
+			hosts := ecrRegistryHosts(context.Background(), podSpec)
+			if len(hosts) != 1 || hosts[0].Name != ecrRegistry {
+				t.Fatalf("expected a single ECR host, got %#v", hosts)
+			}
+			if hosts[0].User != "AWS" || hosts[0].Pass != "token-us-west-2" {
+				t.Errorf("unexpected ECR credentials %q/%q", hosts[0].User, hosts[0].Pass)
+			}
+		}
+		if fetches["us-west-2"] != 1 {
+			t.Errorf("expected the token to be fetched once and cached, got %d fetches", fetches["us-west-2"])
+		}
+	})
+
+	t.Run("expiring token is refreshed", func(t *testing.T) {
+		ecrAuthEnabled = true
+		ecrTokens["us-west-2"] = ecrToken{user: "AWS", pass: "stale", expiresAt: time.Now().Add(time.Minute)}
+		hosts := ecrRegistryHosts(context.Background(), podSpec)
+		if len(hosts) != 1 || hosts[0].Pass != "token-us-west-2" {
+			t.Errorf("expected a refreshed token, got %#v", hosts)
+		}
+	})
+
+	t.Run("fetch error skips the registry", func(t *testing.T) {
+		ecrAuthEnabled = true
+		ecrTokens = map[string]ecrToken{}
+		ecrTokenFetcher = func(context.Context, string) (ecrToken, error) {
+			return ecrToken{}, errors.New("no credentials")
+		}
+		if hosts := ecrRegistryHosts(context.Background(), podSpec); len(hosts) != 0 {
+			t.Errorf("expected no hosts on fetch error, got %#v", hosts)
+		}
+	})
+}
+
+func TestECRHostPattern(t *testing.T) {
+	tests := []struct {
+		host   string
+		region string
+	}{
+		{host: "123456789012.dkr.ecr.us-east-1.amazonaws.com", region: "us-east-1"},
+		{host: "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", region: "us-gov-west-1"},
+		{host: "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", region: "cn-north-1"},
+		{host: "public.ecr.aws"},
+		{host: "docker.io"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			match := ecrHostPattern.FindStringSubmatch(tt.host)
+			region := ""
+			if match != nil {
+				region = match[1]
+			}
+			if region != tt.region {
+				t.Errorf("region for %q = %q, want %q", tt.host, region, tt.region)
+			}
+		})
+	}
+}
+
+func TestGCPRegistryHosts(t *testing.T) {
+	const arRegistry = "us-central1-docker.pkg.dev"
+
+	prevEnabled, prevFetcher := gcpAuthEnabled, gcpTokenFetcher
+	t.Cleanup(func() {
+		gcpAuthEnabled, gcpTokenFetcher = prevEnabled, prevFetcher
+		gcpToken = nil
+	})
+
+	fetches := 0
+	gcpTokenFetcher = func(context.Context) (*oauth2.Token, error) {
+		fetches++
+		return &oauth2.Token{AccessToken: "gcp-token", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+	podSpec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "app", Image: arRegistry + "/project/repo/app:v1"},
+			{Name: "legacy", Image: "gcr.io/project/legacy:v1"},
+			{Name: "sidecar", Image: credTestRegistry + "/sidecar:v1"},
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		gcpAuthEnabled = false
+		if hosts := gcpRegistryHosts(context.Background(), podSpec); hosts != nil {
+			t.Errorf("expected no hosts when GCP_AUTH is disabled, got %#v", hosts)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		gcpAuthEnabled = true
+		hosts := gcpRegistryHosts(context.Background(), podSpec)
+		names := []string{}
+		for _, h := range hosts {
+			names = append(names, h.Name)
+			if h.User != gcpTokenUser || h.Pass != "gcp-token" {
+				t.Errorf("unexpected credentials for %s: %q/%q", h.Name, h.User, h.Pass)
+			}
+		}
+		if want := []string{arRegistry, "gcr.io"}; !slices.Equal(names, want) {
+			t.Errorf("hosts = %v, want %v", names, want)
+		}
+		if fetches != 1 {
+			t.Errorf("expected the token to be fetched once and cached, got %d fetches", fetches)
+		}
+	})
+
+	t.Run("fetch error returns no hosts", func(t *testing.T) {
+		gcpAuthEnabled = true
+		gcpToken = nil
+		gcpTokenFetcher = func(context.Context) (*oauth2.Token, error) {
+			return nil, errors.New("no credentials")
+		}
+		if hosts := gcpRegistryHosts(context.Background(), podSpec); len(hosts) != 0 {
+			t.Errorf("expected no hosts on fetch error, got %#v", hosts)
+		}
+	})
+}
+
+func TestTokenExchangeRegistryHosts(t *testing.T) {
+	const exchangeRegistry = "registry.example.com"
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %v", err)
+		}
+		if got := r.PostForm.Get("grant_type"); got != tokenExchangeGrantType {
+			t.Errorf("grant_type = %q, want %q", got, tokenExchangeGrantType)
+		}
+		if got := r.PostForm.Get("subject_token"); got != "sa-token" {
+			t.Errorf("subject_token = %q, want sa-token", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"reg-token","expires_in":300}`))
+	}))
+	defer server.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("sa-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prevRegistries, prevPath := tokenExchangeRegistries, serviceAccountTokenPath
+	t.Cleanup(func() {
+		tokenExchangeRegistries, serviceAccountTokenPath = prevRegistries, prevPath
+		exchangedTokens = map[string]exchangedToken{}
+	})
+	tokenExchangeRegistries = map[string]string{exchangeRegistry: server.URL}
+	serviceAccountTokenPath = tokenPath
+	exchangedTokens = map[string]exchangedToken{}
+
+	podSpec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "app", Image: exchangeRegistry + "/team/app:v1"},
+			{Name: "sidecar", Image: credTestRegistry + "/sidecar:v1"},
+		},
+	}
+	for range 2 {
+		hosts := tokenExchangeRegistryHosts(context.Background(), podSpec)
+		if len(hosts) != 1 || hosts[0].Name != exchangeRegistry ||
+			hosts[0].User != tokenExchangeUserDefault || hosts[0].Pass != "reg-token" {
+			t.Fatalf("hosts = %#v, want one %s host with the exchanged token", hosts, exchangeRegistry)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the token to be exchanged once and cached, got %d exchanges", fetches)
+	}
+
+	t.Run("unreadable token returns no hosts", func(t *testing.T) {
+		exchangedTokens = map[string]exchangedToken{}
+		serviceAccountTokenPath = filepath.Join(t.TempDir(), "missing")
+		if hosts := tokenExchangeRegistryHosts(context.Background(), podSpec); len(hosts) != 0 {
+			t.Errorf("expected no hosts when the token cannot be read, got %#v", hosts)
+		}
+	})
+}
+
+func TestTokenExchangeRegistryHosts_BearerChallenge(t *testing.T) {
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"reg-token","expires_in":300}`))
+	}))
+	defer exchange.Close()
+
+	// The registry challenges for a bearer token from its token service, which
+	// must receive the exchanged token as basic auth credentials.
+	var tokenServiceAuth, manifestAuth atomic.Value
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, pass, _ := r.BasicAuth()
+			tokenServiceAuth.Store(user + ":" + pass)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"issued"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer issued" {
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+registry.URL+`/token",service="registry",scope="repository:app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		manifestAuth.Store(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest.FromString(testIndex).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+		if r.Method == http.MethodGet {
+			w.Write([]byte(testIndex))
+		}
+	}))
+	defer registry.Close()
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("sa-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prevRegistries, prevPath := tokenExchangeRegistries, serviceAccountTokenPath
+	t.Cleanup(func() {
+		tokenExchangeRegistries, serviceAccountTokenPath = prevRegistries, prevPath
+		exchangedTokens = map[string]exchangedToken{}
+	})
+	tokenExchangeRegistries = map[string]string{registryHost: exchange.URL}
+	serviceAccountTokenPath = tokenPath
+	exchangedTokens = map[string]exchangedToken{}
+
+	image := registryHost + "/app:v1"
+	hosts := tokenExchangeRegistryHosts(context.Background(), &corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "app", Image: image}},
+	})
+	if len(hosts) != 1 {
+		t.Fatalf("hosts = %#v, want one", hosts)
+	}
+	hosts[0].TLS = config.TLSDisabled
+
+	r, err := parseImageRef(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetManifest(context.Background(), r, hosts); err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+	if got, want := tokenServiceAuth.Load(), tokenExchangeUserDefault+":reg-token"; got != want {
+		t.Errorf("token service basic auth = %v, want %q", got, want)
+	}
+	if got := manifestAuth.Load(); got != "Bearer issued" {
+		t.Errorf("manifest Authorization = %v, want the issued bearer token", got)
+	}
+}
+
+func TestParseTokenExchangeRegistries(t *testing.T) {
+	registries, err := parseTokenExchangeRegistries(`{"registry.example.com": "https://sts.example.com/token"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if registries["registry.example.com"] != "https://sts.example.com/token" {
+		t.Errorf("registries = %v", registries)
+	}
+	if registries, err := parseTokenExchangeRegistries(""); err != nil || registries != nil {
+		t.Errorf("expected nil for an empty value, got %v, %v", registries, err)
+	}
+	for _, raw := range []string{
+		`not json`,
+		`{"registry.example.com": "sts.example.com/token"}`,
+		`{"registry.example.com": "ftp://sts.example.com/token"}`,
+	} {
+		if _, err := parseTokenExchangeRegistries(raw); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+}
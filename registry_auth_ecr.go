@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types/ref"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ecrTokenRefreshMargin is how long before expiry a cached ECR token is renewed.
+const ecrTokenRefreshMargin = 30 * time.Minute
+
+// ecrHostPattern matches private ECR registry hosts and captures the region.
+var ecrHostPattern = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrAuthEnabled turns on ECR credentials from the webhook's own AWS identity.
+// It is set at startup from ECR_AUTH.
+var ecrAuthEnabled bool
+
+// ecrToken is a decoded ECR authorization token.
+type ecrToken struct {
+	user      string
+	pass      string
+	expiresAt time.Time
+}
+
+// ecrTokenFetcher obtains an ECR authorization token for a region. It is a
+// package var so tests can substitute a fake without calling AWS.
+var ecrTokenFetcher = fetchECRToken
+
+var (
+	ecrTokensMu sync.Mutex
+	ecrTokens   = map[string]ecrToken{}
+)
+
+// fetchECRToken requests an authorization token using the default AWS
+// credential chain, which covers IRSA web identity and assumed roles.
+func fetchECRToken(ctx context.Context, region string) (ecrToken, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return ecrToken{}, err
+	}
+	out, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return ecrToken{}, err
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return ecrToken{}, errors.New("ecr returned no authorization data")
+	}
+	data := out.AuthorizationData[0]
+	user, pass, err := decodeDockerAuth(aws.ToString(data.AuthorizationToken))
+	if err != nil {
+		return ecrToken{}, err
+	}
+	return ecrToken{user: user, pass: pass, expiresAt: aws.ToTime(data.ExpiresAt)}, nil
+}
+
+// getECRToken returns a cached token for the region, fetching a new one when
+// none is cached or the cached token is close to expiry.
+func getECRToken(ctx context.Context, region string) (ecrToken, error) {
+	ecrTokensMu.Lock()
+	defer ecrTokensMu.Unlock()
+
+	if token, ok := ecrTokens[region]; ok && time.Until(token.expiresAt) > ecrTokenRefreshMargin {
+		return token, nil
+	}
+	token, err := ecrTokenFetcher(ctx, region)
+	if err != nil {
+		return ecrToken{}, err
+	}
+	ecrTokens[region] = token
+	return token, nil
+}
+
+// ecrRegistryHosts returns registry host configurations carrying ECR tokens for
+// every private ECR registry referenced by the PodSpec's images. It returns nil
+// when ECR_AUTH is disabled.
+func ecrRegistryHosts(ctx context.Context, podSpec *corev1.PodSpec) []config.Host {
+	if !ecrAuthEnabled || podSpec == nil {
+		return nil
+	}
+
+	hosts := []config.Host{}
+	for _, registry := range podSpecRegistries(podSpec) {
+		match := ecrHostPattern.FindStringSubmatch(registry)
+		if match == nil {
+			continue
+		}
+
+		token, err := getECRToken(ctx, match[1])
+		if err != nil {
+			slog.Warn("failed to get ECR authorization token", "registry", registry, "error", err)
+			continue
+		}
+		host := config.HostNewName(registry)
+		host.User = token.user
+		host.Pass = token.pass
+		hosts = append(hosts, *host)
+	}
+	return hosts
+}
+
+// podSpecRegistries returns the distinct registry hosts referenced by the
+// PodSpec's containers, init containers, and ephemeral containers, in order of
+// first appearance. Images that fail to parse are skipped.
+func podSpecRegistries(podSpec *corev1.PodSpec) []string {
+	images := []string{}
+	for _, c := range podSpec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range podSpec.Containers {
+		images = append(images, c.Image)
+	}
+	for _, c := range podSpec.EphemeralContainers {
+		images = append(images, c.Image)
+	}
+
+	registries := []string{}
+	for _, image := range images {
+		r, err := ref.New(image)
+		if err != nil || slices.Contains(registries, r.Registry) {
+			continue
+		}
+		registries = append(registries, r.Registry)
+	}
+	return registries
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/regclient/regclient/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// gcpTokenUser is the username Artifact Registry and GCR expect with an
+	// OAuth2 access token as the password.
+	gcpTokenUser = "oauth2accesstoken"
+	// gcpTokenScope is the OAuth2 scope requested for registry access tokens.
+	gcpTokenScope = "https://www.googleapis.com/auth/cloud-platform"
+	// gcpTokenRefreshMargin is how long before expiry a cached GCP token is renewed.
+	gcpTokenRefreshMargin = 5 * time.Minute
+)
+
+// gcpAuthEnabled turns on Artifact Registry and GCR credentials from the
+// webhook's own Google identity. It is set at startup from GCP_AUTH.
+var gcpAuthEnabled bool
+
+// gcpTokenFetcher obtains an OAuth2 access token for Google registries. It is a
+// package var so tests can substitute a fake without calling Google.
+var gcpTokenFetcher = fetchGCPToken
+
+var (
+	gcpTokenMu sync.Mutex
+	gcpToken   *oauth2.Token
+)
+
+// fetchGCPToken requests an access token using Application Default
+// Credentials, which covers GKE Workload Identity and the metadata server.
+func fetchGCPToken(ctx context.Context) (*oauth2.Token, error) {
+	source, err := google.DefaultTokenSource(ctx, gcpTokenScope)
+	if err != nil {
+		return nil, err
+	}
+	return source.Token()
+}
+
+// getGCPToken returns the cached access token, fetching a new one when none is
+// cached or the cached token is close to expiry.
+func getGCPToken(ctx context.Context) (*oauth2.Token, error) {
+	gcpTokenMu.Lock()
+	defer gcpTokenMu.Unlock()
+
+	if gcpToken != nil && (gcpToken.Expiry.IsZero() || time.Until(gcpToken.Expiry) > gcpTokenRefreshMargin) {
+		return gcpToken, nil
+	}
+	token, err := gcpTokenFetcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gcpToken = token
+	return token, nil
+}
+
+// isGCPRegistry reports whether registry is an Artifact Registry
+// (`<location>-docker.pkg.dev`) or Container Registry (`gcr.io`, `<region>.gcr.io`)
+// host.
+func isGCPRegistry(registry string) bool {
+	return strings.HasSuffix(registry, "-docker.pkg.dev") ||
+		registry == "gcr.io" ||
+		strings.HasSuffix(registry, ".gcr.io")
+}
+
+// gcpRegistryHosts returns registry host configurations carrying a GCP access
+// token for every Artifact Registry or GCR host referenced by the PodSpec's
+// images. It returns nil when GCP_AUTH is disabled.
+func gcpRegistryHosts(ctx context.Context, podSpec *corev1.PodSpec) []config.Host {
+	if !gcpAuthEnabled || podSpec == nil {
+		return nil
+	}
+
+	hosts := []config.Host{}
+	for _, registry := range podSpecRegistries(podSpec) {
+		if !isGCPRegistry(registry) {
+			continue
+		}
+
+		token, err := getGCPToken(ctx)
+		if err != nil {
+			slog.Warn("failed to get GCP access token", "registry", registry, "error", err)
+			return hosts
+		}
+		host := config.HostNewName(registry)
+		host.User = gcpTokenUser
+		host.Pass = token.AccessToken
+		hosts = append(hosts, *host)
+	}
+	return hosts
+}
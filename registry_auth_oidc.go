@@ -0,0 +1,182 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/regclient/regclient/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// serviceAccountTokenPathDefault is where the kubelet mounts the pod's
+	// service account token.
+	serviceAccountTokenPathDefault = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// exchangedTokenRefreshMargin is how long before expiry an exchanged registry
+	// token is renewed.
+	exchangedTokenRefreshMargin = time.Minute
+	// exchangedTokenLifetimeDefault is assumed for exchanged tokens whose
+	// response carries no expires_in.
+	exchangedTokenLifetimeDefault = 5 * time.Minute
+	// tokenExchangeUserDefault is the username sent with exchanged tokens, as
+	// registries accepting access tokens in place of a password expect.
+	tokenExchangeUserDefault = "<token>"
+
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// tokenExchangeRegistries maps registry hosts that trust the cluster's OIDC
+// issuer to the endpoint exchanging the webhook's service account token for a
+// registry token. It is set at startup from REGISTRY_TOKEN_EXCHANGE.
+var tokenExchangeRegistries map[string]string
+
+// serviceAccountTokenPath is the projected service account token presented for
+// exchange. It is set at startup from SERVICE_ACCOUNT_TOKEN_PATH.
+var serviceAccountTokenPath = serviceAccountTokenPathDefault
+
+// tokenExchangeUser is the username presented with an exchanged token, which
+// is sent as the password. It is set at startup from
+// REGISTRY_TOKEN_EXCHANGE_USER.
+var tokenExchangeUser = tokenExchangeUserDefault
+
+// exchangedToken is a registry token obtained by token exchange.
+type exchangedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+var (
+	exchangedTokensMu sync.Mutex
+	exchangedTokens   = map[string]exchangedToken{}
+)
+
+// tokenExchangeClient sends token exchange requests.
+var tokenExchangeClient = &http.Client{Timeout: registryRequestTimeout}
+
+// parseTokenExchangeRegistries parses REGISTRY_TOKEN_EXCHANGE, a JSON object
+// mapping registry hosts to http(s) token exchange endpoints.
+func parseTokenExchangeRegistries(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	registries := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &registries); err != nil {
+		return nil, fmt.Errorf("invalid REGISTRY_TOKEN_EXCHANGE: %w", err)
+	}
+	for registry, endpoint := range registries {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid REGISTRY_TOKEN_EXCHANGE endpoint %q for %s: must be an http(s) URL",
+				endpoint, registry)
+		}
+	}
+	return registries, nil
+}
+
+// fetchExchangedToken presents the service account token to endpoint as an
+// RFC 8693 token exchange and returns the registry token it issues. Both the
+// RFC 8693 access_token and the Docker registry token response fields are
+// accepted.
+func fetchExchangedToken(ctx context.Context, endpoint string) (exchangedToken, error) {
+	subjectToken, err := os.ReadFile(serviceAccountTokenPath)
+	if err != nil {
+		return exchangedToken{}, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	form := url.Values{
+		"grant_type":         {tokenExchangeGrantType},
+		"subject_token":      {strings.TrimSpace(string(subjectToken))},
+		"subject_token_type": {tokenTypeJWT},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return exchangedToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", registryUserAgent)
+
+	resp, err := tokenExchangeClient.Do(req)
+	if err != nil {
+		return exchangedToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return exchangedToken{}, fmt.Errorf("token exchange returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		Token       string `json:"token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return exchangedToken{}, fmt.Errorf("invalid token exchange response: %w", err)
+	}
+	token := cmp.Or(body.AccessToken, body.Token)
+	if token == "" {
+		return exchangedToken{}, errors.New("token exchange response carried no token")
+	}
+	lifetime := exchangedTokenLifetimeDefault
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	return exchangedToken{token: token, expiresAt: time.Now().Add(lifetime)}, nil
+}
+
+// getExchangedToken returns the cached token for registry, exchanging the
+// service account token again when none is cached or it is close to expiry.
+func getExchangedToken(ctx context.Context, registry, endpoint string) (exchangedToken, error) {
+	exchangedTokensMu.Lock()
+	defer exchangedTokensMu.Unlock()
+
+	if token, ok := exchangedTokens[registry]; ok && time.Until(token.expiresAt) > exchangedTokenRefreshMargin {
+		return token, nil
+	}
+	token, err := fetchExchangedToken(ctx, endpoint)
+	if err != nil {
+		return exchangedToken{}, err
+	}
+	exchangedTokens[registry] = token
+	return token, nil
+}
+
+// tokenExchangeRegistryHosts returns registry host configurations carrying an
+// exchanged token for every REGISTRY_TOKEN_EXCHANGE registry referenced by the
+// PodSpec's images. It returns nil when no registries are configured.
+func tokenExchangeRegistryHosts(ctx context.Context, podSpec *corev1.PodSpec) []config.Host {
+	if len(tokenExchangeRegistries) == 0 || podSpec == nil {
+		return nil
+	}
+
+	hosts := []config.Host{}
+	for _, registry := range podSpecRegistries(podSpec) {
+		endpoint, ok := tokenExchangeRegistries[registry]
+		if !ok {
+			continue
+		}
+
+		token, err := getExchangedToken(ctx, registry, endpoint)
+		if err != nil {
+			slog.Warn("failed to exchange service account token", "registry", registry, "error", err)
+			continue
+		}
+		// The token goes in the password: regclient sends it with the username
+		// as basic auth, or to the registry's token service for a bearer token.
+		// Host.Token would instead be presented as an OAuth2 refresh token.
+		host := config.HostNewName(registry)
+		host.User = tokenExchangeUser
+		host.Pass = token.token
+		hosts = append(hosts, *host)
+	}
+	return hosts
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"errors"
+	"slices"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -128,3 +131,99 @@ func TestIsNamespaceDisabled_ClientError(t *testing.T) {
 		t.Errorf("IsNamespaceDisabled() with unavailable client = %v, want false", got)
 	}
 }
+
+func TestNamespaceSkippedMetric(t *testing.T) {
+	withKubeClient(t, fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "dev", Labels: map[string]string{"env": "dev"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "prod",
+			Labels:      map[string]string{"env": "prod"},
+			Annotations: map[string]string{AnnotationNamespaceDisabled: "true"},
+		}},
+	))
+	selector, err := labels.Parse("env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterConfig := &NamespaceFilterConfig{
+		NamespacesToIgnore: map[string]bool{"kube-system": true},
+		NamespaceSelector:  selector,
+	}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		reason string
+		skip   func() bool
+	}{
+		{namespaceSkipIgnoreList, func() bool { return IsNamespaceFiltered(ctx, "kube-system", filterConfig) }},
+		{namespaceSkipSelector, func() bool { return IsNamespaceFiltered(ctx, "dev", filterConfig) }},
+		{namespaceSkipDisabledAnnotation, func() bool { return IsNamespaceDisabled(ctx, "prod") }},
+	} {
+		counter := namespaceSkipped.WithLabelValues(tt.reason)
+		before := testutil.ToFloat64(counter)
+		if !tt.skip() {
+			t.Errorf("%s: expected the namespace to be skipped", tt.reason)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s skips = %v, want 1", tt.reason, got)
+		}
+	}
+
+	before := testutil.ToFloat64(namespaceSkipped.WithLabelValues(namespaceSkipSelector))
+	if IsNamespaceFiltered(ctx, "prod", filterConfig) {
+		t.Error("expected prod to match the selector")
+	}
+	if got := testutil.ToFloat64(namespaceSkipped.WithLabelValues(namespaceSkipSelector)) - before; got != 0 {
+		t.Errorf("selector skips = %v, want 0 for a matching namespace", got)
+	}
+}
+
+func TestGetNamespacePlatforms(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:        "no annotation returns nil",
+			annotations: nil,
+			expected:    nil,
+		},
+		{
+			name:        "single platform",
+			annotations: map[string]string{AnnotationNamespacePlatforms: "linux/amd64"},
+			expected:    []string{"linux/amd64"},
+		},
+		{
+			name:        "comma-separated list is trimmed",
+			annotations: map[string]string{AnnotationNamespacePlatforms: " linux/amd64 , linux/arm64,,"},
+			expected:    []string{"linux/amd64", "linux/arm64"},
+		},
+		{
+			name:        "blank annotation returns nil",
+			annotations: map[string]string{AnnotationNamespacePlatforms: " , "},
+			expected:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withKubeClient(t, fake.NewSimpleClientset(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: tt.annotations},
+			}))
+
+			got := GetNamespacePlatforms(context.Background(), "team-a")
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("GetNamespacePlatforms() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetNamespacePlatforms_ClientError(t *testing.T) {
+	withKubeClientErr(t, errors.New("simulated client error"))
+
+	if got := GetNamespacePlatforms(context.Background(), "team-a"); got != nil {
+		t.Errorf("GetNamespacePlatforms() with unavailable client = %v, want nil", got)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// registryRateLimits maps a registry host to the token bucket limiting lookups
+// against it. A token covers one registry access, i.e. one call of
+// withRegistryAccess: fetching a manifest, or the config of a single-platform
+// image. Each access may make several HTTP requests, such as a HEAD, a GET,
+// and a token request, so the rate of HTTP requests is a small multiple of the
+// configured rate. Hosts without an entry are not rate limited. It is set at
+// startup from REGISTRY_RATE_LIMIT.
+var registryRateLimits map[string]*rate.Limiter
+
+// waitForRegistryRateLimit blocks until the registry's rate limiter allows a
+// lookup or ctx is done. The time spent waiting is recorded per registry.
+func waitForRegistryRateLimit(ctx context.Context, registry string) error {
+	limiter, ok := registryRateLimits[registry]
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	registryRateLimitWait.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+	return err
+}
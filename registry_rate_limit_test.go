@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWaitForRegistryRateLimit(t *testing.T) {
+	prev := registryRateLimits
+	registryRateLimits = map[string]*rate.Limiter{
+		"docker.io": rate.NewLimiter(rate.Every(time.Hour), 1),
+	}
+	t.Cleanup(func() { registryRateLimits = prev })
+
+	if err := waitForRegistryRateLimit(context.Background(), "docker.io"); err != nil {
+		t.Fatalf("expected the first request to use the burst token, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := waitForRegistryRateLimit(ctx, "docker.io"); err == nil {
+		t.Error("expected an error when the next token is past the context deadline")
+	}
+
+	if err := waitForRegistryRateLimit(ctx, "ghcr.io"); err != nil {
+		t.Errorf("expected registries without a limit to pass, got %v", err)
+	}
+}
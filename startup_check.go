@@ -0,0 +1,144 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Startup registry check modes, set via STARTUP_REGISTRY_CHECK.
+const (
+	// StartupRegistryCheckOff skips the check (the default).
+	StartupRegistryCheckOff = "off"
+	// StartupRegistryCheckWarn inspects the canary image at startup and logs
+	// an error if it fails, then serves as usual.
+	StartupRegistryCheckWarn = "warn"
+	// StartupRegistryCheckNotReady also reports not-ready on /readyz, so the
+	// pod receives no admission traffic while the registry is unreachable.
+	StartupRegistryCheckNotReady = "not-ready"
+	// StartupRegistryCheckExit exits instead of serving.
+	StartupRegistryCheckExit = "exit"
+)
+
+const (
+	// startupCheckImageDefault is resolved against DEFAULT_REGISTRY when set.
+	startupCheckImageDefault = "busybox:latest"
+	startupCheckTimeout      = 30 * time.Second
+)
+
+// Under StartupRegistryCheckNotReady a failed check is retried in the
+// background, starting after startupCheckRetryInitial and doubling up to
+// startupCheckRetryMax.
+var (
+	startupCheckRetryInitial = 5 * time.Second
+	startupCheckRetryMax     = 5 * time.Minute
+)
+
+var (
+	startupRegistryCheckMu sync.Mutex
+	// startupRegistryCheckErr holds the failure of the startup registry check
+	// under StartupRegistryCheckNotReady, reported by /readyz until a retry
+	// passes.
+	startupRegistryCheckErr error
+)
+
+// startupRegistryCheckError returns the current startup registry check
+// failure, or nil.
+func startupRegistryCheckError() error {
+	startupRegistryCheckMu.Lock()
+	defer startupRegistryCheckMu.Unlock()
+	return startupRegistryCheckErr
+}
+
+func setStartupRegistryCheckError(err error) {
+	startupRegistryCheckMu.Lock()
+	defer startupRegistryCheckMu.Unlock()
+	startupRegistryCheckErr = err
+}
+
+// startupRegistryCheckFromEnv parses STARTUP_REGISTRY_CHECK and the canary
+// image from STARTUP_CHECK_IMAGE, applying the defaults when unset.
+func startupRegistryCheckFromEnv() (mode, image string, err error) {
+	mode = cmp.Or(os.Getenv("STARTUP_REGISTRY_CHECK"), StartupRegistryCheckOff)
+	switch mode {
+	case StartupRegistryCheckOff, StartupRegistryCheckWarn, StartupRegistryCheckNotReady, StartupRegistryCheckExit:
+	default:
+		return "", "", fmt.Errorf("invalid STARTUP_REGISTRY_CHECK %q: must be %q, %q, %q, or %q", mode,
+			StartupRegistryCheckOff, StartupRegistryCheckWarn, StartupRegistryCheckNotReady, StartupRegistryCheckExit)
+	}
+	return mode, cmp.Or(os.Getenv("STARTUP_CHECK_IMAGE"), startupCheckImageDefault), nil
+}
+
+// checkRegistryConnectivity fetches the manifest of image with the webhook's
+// own registry credentials, bypassing the cache.
+func checkRegistryConnectivity(ctx context.Context, image string) error {
+	r, err := parseImageRef(image)
+	if err != nil {
+		return fmt.Errorf("invalid canary image %q: %w", image, err)
+	}
+	podSpec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "canary", Image: image}}}
+	// A single-platform canary image still proves the registry is reachable.
+	_, err = GetManifest(ctx, r, GetRegistryHosts(ctx, "", podSpec))
+	if err != nil && !errors.Is(err, errSingleManifest) {
+		return fmt.Errorf("failed to inspect canary image %s: %w", r.CommonName(), err)
+	}
+	return nil
+}
+
+// runStartupRegistryCheck inspects the canary image according to
+// STARTUP_REGISTRY_CHECK, so a webhook that cannot reach its registries fails
+// loudly at startup instead of silently adding no tolerations.
+func runStartupRegistryCheck() {
+	mode, image, err := startupRegistryCheckFromEnv()
+	if err != nil {
+		slog.Error("failed to load startup registry check config", "error", err)
+		os.Exit(1)
+	}
+	if mode == StartupRegistryCheckOff {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	err = checkRegistryConnectivity(ctx, image)
+	if err == nil {
+		slog.Info("startup registry check passed", "image", image)
+		return
+	}
+	slog.Error("startup registry check failed; images cannot be inspected and no platform tolerations will be added",
+		"image", image, "mode", mode, "error", err)
+	switch mode {
+	case StartupRegistryCheckExit:
+		os.Exit(1)
+	case StartupRegistryCheckNotReady:
+		setStartupRegistryCheckError(err)
+		go retryStartupRegistryCheck(image)
+	}
+}
+
+// retryStartupRegistryCheck re-runs the startup registry check with backoff
+// until it passes, then clears the failure so /readyz reports ready.
+func retryStartupRegistryCheck(image string) {
+	delay := startupCheckRetryInitial
+	for {
+		time.Sleep(delay)
+		ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+		err := checkRegistryConnectivity(ctx, image)
+		cancel()
+		if err == nil {
+			setStartupRegistryCheckError(nil)
+			slog.Info("startup registry check passed on retry", "image", image)
+			return
+		}
+		setStartupRegistryCheckError(err)
+		delay = min(2*delay, startupCheckRetryMax)
+		slog.Warn("startup registry check still failing", "image", image, "retryIn", delay, "error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/config"
+)
+
+func TestCheckRegistryConnectivity(t *testing.T) {
+	indexDigest := digest.FromString(testIndex)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/canary/manifests/latest", "/v2/canary/manifests/" + indexDigest.String():
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest.String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(testIndex))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	prevHosts, prevBreaker := staticRegistryHosts, registryBreaker
+	t.Cleanup(func() { staticRegistryHosts, registryBreaker = prevHosts, prevBreaker })
+	staticRegistryHosts = []config.Host{*host}
+	registryBreaker = newCircuitBreaker(0, breakerWindowDefault, breakerCooldownDefault)
+
+	if err := checkRegistryConnectivity(context.Background(), registry+"/canary:latest"); err != nil {
+		t.Errorf("expected the canary image to be inspected, got %v", err)
+	}
+	if err := checkRegistryConnectivity(context.Background(), registry+"/missing:latest"); err == nil {
+		t.Error("expected an error for an uninspectable canary image")
+	}
+}
+
+func TestStartupRegistryCheckFromEnv(t *testing.T) {
+	t.Setenv("STARTUP_REGISTRY_CHECK", "")
+	t.Setenv("STARTUP_CHECK_IMAGE", "")
+	mode, image, err := startupRegistryCheckFromEnv()
+	if err != nil || mode != StartupRegistryCheckOff || image != startupCheckImageDefault {
+		t.Errorf("unset = %q, %q, %v; want %q, %q", mode, image, err, StartupRegistryCheckOff, startupCheckImageDefault)
+	}
+
+	t.Setenv("STARTUP_REGISTRY_CHECK", "not-ready")
+	t.Setenv("STARTUP_CHECK_IMAGE", "registry.example.com/canary:v1")
+	mode, image, err = startupRegistryCheckFromEnv()
+	if err != nil || mode != StartupRegistryCheckNotReady || image != "registry.example.com/canary:v1" {
+		t.Errorf("custom = %q, %q, %v", mode, image, err)
+	}
+
+	t.Setenv("STARTUP_REGISTRY_CHECK", "true")
+	if _, _, err := startupRegistryCheckFromEnv(); err == nil {
+		t.Error("expected an error for STARTUP_REGISTRY_CHECK=true")
+	}
+}
+
+func TestReadyzHandler_StartupRegistryCheck(t *testing.T) {
+	platformConfig = nil
+	t.Cleanup(func() { setStartupRegistryCheckError(nil) })
+	setStartupRegistryCheckError(errors.New("failed to inspect canary image"))
+
+	router := newTestRouter(t)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503; body=%s", w.Code, w.Body.String())
+	}
+}
+
+func TestRunStartupRegistryCheck_NotReadyRecovers(t *testing.T) {
+	indexDigest := digest.FromString(testIndex)
+	var up atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "registry unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Header().Set("Docker-Content-Digest", indexDigest.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(testIndex)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(testIndex))
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	host := config.HostNewName(registry)
+	host.TLS = config.TLSDisabled
+	prevHosts, prevBreaker := staticRegistryHosts, registryBreaker
+	prevInitial, prevMax := startupCheckRetryInitial, startupCheckRetryMax
+	t.Cleanup(func() {
+		staticRegistryHosts, registryBreaker = prevHosts, prevBreaker
+		startupCheckRetryInitial, startupCheckRetryMax = prevInitial, prevMax
+		setStartupRegistryCheckError(nil)
+	})
+	staticRegistryHosts = []config.Host{*host}
+	registryBreaker = newCircuitBreaker(0, breakerWindowDefault, breakerCooldownDefault)
+	startupCheckRetryInitial, startupCheckRetryMax = 10*time.Millisecond, 20*time.Millisecond
+	t.Setenv("STARTUP_REGISTRY_CHECK", StartupRegistryCheckNotReady)
+	t.Setenv("STARTUP_CHECK_IMAGE", registry+"/canary:latest")
+
+	runStartupRegistryCheck()
+	if startupRegistryCheckError() == nil {
+		t.Fatal("expected the failed startup check to report not-ready")
+	}
+
+	up.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for startupRegistryCheckError() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a background retry to clear the startup check failure")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// structuredConfig is the JSON document accepted in the CONFIG environment
+// variable. Each field stands in for the environment variable named in its
+// comment, so a Helm chart can render one value instead of many.
+type structuredConfig struct {
+	// PlatformTolerations is the PLATFORM_TOLERATIONS array.
+	PlatformTolerations json.RawMessage            `json:"platformTolerations,omitempty"`
+	NamespaceFilter     *structuredNamespaceFilter `json:"namespaceFilter,omitempty"`
+	Cache               *structuredCacheConfig     `json:"cache,omitempty"`
+	TLS                 *structuredTLSConfig       `json:"tls,omitempty"`
+	// Env sets any other environment variable by name, e.g. "ECR_AUTH".
+	Env map[string]string `json:"env,omitempty"`
+}
+
+type structuredNamespaceFilter struct {
+	NamespaceSelector       string   `json:"namespaceSelector,omitempty"`       // NAMESPACE_SELECTOR
+	PodSelector             string   `json:"podSelector,omitempty"`             // POD_LABEL_SELECTOR
+	NamespacesToIgnore      []string `json:"namespacesToIgnore,omitempty"`      // NAMESPACES_TO_IGNORE
+	NamespacesToIgnoreRegex []string `json:"namespacesToIgnoreRegex,omitempty"` // NAMESPACES_TO_IGNORE_REGEX
+}
+
+type structuredCacheConfig struct {
+	Backend              string   `json:"backend,omitempty"`              // CACHE
+	Size                 *int     `json:"size,omitempty"`                 // CACHE_SIZE
+	Policy               string   `json:"policy,omitempty"`               // CACHE_POLICY
+	MaxAge               string   `json:"maxAge,omitempty"`               // CACHE_MAX_AGE
+	RedisAddr            string   `json:"redisAddr,omitempty"`            // REDIS_ADDR
+	L1TTL                string   `json:"l1TTL,omitempty"`                // CACHE_L1_TTL
+	KeyPrefix            string   `json:"keyPrefix,omitempty"`            // CACHE_KEY_PREFIX
+	Version              string   `json:"version,omitempty"`              // CACHE_VERSION
+	StaleWhileRevalidate string   `json:"staleWhileRevalidate,omitempty"` // CACHE_STALE_WHILE_REVALIDATE
+	TTLJitter            *float64 `json:"ttlJitter,omitempty"`            // CACHE_TTL_JITTER
+	MutableTagTTL        string   `json:"mutableTagTTL,omitempty"`        // MUTABLE_TAG_TTL
+}
+
+type structuredTLSConfig struct {
+	Enabled  *bool  `json:"enabled,omitempty"`  // TLS_ENABLED
+	CertPath string `json:"certPath,omitempty"` // CERT_PATH
+	KeyPath  string `json:"keyPath,omitempty"`  // KEY_PATH
+}
+
+// LoadConfig applies the JSON document in CONFIG by exporting each setting it
+// contains as the equivalent environment variable, so the existing loaders pick
+// it up unchanged. Environment variables that are already set take precedence
+// over the document. Unknown fields are rejected so a typo fails at startup.
+func LoadConfig() error {
+	raw := os.Getenv("CONFIG")
+	if raw == "" {
+		return nil
+	}
+	var cfg structuredConfig
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return fmt.Errorf("invalid CONFIG: %w", err)
+	}
+
+	env, err := cfg.envVars()
+	if err != nil {
+		return fmt.Errorf("invalid CONFIG: %w", err)
+	}
+	for name, value := range env {
+		if _, set := os.LookupEnv(name); set {
+			slog.Info("environment variable overrides CONFIG", "name", name)
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return fmt.Errorf("failed to apply CONFIG setting %s: %w", name, err)
+		}
+	}
+	slog.Info("loaded structured config from CONFIG", "settings", len(env))
+	return nil
+}
+
+// envVars returns the environment variables the document stands in for.
+func (c *structuredConfig) envVars() (map[string]string, error) {
+	env := map[string]string{}
+	for name, value := range c.Env {
+		if name == "" || name == "CONFIG" {
+			return nil, fmt.Errorf("env: invalid variable name %q", name)
+		}
+		env[name] = value
+	}
+
+	set := func(name, value string) {
+		if value != "" {
+			env[name] = value
+		}
+	}
+	if len(c.PlatformTolerations) > 0 {
+		set("PLATFORM_TOLERATIONS", string(c.PlatformTolerations))
+	}
+	if f := c.NamespaceFilter; f != nil {
+		set("NAMESPACE_SELECTOR", f.NamespaceSelector)
+		set("POD_LABEL_SELECTOR", f.PodSelector)
+		set("NAMESPACES_TO_IGNORE", strings.Join(f.NamespacesToIgnore, ","))
+		set("NAMESPACES_TO_IGNORE_REGEX", strings.Join(f.NamespacesToIgnoreRegex, ","))
+	}
+	if cc := c.Cache; cc != nil {
+		set("CACHE", cc.Backend)
+		if cc.Size != nil {
+			set("CACHE_SIZE", strconv.Itoa(*cc.Size))
+		}
+		set("CACHE_POLICY", cc.Policy)
+		set("CACHE_MAX_AGE", cc.MaxAge)
+		set("REDIS_ADDR", cc.RedisAddr)
+		set("CACHE_L1_TTL", cc.L1TTL)
+		set("CACHE_KEY_PREFIX", cc.KeyPrefix)
+		set("CACHE_VERSION", cc.Version)
+		set("CACHE_STALE_WHILE_REVALIDATE", cc.StaleWhileRevalidate)
+		if cc.TTLJitter != nil {
+			set("CACHE_TTL_JITTER", strconv.FormatFloat(*cc.TTLJitter, 'g', -1, 64))
+		}
+		set("MUTABLE_TAG_TTL", cc.MutableTagTTL)
+	}
+	if t := c.TLS; t != nil {
+		if t.Enabled != nil {
+			set("TLS_ENABLED", strconv.FormatBool(*t.Enabled))
+		}
+		set("CERT_PATH", t.CertPath)
+		set("KEY_PATH", t.KeyPath)
+	}
+	return env, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// unsetEnv unsets the named variables for the duration of the test, restoring
+// them afterwards even if the code under test sets them.
+func unsetEnv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	unsetEnv(t,
+		"PLATFORM_TOLERATIONS", "NAMESPACE_SELECTOR", "NAMESPACES_TO_IGNORE", "POD_LABEL_SELECTOR",
+		"CACHE", "CACHE_SIZE", "CACHE_POLICY", "TLS_ENABLED", "CERT_PATH", "KEY_PATH", "HOST", "PORT",
+		"ECR_AUTH",
+	)
+	t.Setenv("CONFIG", `{
+		"platformTolerations": [{"platform": "linux/arm64", "key": "arch", "value": "arm64"}],
+		"namespaceFilter": {"namespaceSelector": "env=prod", "namespacesToIgnore": ["kube-system", "kube-public"]},
+		"cache": {"backend": "inmemory", "size": 42, "policy": "lru"},
+		"tls": {"enabled": true, "certPath": "/tls/cert.pem", "keyPath": "/tls/key.pem"},
+		"env": {"ECR_AUTH": "true"}
+	}`)
+
+	if err := LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	platforms, err := LoadPlatformTolerationConfig()
+	if err != nil {
+		t.Fatalf("LoadPlatformTolerationConfig() error = %v", err)
+	}
+	if len(platforms.Mappings) != 1 || platforms.Mappings[0].Toleration.Key != "arch" {
+		t.Errorf("mappings = %+v, want the arch mapping from CONFIG", platforms.Mappings)
+	}
+
+	filter, err := LoadNamespaceFilterConfig()
+	if err != nil {
+		t.Fatalf("LoadNamespaceFilterConfig() error = %v", err)
+	}
+	if filter.NamespaceSelector.String() != "env=prod" || !filter.NamespacesToIgnore["kube-public"] {
+		t.Errorf("namespace filter = %+v, want the filter from CONFIG", filter)
+	}
+
+	c, err := newCacheFromEnv()
+	if err != nil {
+		t.Fatalf("newCacheFromEnv() error = %v", err)
+	}
+	if inMemory, ok := c.(*InMemoryCache); !ok || inMemory.size != 42 || inMemory.policy != "lru" {
+		t.Errorf("cache = %+v, want a 42-entry lru in-memory cache", c)
+	}
+
+	s := serverSettingsFromEnv()
+	if !s.tlsEnabled || s.certPath != "/tls/cert.pem" || s.keyPath != "/tls/key.pem" {
+		t.Errorf("server settings = %+v, want TLS from CONFIG", s)
+	}
+
+	if os.Getenv("ECR_AUTH") != "true" {
+		t.Errorf("ECR_AUTH = %q, want true from the env section", os.Getenv("ECR_AUTH"))
+	}
+}
+
+func TestLoadConfig_EnvOverrides(t *testing.T) {
+	unsetEnv(t, "CACHE_POLICY")
+	t.Setenv("CACHE_SIZE", "5")
+	t.Setenv("CONFIG", `{"cache": {"size": 42, "policy": "lfu"}}`)
+
+	if err := LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got := os.Getenv("CACHE_SIZE"); got != "5" {
+		t.Errorf("CACHE_SIZE = %q, want the explicitly set 5", got)
+	}
+	if got := os.Getenv("CACHE_POLICY"); got != "lfu" {
+		t.Errorf("CACHE_POLICY = %q, want lfu from CONFIG", got)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		`not json`,
+		`{"cache": {"sise": 42}}`,
+		`{"env": {"CONFIG": "{}"}}`,
+	} {
+		t.Setenv("CONFIG", raw)
+		if err := LoadConfig(); err == nil {
+			t.Errorf("expected an error for CONFIG=%s", raw)
+		}
+	}
+}